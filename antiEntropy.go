@@ -0,0 +1,276 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// defaultAntiEntropyInterval is used when ANTI_ENTROPY_INTERVAL isn't set
+const defaultAntiEntropyInterval = 10 * time.Second
+
+type AntiEntropyMetrics struct {
+	Rounds          int       `json:"rounds"`
+	FailedRounds    int       `json:"failed-rounds"`
+	BucketsRepaired int       `json:"buckets-repaired"`
+	KeysRepaired    int       `json:"keys-repaired"`
+	KeysDeleted     int       `json:"keys-deleted"`
+	LastRound       time.Time `json:"last-round"`
+}
+
+type MerkleTreeResponse struct {
+	Tree MerkleTree  `json:"tree"`
+	Vc   VectorClock `json:"Vc"`
+}
+
+// BucketsResponse carries the version vectors of the keys of some buckets,
+// including the keys that were deleted
+type BucketsResponse struct {
+	Dvvs map[string]*KeyDVV `json:"Dvvs"`
+	Vc   VectorClock        `json:"Vc"`
+}
+
+func parseAntiEntropyInterval(interval string) time.Duration {
+	if interval == "" {
+		return defaultAntiEntropyInterval
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// snapshot returns a copy of the kv store along with the vector clock that
+// produced it.
+func (r *Replica) snapshot() (map[string]any, VectorClock) {
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	r.vcLock.Lock()
+	defer r.vcLock.Unlock()
+
+	kv := make(map[string]any, len(r.kv))
+	maps.Copy(kv, r.kv)
+	return kv, CloneVC(*r.vc)
+}
+
+// snapshotData returns a copy of the kv store and of the version vectors of
+// its keys, along with the vector clock that produced them
+func (r *Replica) snapshotData() (map[string]any, VectorClock, map[string]*KeyDVV) {
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	r.vcLock.Lock()
+	defer r.vcLock.Unlock()
+
+	kv := maps.Clone(r.kv)
+	dvvs := make(map[string]*KeyDVV, len(r.dvvs))
+	for k, d := range r.dvvs {
+		dvvs[k] = d.clone()
+	}
+	return kv, CloneVC(*r.vc), dvvs
+}
+
+// merkleData returns what the Merkle trees are built from, along with the
+// vector clock that produced it: the value of every key, paired with the dots
+// of its siblings if it has concurrent ones, so that replicas holding the same
+// value but different siblings still repair each other.
+func (r *Replica) merkleData() (map[string]any, VectorClock) {
+	kv, vc, dvvs := r.snapshotData()
+	for k, v := range kv {
+		d, ok := dvvs[k]
+		if !ok || len(d.Siblings) < 2 {
+			continue
+		}
+		var dots []Dot
+		for _, s := range d.Siblings {
+			dots = append(dots, s.Dot)
+		}
+		slices.SortFunc(dots, func(a, b Dot) int {
+			return cmp.Or(strings.Compare(a.Id, b.Id), cmp.Compare(a.Counter, b.Counter))
+		})
+		kv[k] = map[string]any{"value": v, "siblings": dots}
+	}
+	return kv, vc
+}
+
+// runAntiEntropy periodically reconciles this replica with a random member of
+// its shard. It returns immediately if anti-entropy is disabled.
+func (r *Replica) runAntiEntropy() {
+	if r.antiEntropyInterval <= 0 {
+		return
+	}
+	for r.sleep(r.antiEntropyInterval) {
+		if r.getShardId() == "" {
+			continue
+		}
+		err := r.antiEntropyRound()
+
+		r.aeLock.Lock()
+		r.aeMetrics.Rounds++
+		r.aeMetrics.LastRound = time.Now()
+		if err != nil {
+			r.aeMetrics.FailedRounds++
+		}
+		r.aeLock.Unlock()
+
+		if err != nil {
+			zap.L().Warn("Anti-entropy round failed", zap.Error(err))
+		}
+	}
+}
+
+// antiEntropyRound pulls the differing buckets from a peer whose state isn't
+// behind this replica's. Peers that are behind will pull from us in their own
+// rounds.
+func (r *Replica) antiEntropyRound() error {
+	peers := FilterViews(r.shardMembers(), r.addr)
+	if len(peers) == 0 {
+		return nil
+	}
+	peer := peers[r.aeRand.Intn(len(peers))]
+
+	var remote MerkleTreeResponse
+	if err := getJSON(r.transport, OpReplication, peer, "/anti-entropy/tree", &remote); err != nil {
+		return err
+	}
+
+	kv, vc := r.merkleData()
+	local := BuildMerkleTree(kv)
+
+	// Nothing to learn from a peer that has seen a subset of our writes
+	if order := vc.Compare(&remote.Vc); order >= 0 {
+		return nil
+	}
+
+	diff := local.Diff(&remote.Tree)
+	if len(diff) == 0 {
+		r.mergeVC(remote.Vc)
+		return nil
+	}
+
+	var ids []string
+	for _, b := range diff {
+		ids = append(ids, strconv.Itoa(b))
+	}
+	var buckets BucketsResponse
+	if err := getJSON(r.transport, OpBulk, peer, "/anti-entropy/buckets?ids="+strings.Join(ids, ","), &buckets); err != nil {
+		return err
+	}
+
+	repaired, deleted := r.repairBuckets(diff, buckets.Dvvs)
+	r.mergeVC(buckets.Vc)
+
+	r.aeLock.Lock()
+	r.aeMetrics.BucketsRepaired += len(diff)
+	r.aeMetrics.KeysRepaired += repaired
+	r.aeMetrics.KeysDeleted += deleted
+	r.aeLock.Unlock()
+
+	zap.L().Info("Anti-entropy repaired buckets", zap.String("peer", peer), zap.Ints("buckets", diff), zap.Int("keys-repaired", repaired), zap.Int("keys-deleted", deleted))
+	return nil
+}
+
+// repairBuckets merges the version vectors of the peer's keys in the given
+// buckets into the local ones. Merging works on the current version vectors
+// rather than on a snapshot, so writes applied since the round started are
+// kept unless the peer superseded them, and each key ends up holding the
+// winning sibling, which is the same on every replica.
+func (r *Replica) repairBuckets(buckets []int, remote map[string]*KeyDVV) (repaired int, deleted int) {
+	inDiff := make(map[int]bool)
+	for _, b := range buckets {
+		inDiff[b] = true
+	}
+
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+
+	for k, o := range remote {
+		if !inDiff[merkleBucket(k)] || r.isStronglyConsistent(k) {
+			continue
+		}
+		_, existed := r.kv[k]
+		if !r.mergeDVV(k, o) {
+			continue
+		}
+		if _, exists := r.kv[k]; existed && !exists {
+			deleted++
+		} else {
+			repaired++
+		}
+	}
+	return repaired, deleted
+}
+
+// mergeVC takes the entry-wise maximum of the replica's clock and vc
+func (r *Replica) mergeVC(vc VectorClock) {
+	r.vcLock.Lock()
+	for client, entry := range vc.Clocks {
+		if entry > r.vc.Clocks[client] {
+			r.vc.Clocks[client] = entry
+		}
+	}
+	r.vc.observe(vc.Timestamp)
+	r.vcLock.Unlock()
+	r.waits.Notify()
+}
+
+// getJSON sends a GET request for endpoint to addr through t and decodes the
+// JSON response into v. op decides the timeout of the request.
+func getJSON(t Transport, op Operation, addr string, endpoint string, v any) error {
+	res, err := t.Send(HttpRequest{
+		method:   http.MethodGet,
+		endpoint: endpoint,
+		addr:     addr,
+		op:       op,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s from %s returned %d", endpoint, addr, res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (r *Replica) handleMerkleTreeGet(c echo.Context) error {
+	kv, vc := r.merkleData()
+	return c.JSON(http.StatusOK, MerkleTreeResponse{Tree: *BuildMerkleTree(kv), Vc: vc})
+}
+
+func (r *Replica) handleBucketsGet(c echo.Context) error {
+	wanted := make(map[int]bool)
+	for _, id := range strings.Split(c.QueryParam("ids"), ",") {
+		b, err := strconv.Atoi(id)
+		if err != nil || b < 0 || b >= merkleLeaves {
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid bucket id"})
+		}
+		wanted[b] = true
+	}
+
+	// The clock is taken first so that it doesn't cover writes missing from
+	// the version vectors
+	_, vc := r.snapshot()
+	dvvs := r.snapshotDVVs(func(k string) bool { return wanted[merkleBucket(k)] })
+	return c.JSON(http.StatusOK, BucketsResponse{Dvvs: dvvs, Vc: vc})
+}
+
+func (r *Replica) handleAntiEntropyMetrics(c echo.Context) error {
+	r.aeLock.Lock()
+	defer r.aeLock.Unlock()
+	return c.JSON(http.StatusOK, r.aeMetrics)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check that anti-entropy keeps concurrent writes as siblings and converges
+// on the same winner on both sides, and that it spreads deletions
+func Test_AntiEntropyMergesVersionVectors(t *testing.T) {
+	tc := startCluster(t, 2, 1)
+	addrs := tc.addrs()
+	// Leave the replication of writes to anti-entropy
+	for _, r := range tc.nodes {
+		r.outbox.Stop()
+	}
+
+	status, err := tc.client().Put(addrs[0], "k", "x")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	status, err = tc.client().Put(addrs[1], "k", "y")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+
+	assert.NoError(t, tc.nodes[0].antiEntropyRound())
+	assert.NoError(t, tc.nodes[1].antiEntropyRound())
+	for i := range tc.nodes {
+		assert.Equal(t, map[string]any{"k": "y"}, tc.kv(i))
+		res, status, err := tc.client().Get(addrs[i], "k")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, status)
+		assert.ElementsMatch(t, []any{"x", "y"}, res.Siblings, "replica %d", i)
+	}
+
+	// A deletion made in the context of both siblings supersedes them
+	status, err = tc.client().Delete(addrs[0], "k")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NoError(t, tc.nodes[1].antiEntropyRound())
+	assert.Empty(t, tc.kv(1))
+	assert.Equal(t, 1, tc.nodes[1].aeMetrics.KeysDeleted)
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
 	"net/http"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,71 +11,103 @@ import (
 
 type BroadcastRequest = BufferAtSenderRequest
 
-type BroadcastFirstRequest struct {
-	BroadcastRequest
-	srcAddr string
-}
+// broadcastParallelism bounds the number of targets a broadcast sends to at
+// the same time
+const broadcastParallelism = 8
 
-// Broadcast sends the requests to all the nodes in br.Targets
-func Broadcast(br *BroadcastRequest) []FailingRequest {
+// Broadcast sends the requests to all the nodes in br.Targets, up to
+// broadcastParallelism of them at a time, and returns the requests that failed
+// in the order of br.Targets. It returns once every target answered, so the
+// requests of successive broadcasts reach each target in order.
+func (r *Replica) Broadcast(br *BroadcastRequest) []FailingRequest {
 	// zap.L().Info("In Broadcast", zap.Any("payload", *br))
-	var failingReqs []FailingRequest
+	// A target listed more than once gets its requests one after the other
+	var targets []string
+	counts := make(map[string]int)
+	for _, addr := range br.Targets {
+		if counts[addr] == 0 {
+			targets = append(targets, addr)
+		}
+		counts[addr]++
+	}
 
-	urls := br.Targets
-	for _, addr := range urls {
-		// Create request
-		payload := br.Payload
-		endpoint := br.Endpoint
-		method := br.Method
+	results := make([][]FailingRequest, len(targets))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, broadcastParallelism)
+	for i, addr := range targets {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			for range counts[addr] {
+				if fr := r.broadcastTo(br, addr); fr != nil {
+					results[i] = append(results[i], *fr)
+				}
+			}
+		}()
+	}
+	wg.Wait()
 
-		res, err := SendRequest(HttpRequest{
-			method:   method,
-			endpoint: endpoint,
-			addr:     addr,
-			payload:  payload,
-		})
-		if err != nil {
-			failingReqs = append(failingReqs, FailingRequest{
-				address: addr,
-				err:     errors.New("failed request"),
-			})
-			zap.L().Warn("Request failed to", zap.String("addr", addr), zap.String("method", method), zap.Error(err))
-			continue
+	var failingReqs []FailingRequest
+	for _, failed := range results {
+		failingReqs = append(failingReqs, failed...)
+	}
+	return failingReqs
+}
 
+// broadcastTo sends the request of br to addr and returns a FailingRequest if
+// it failed
+func (r *Replica) broadcastTo(br *BroadcastRequest, addr string) *FailingRequest {
+	method := br.Method
+	res, err := r.transport.Send(HttpRequest{
+		method:   method,
+		endpoint: br.Endpoint,
+		addr:     addr,
+		payload:  br.Payload,
+		op:       br.Op,
+	})
+	if err != nil {
+		zap.L().Warn("Request failed to", zap.String("addr", addr), zap.String("method", method), zap.Error(err))
+		return &FailingRequest{
+			address: addr,
+			err:     errors.New("failed request"),
 		}
-		// Retry if status code is 503
-		if res.StatusCode == 503 {
-			zap.L().Info("Response returned 503. Going to retry this", zap.String("addr", addr), zap.String("method", method))
-			failingReqs = append(failingReqs, FailingRequest{
-				address: addr,
-			})
-			continue
+	}
+	drain(res)
+	// Retry if status code is 503
+	if res.StatusCode == 503 {
+		zap.L().Info("Response returned 503. Going to retry this", zap.String("addr", addr), zap.String("method", method))
+		return &FailingRequest{
+			address: addr,
 		}
 	}
-	return failingReqs
+	return nil
 }
 
 // BroadcastFirst sends requests to the list of target nodes until one
 // responds successfully. If one fails to respond it sends a delete request
-func BroadcastFirst(br *BroadcastFirstRequest) (*http.Response, error) {
+func (r *Replica) BroadcastFirst(br *BroadcastRequest) (*http.Response, error) {
 	var (
 		res *http.Response
 		err error
 	)
 	for _, n := range br.Targets {
 		p := br.Payload
-		res, err = SendRequest(HttpRequest{
+		res, err = r.transport.Send(HttpRequest{
 			method:   br.Method,
 			endpoint: br.Endpoint,
 			addr:     n,
 			payload:  p,
+			op:       br.Op,
+			timeout:  br.Timeout,
 		})
 		if err == nil {
 			break
 		}
 		// zap.L().Warn("couldn't send read request", zap.String("remote-node", n))
 		zap.L().Info("deleting node", zap.String("delete-node", n))
-		sendViewRequest(http.MethodDelete, br.srcAddr, n, "")
+		r.removeFromView(n)
 	}
 	return res, nil
 
@@ -89,30 +118,17 @@ type HttpRequest struct {
 	endpoint string
 	addr     string
 	payload  any
+	// op decides the timeout of the request, unless timeout is set
+	op      Operation
+	timeout time.Duration
+	// from is the replica sending the request, if any
+	from string
 }
 
-func SendRequest(r HttpRequest) (*http.Response, error) {
-	requestURL, err := url.Parse(fmt.Sprintf("http://%s%s", r.addr, r.endpoint))
-	if err != nil {
-		zap.L().Error("Couldn't parse URL", zap.Error(err))
-		return nil, err
-	}
-
-	json, err := json.Marshal(r.payload)
-	if err != nil {
-		zap.L().Error("Couldn't marshal to JSON", zap.Error(err))
-		return nil, err
-	}
-
-	req, err := http.NewRequest(r.method, requestURL.String(), bytes.NewBuffer(json))
-	if err != nil {
-		zap.L().Error("Couldn't construct request", zap.Error(err))
-		return nil, err
-	}
+// defaultRequestTimeout is the default timeout of replication requests
+const defaultRequestTimeout = 200 * time.Millisecond
 
-	req.Header.Set("Content-Type", "application/json")
-	client := http.Client{
-		Timeout: 200 * time.Millisecond,
-	}
-	return client.Do(req)
+// SendRequest sends r over HTTP through a pool shared by every caller
+func SendRequest(r HttpRequest) (*http.Response, error) {
+	return defaultPool.Send(r)
 }
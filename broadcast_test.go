@@ -2,116 +2,214 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// testServer serves handler on a loopback port and returns its address
+func testServer(t *testing.T, handler http.HandlerFunc) string {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
 func Test_SendRequest_GET(t *testing.T) {
-	_, err := SendRequest(HttpRequest{
+	addr := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/view", r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	res, err := SendRequest(HttpRequest{
 		method:   http.MethodGet,
-		endpoint: "/",
-		addr:     "www.google.com",
+		endpoint: "/view",
+		addr:     addr,
 	})
 
 	assert.NoError(t, err)
-
+	assert.Equal(t, http.StatusOK, res.StatusCode)
 }
 
-/*
-import (
-	"net/http"
-	"net/http/httptest"
-	"testing"
-	"time"
-
-	"github.com/stretchr/testify/assert"
-)
+// countingServer serves status to every request and counts the requests
+func countingServer(t *testing.T, status int) (string, func() int) {
+	var (
+		lock  sync.Mutex
+		tries int
+	)
+	addr := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		tries++
+		lock.Unlock()
+		w.WriteHeader(status)
+	})
+	return addr, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return tries
+	}
+}
 
+func testBufferAtSender(t *testing.T, targets ...string) *Replica {
+	r := &Replica{outbox: NewOutbox(t.TempDir(), func(string, OutboxEntry) {
+		t.Error("target should be reachable")
+	})}
+	assert.NoError(t, r.BufferAtSender(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/",
+		Targets:  targets,
+	}))
+	assert.Eventually(t, func() bool {
+		return r.outbox.Status().Depth == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	return r
+}
 
 // Simple smoke test to ensure no concurrency issues
-func TestLongPollSmoke(t *testing.T) {
-	timeout := time.After(3 * time.Second)
-	done := make(chan bool)
-	go func() {
-		assert.NoError(t, LongPoll(&PollRequest{
-			Method:   "GET",
-			Payload:  nil,
-			Endpoint: "/",
-			Replicas: []string{"https://google.com"},
-		}))
-		done <- true
-	}()
-	select {
-	case <-timeout:
-		t.Fatal("Test timed out")
-	case <-done:
+func Test_BufferAtSenderSmoke(t *testing.T) {
+	var targets []string
+	var counts []func() int
+	for i := 0; i < 5; i++ {
+		addr, tries := countingServer(t, http.StatusOK)
+		targets = append(targets, addr)
+		counts = append(counts, tries)
+	}
+	testBufferAtSender(t, targets...)
+	for _, tries := range counts {
+		assert.Equal(t, 1, tries())
 	}
 }
 
 // Check that we don't retry non-503 errors
-func TestLongPoll_FailingNon503(t *testing.T) {
-	tries := 0
-	badSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tries++
-		w.WriteHeader(404)
-	}))
-	defer badSvr.Close()
-	timeout := time.After(3 * time.Second)
-	done := make(chan bool)
-	go func() {
-		assert.NoError(t, LongPoll(&PollRequest{
-			Method:   "GET",
-			Payload:  nil,
-			Endpoint: "/",
-			Replicas: []string{badSvr.URL},
-		}))
-		done <- true
-	}()
-	select {
-	case <-timeout:
-		t.Fatal("Test timed out")
-	case <-done:
-	}
-	assert.Equal(t, tries, 1)
-
+func Test_BufferAtSenderFailingNon503(t *testing.T) {
+	addr, tries := countingServer(t, http.StatusNotFound)
+	testBufferAtSender(t, addr)
+	assert.Equal(t, 1, tries())
 }
 
 // Check that we don't retry successful responses
-func TestLongPoll_SuccessServer(t *testing.T) {
-	tries := 0
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tries++
-		w.WriteHeader(200)
-	}))
-	defer srv.Close()
-	timeout := time.After(3 * time.Second)
-	done := make(chan bool)
-	go func() {
-		assert.NoError(t, LongPoll(&PollRequest{
-			Method:   "GET",
-			Payload:  nil,
+func Test_BufferAtSenderSuccessServer(t *testing.T) {
+	addr, tries := countingServer(t, http.StatusOK)
+	testBufferAtSender(t, addr)
+	assert.Equal(t, 1, tries())
+}
+
+// Check that we don't allow requests other than PUT & DELETE
+func Test_BufferAtSenderInvalidMethod(t *testing.T) {
+	r := &Replica{outbox: NewOutbox(t.TempDir(), nil)}
+	for _, method := range []string{http.MethodGet, http.MethodPatch} {
+		assert.Error(t, r.BufferAtSender(&BufferAtSenderRequest{
+			Method:   method,
 			Endpoint: "/",
-			Replicas: []string{srv.URL},
+			Targets:  []string{"unreachable:1"},
 		}))
-		done <- true
-	}()
-	select {
-	case <-timeout:
-		t.Fatal("Test timed out")
-	case <-done:
 	}
-	assert.Equal(t, tries, 1)
+	assert.Equal(t, 0, r.outbox.Status().Depth)
 }
 
-// Check that we don't allow non-GET, PUT, & DELETE requests
-func TestLongPoll_InvalidMethod(t *testing.T) {
-	assert.Error(t, LongPoll(&PollRequest{
-		Method:   "PATCH",
-		Payload:  nil,
-		Endpoint: "/",
-		Replicas: []string{"https://google.com"},
-	}))
+// Check that Broadcast sends to its targets concurrently, up to
+// broadcastParallelism at a time, and that broadcasts running at the same
+// time, such as a reshard and a view change, each reach every target. Each
+// request is held until its broadcast has broadcastParallelism requests in
+// flight, so a broadcast that sent fewer at a time would stall.
+func Test_BroadcastConcurrent(t *testing.T) {
+	endpoints := []string{"/reshard", "/view"}
+	var (
+		lock    sync.Mutex
+		active  = make(map[string]int)
+		maxSeen = make(map[string]int)
+		full    = make(map[string]chan struct{})
+		reached = make(map[string]map[string]int)
+	)
+	for _, e := range endpoints {
+		full[e] = make(chan struct{})
+		reached[e] = make(map[string]int)
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		e := r.URL.Path
+		lock.Lock()
+		active[e]++
+		maxSeen[e] = max(maxSeen[e], active[e])
+		if active[e] == broadcastParallelism {
+			close(full[e])
+		}
+		lock.Unlock()
+		// Give up well before the request times out, so that a broadcast
+		// sending too few requests at a time fails on maxSeen
+		select {
+		case <-full[e]:
+		case <-time.After(defaultRequestTimeout / 2):
+		}
+		lock.Lock()
+		active[e]--
+		reached[e][r.Host]++
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}
+	var targets []string
+	for range 2 * broadcastParallelism {
+		targets = append(targets, testServer(t, handler))
+	}
+
+	r := &Replica{transport: defaultPool}
+	var done sync.WaitGroup
+	for _, e := range endpoints {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			failed := r.Broadcast(&BroadcastRequest{Method: http.MethodPut, Endpoint: e, Targets: targets})
+			assert.Empty(t, failed, "broadcast to %s", e)
+		}()
+	}
+	done.Wait()
+
+	for _, e := range endpoints {
+		assert.Equal(t, broadcastParallelism, maxSeen[e], "requests to %s in flight at a time", e)
+		assert.Len(t, reached[e], len(targets), "targets reached by the broadcast to %s", e)
+		for _, addr := range targets {
+			assert.Equal(t, 1, reached[e][addr], "requests to %s%s", addr, e)
+		}
+	}
+}
+
+// Check that Broadcast returns the failed requests in the order of their
+// targets, and sends the requests to a target listed twice one at a time
+func Test_BroadcastFailingRequests(t *testing.T) {
+	unavailable, _ := countingServer(t, http.StatusServiceUnavailable)
+	ok, tries := countingServer(t, http.StatusOK)
+	var (
+		lock   sync.Mutex
+		active int
+	)
+	slow := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		active++
+		assert.Equal(t, 1, active)
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		active--
+		lock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
 
+	r := &Replica{transport: defaultPool}
+	failed := r.Broadcast(&BroadcastRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/",
+		Targets:  []string{"127.0.0.1:1", slow, unavailable, ok, slow},
+	})
+	assert.Equal(t, 1, tries())
+	if assert.Len(t, failed, 4) {
+		assert.Equal(t, "127.0.0.1:1", failed[0].address)
+		assert.Error(t, failed[0].err)
+		for i, addr := range []string{slow, slow, unavailable} {
+			assert.Equal(t, addr, failed[i+1].address)
+			assert.NoError(t, failed[i+1].err)
+		}
+	}
 }
-*/
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultCausalWait is how long a request waits for its causal
+	// dependencies when the client doesn't say. It stays below the timeout of
+	// requests between replicas so that parked broadcasts aren't mistaken for
+	// unreachable replicas.
+	defaultCausalWait = 100 * time.Millisecond
+	maxCausalWait     = 30 * time.Second
+)
+
+var ErrInvalidWait = errors.New("invalid wait")
+
+// CausalWaitQueue parks requests whose causal dependencies haven't been
+// applied yet, and wakes them whenever the clock of the replica advances so
+// that they check their dependencies again
+type CausalWaitQueue struct {
+	lock     sync.Mutex
+	advanced chan struct{}
+	parked   int
+}
+
+func NewCausalWaitQueue() *CausalWaitQueue {
+	return &CausalWaitQueue{advanced: make(chan struct{})}
+}
+
+// Notify wakes every parked request
+func (q *CausalWaitQueue) Notify() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	close(q.advanced)
+	q.advanced = make(chan struct{})
+}
+
+// Parked returns how many requests are waiting
+func (q *CausalWaitQueue) Parked() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.parked
+}
+
+// Wait blocks until ready returns true or the deadline passes, and returns the
+// last result of ready
+func (q *CausalWaitQueue) Wait(ready func() bool, deadline time.Time) bool {
+	q.lock.Lock()
+	advanced := q.advanced
+	q.lock.Unlock()
+	if ready() {
+		return true
+	}
+
+	q.lock.Lock()
+	q.parked++
+	q.lock.Unlock()
+	defer func() {
+		q.lock.Lock()
+		q.parked--
+		q.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case <-advanced:
+		case <-timer.C:
+			return ready()
+		}
+		// Take the channel before checking so that an advance between the
+		// check and the select isn't missed
+		q.lock.Lock()
+		advanced = q.advanced
+		q.lock.Unlock()
+		if ready() {
+			return true
+		}
+	}
+}
+
+// causalWait returns how long the request may wait for its causal
+// dependencies, given as a duration by the wait query parameter
+func causalWait(c echo.Context) (time.Duration, error) {
+	wait := c.QueryParam("wait")
+	if wait == "" {
+		return defaultCausalWait, nil
+	}
+	d, err := time.ParseDuration(wait)
+	if err != nil || d < 0 {
+		return 0, ErrInvalidWait
+	}
+	return min(d, maxCausalWait), nil
+}
+
+// waitReady waits until the replica is ready for clientClock or until the
+// deadline requested by the client passes
+func (r *Replica) waitReady(c echo.Context, clientClock VectorClock, isRead bool) (bool, error) {
+	wait, err := causalWait(c)
+	if err != nil {
+		return false, err
+	}
+	ready := func() bool {
+		return r.vc.IsReadyFor(restrictVC(clientClock, r.shardMembers()), isRead, &r.vcLock)
+	}
+	return r.waits.Wait(ready, time.Now().Add(wait)), nil
+}
+
+// acceptWrite accepts a write of the client owning clientClock and wakes the
+// requests waiting for it
+func (r *Replica) acceptWrite(clientClock *VectorClock) {
+	if clientClock.Timestamp != nil {
+		r.hlc.Update(*clientClock.Timestamp)
+	}
+	r.vc.Accept(clientClock, false, &r.vcLock)
+	r.waits.Notify()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CausalWaitQueue(t *testing.T) {
+	q := NewCausalWaitQueue()
+	vc := &VectorClock{Clocks: map[string]int{"a": 0}, Self: "r"}
+	var lock sync.Mutex
+	// A client that saw the first write coordinated by a
+	clientClock := VectorClock{Clocks: map[string]int{"a": 1}}
+	ready := func() bool { return vc.IsReadyFor(clientClock, false, &lock) }
+
+	// Requests whose dependencies never arrive give up at the deadline
+	start := time.Now()
+	assert.False(t, q.Wait(ready, start.Add(50*time.Millisecond)))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	done := make(chan bool)
+	go func() { done <- q.Wait(ready, time.Now().Add(5*time.Second)) }()
+	assert.Eventually(t, func() bool { return q.Parked() == 1 }, time.Second, time.Millisecond)
+
+	// Advancing an unrelated entry doesn't release the request
+	vc.Accept(&VectorClock{Clocks: map[string]int{"c": 0}, Self: "c"}, false, &lock)
+	q.Notify()
+	assert.Eventually(t, func() bool { return q.Parked() == 1 }, time.Second, time.Millisecond)
+
+	vc.Accept(&VectorClock{Clocks: map[string]int{"a": 0}, Self: "a"}, false, &lock)
+	q.Notify()
+	select {
+	case ok := <-done:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("request wasn't woken")
+	}
+	assert.Equal(t, 0, q.Parked())
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// chainForwardAttempts is how many times a write is sent to a successor
+	// before the successor is deleted from the view and the chain reconfigured
+	chainForwardAttempts = 3
+	chainForwardBackoff  = 50 * time.Millisecond
+	chainForwardTimeout  = 5 * time.Second
+)
+
+var (
+	ErrChainTimeout = errors.New("chain write timed out")
+	ErrChainGap     = errors.New("chain successor missed earlier writes")
+)
+
+// ChainWrite is a write travelling from the head of a chain to its tail.
+// Writes are numbered by the head so that replicas can ignore the writes they
+// were sent twice after a reconfiguration, and notice the ones they missed.
+type ChainWrite struct {
+	Seq    uint64 `json:"seq"`
+	Method string `json:"method"`
+	Key    string `json:"key"`
+	Value  any    `json:"value,omitempty"`
+	// Timestamp is stamped by the head, so that the write's version has the
+	// same id on every member of the chain
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+}
+
+// parseChainShards parses a comma separated list of shard ids
+func parseChainShards(ids string) map[string]bool {
+	shards := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			shards[id] = true
+		}
+	}
+	return shards
+}
+
+// isChainShard returns whether the replica's shard uses chain replication
+func (r *Replica) isChainShard() bool {
+	return r.chainShards[r.getShardId()]
+}
+
+// chainHead returns the first member of the replica's shard
+func (r *Replica) chainHead() string {
+	members := r.shardMembers()
+	if len(members) == 0 {
+		return ""
+	}
+	return members[0]
+}
+
+// chainTail returns the last member of the replica's shard
+func (r *Replica) chainTail() string {
+	members := r.shardMembers()
+	if len(members) == 0 {
+		return ""
+	}
+	return members[len(members)-1]
+}
+
+// chainSuccessor returns the member following this replica in its shard, or
+// an empty string if this replica is the tail
+func (r *Replica) chainSuccessor() string {
+	members := r.shardMembers()
+	i := slices.Index(members, r.addr)
+	if i < 0 || i == len(members)-1 {
+		return ""
+	}
+	return members[i+1]
+}
+
+// chainFirst orders the members of a chain shard so that a request is
+// forwarded to the replica that serves it: the tail for reads, the head for
+// writes
+func chainFirst(method string, nodes []string) []string {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	first := nodes[0]
+	if method == http.MethodGet {
+		first = nodes[len(nodes)-1]
+	}
+	return append([]string{first}, FilterViews(nodes, first)...)
+}
+
+// removeChainMember reconfigures the chain shards that addr belonged to
+func (r *Replica) removeChainMember(addr string) {
+	r.shardLock.Lock()
+	defer r.shardLock.Unlock()
+	var shards map[string][]string
+	for shardId, members := range r.shards {
+		if r.chainShards[shardId] && slices.Contains(members, addr) {
+			if shards == nil {
+				shards = maps.Clone(r.shards)
+			}
+			shards[shardId] = FilterViews(members, addr)
+			zap.L().Warn("Removed member from chain", zap.String("shard-id", shardId), zap.String("address", addr), zap.Strings("chain", shards[shardId]))
+		}
+	}
+	if shards != nil {
+		r.shards = shards
+	}
+}
+
+// resetChain discards the sequence number of the replica's chain. Sequence
+// numbers are meaningless once the keys of the shard were redistributed by a
+// reshard.
+func (r *Replica) resetChain() {
+	r.chainLock.Lock()
+	defer r.chainLock.Unlock()
+	r.chainSeq = 0
+	r.chainLast = ChainWrite{}
+	r.chainPending = nil
+}
+
+// applyChainWrite applies w to the kv store. The caller must hold r.chainLock.
+func (r *Replica) applyChainWrite(w ChainWrite) {
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+	switch w.Method {
+	case http.MethodPut:
+		r.setKey(w.Key, w.Value, VectorClock{Timestamp: w.Timestamp})
+	case http.MethodDelete:
+		r.deleteKey(w.Key, VectorClock{Timestamp: w.Timestamp})
+	}
+	r.chainSeq = w.Seq
+	r.chainLast = w
+}
+
+// forwardChainWrite sends w down the chain and returns once the tail applied
+// it. Successors that don't respond are deleted from the view, which splices
+// them out of the chain, and w is sent to the next member instead. A successor
+// that missed prev, the write before w, is sent prev first. The caller must
+// hold r.chainLock.
+func (r *Replica) forwardChainWrite(w ChainWrite, prev ChainWrite) error {
+	deadline := time.Now().Add(chainForwardTimeout)
+	failures := 0
+	resent := false
+	for time.Now().Before(deadline) {
+		succ := r.chainSuccessor()
+		if succ == "" {
+			return nil
+		}
+		res, err := r.transport.Send(HttpRequest{
+			method:   http.MethodPut,
+			endpoint: "/chain",
+			addr:     succ,
+			payload:  w,
+		})
+		if err == nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			switch res.StatusCode {
+			case http.StatusOK:
+				return nil
+			case http.StatusConflict:
+				if resent || prev.Seq == 0 || prev.Seq+1 != w.Seq {
+					return ErrChainGap
+				}
+				resent = true
+				if err := r.forwardChainWrite(prev, ChainWrite{}); err != nil {
+					return err
+				}
+				continue
+			}
+		} else if failures++; failures >= chainForwardAttempts {
+			zap.L().Warn("Chain successor unreachable, deleting view", zap.String("address", succ), zap.Error(err))
+			r.removeFromView(succ)
+			failures = 0
+			continue
+		}
+		time.Sleep(chainForwardBackoff)
+	}
+	return ErrChainTimeout
+}
+
+// handleChain serves a request to /kvs/:key in a chain shard. Writes are
+// applied by the head once they reached the tail, and reads are served by the
+// tail, so a read observes every acknowledged write.
+// Requests that reach the wrong member are proxied to the head or the tail.
+func (r *Replica) handleChain(c echo.Context, key string, request *Request) error {
+	method := c.Request().Method
+	if method == http.MethodGet {
+		if tail := r.chainTail(); tail != r.addr {
+			return r.proxyKvRequest(c, key, request, tail)
+		}
+		r.kvLock.RLock()
+		val, ok := r.kv[key]
+		r.kvLock.RUnlock()
+		if !ok {
+			return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
+		}
+		return c.JSON(http.StatusOK, GetResponse{
+			Response:   Response{Result: "found", CausalMetadata: request.CausalMetadata, ShardId: r.getShardId()},
+			StoreValue: StoreValue{Value: val},
+		})
+	}
+
+	if head := r.chainHead(); head != r.addr {
+		return r.proxyKvRequest(c, key, request, head)
+	}
+
+	r.chainLock.Lock()
+	defer r.chainLock.Unlock()
+
+	if p := r.chainPending; p != nil {
+		if err := r.forwardChainWrite(*p, r.chainLast); err != nil {
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: err.Error()})
+		}
+		r.applyChainWrite(*p)
+		r.chainPending = nil
+	}
+
+	r.kvLock.RLock()
+	_, exists := r.kv[key]
+	r.kvLock.RUnlock()
+	if method == http.MethodDelete && !exists {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
+	}
+
+	ts := r.hlc.Now()
+	w := ChainWrite{Seq: r.chainSeq + 1, Method: method, Key: key, Value: request.Value, Timestamp: &ts}
+	if err := r.forwardChainWrite(w, r.chainLast); err != nil {
+		r.chainPending = &w
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: err.Error()})
+	}
+	r.applyChainWrite(w)
+
+	result, status := "replaced", http.StatusOK
+	switch {
+	case method == http.MethodDelete:
+		result = "deleted"
+	case !exists:
+		result, status = "created", http.StatusCreated
+	}
+	return c.JSON(status, Response{Result: result, CausalMetadata: request.CausalMetadata, ShardId: r.getShardId()})
+}
+
+// handleChainWrite applies a write sent by the predecessor of this replica and
+// passes it on to the successor. Writes that were already applied are passed
+// on as well, since the successor may have missed them, while writes that
+// follow a write this replica missed are rejected with a 409, so that the
+// predecessor sends the missing write first.
+func (r *Replica) handleChainWrite(c echo.Context) error {
+	w := new(ChainWrite)
+	if err := c.Bind(w); err != nil || w.Seq == 0 {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+
+	r.chainLock.Lock()
+	defer r.chainLock.Unlock()
+	prev := r.chainLast
+	switch {
+	case w.Seq > r.chainSeq+1:
+		return c.JSON(http.StatusConflict, ErrResponse{Error: ErrChainGap.Error()})
+	case w.Seq == r.chainSeq+1:
+		r.applyChainWrite(*w)
+	}
+	if err := r.forwardChainWrite(*w, prev); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, ActionResponse{Result: "applied"})
+}
+
+// proxyKvRequest forwards a request to /kvs/:key to target and streams back
+// its response. Requests are only proxied once so that replicas with stale
+// views of the shard can't bounce a request between each other.
+func (r *Replica) proxyKvRequest(c echo.Context, key string, request *Request, target string) error {
+	if request.Proxied {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Request was already proxied; try again later"})
+	}
+
+	endpoint := "/kvs/" + key
+	if query := c.QueryString(); query != "" {
+		endpoint += "?" + query
+	}
+	request.Proxied = true
+	// Sessions are kept by the replica the client talks to
+	request.CausalMetadata.Session = ""
+	res, err := r.transport.Send(HttpRequest{
+		method:   c.Request().Method,
+		endpoint: endpoint,
+		addr:     target,
+		payload:  request,
+	})
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Replica " + target + " unreachable; try again later"})
+	}
+	defer res.Body.Close()
+	if leader := res.Header.Get(raftLeaderHeader); leader != "" {
+		c.Response().Header().Set(raftLeaderHeader, leader)
+	}
+	return c.Stream(res.StatusCode, "application/json", res.Body)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ChainOrder(t *testing.T) {
+	r := &Replica{
+		addr:        "b",
+		shardId:     "s0",
+		shards:      map[string][]string{"s0": {"a", "b", "c"}, "s1": {"d", "e"}},
+		chainShards: parseChainShards("s0, s2"),
+	}
+	assert.True(t, r.isChainShard())
+	assert.Equal(t, "a", r.chainHead())
+	assert.Equal(t, "c", r.chainTail())
+	assert.Equal(t, "c", r.chainSuccessor())
+
+	assert.Equal(t, []string{"c", "a", "b"}, chainFirst(http.MethodGet, r.shards["s0"]))
+	assert.Equal(t, []string{"a", "b", "c"}, chainFirst(http.MethodPut, r.shards["s0"]))
+
+	// Deleting the tail makes its predecessor the tail. The mapping is
+	// replaced, so readers holding the previous one aren't affected.
+	before := r.getShards()
+	r.removeChainMember("c")
+	assert.Equal(t, "b", r.chainTail())
+	assert.Equal(t, "", r.chainSuccessor())
+	assert.Equal(t, []string{"a", "b", "c"}, before["s0"])
+
+	// Only chain shards are reconfigured
+	r.removeChainMember("e")
+	assert.Equal(t, []string{"d", "e"}, r.shards["s1"])
+}
+
+// Check that a member rejects writes past one it missed, and that its
+// predecessor sends it the missing write first
+func Test_ChainResendsMissedWrite(t *testing.T) {
+	tc := startCluster(t, 3, 1, func(cfg *ReplicaConfig) { cfg.ChainShards = "s0" })
+	head := tc.nodes[0].chainHead()
+	tail := tc.nodes[0].chainTail()
+	tailNode := tc.nodes[slices.Index(tc.addrs(), tail)]
+	c := tc.client()
+
+	status, err := c.Put(head, "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, err = tc.do(http.MethodPut, tail, "/chain", ChainWrite{Seq: 3, Method: http.MethodPut, Key: "y", Value: "2"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.NotContains(t, tc.kv(slices.Index(tc.addrs(), tail)), "y")
+
+	// Make the tail forget the write to x, as if it had missed it
+	tailNode.chainLock.Lock()
+	tailNode.chainSeq, tailNode.chainLast = 0, ChainWrite{}
+	tailNode.chainLock.Unlock()
+	status, err = c.Put(head, "y", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, map[string]any{"x": "1", "y": "2"}, tc.kv(slices.Index(tc.addrs(), tail)))
+}
+
+// Check that the head doesn't apply a write the tail didn't acknowledge, and
+// settles it before the next write
+func Test_ChainHeadAppliesAcknowledgedWrites(t *testing.T) {
+	tc := startCluster(t, 3, 1, func(cfg *ReplicaConfig) { cfg.ChainShards = "s0" })
+	addrs := tc.addrs()
+	head := tc.nodes[0].chainHead()
+	headIdx, tailIdx := slices.Index(addrs, head), slices.Index(addrs, tc.nodes[0].chainTail())
+	c := tc.client()
+
+	status, err := c.Put(head, "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+
+	// The middle member misses the next write, and the head can't resend it
+	headNode, middleIdx := tc.nodes[headIdx], 3-headIdx-tailIdx
+	headNode.chainLock.Lock()
+	headNode.chainLast = ChainWrite{}
+	headNode.chainLock.Unlock()
+	tc.nodes[middleIdx].chainLock.Lock()
+	tc.nodes[middleIdx].chainSeq = 0
+	tc.nodes[middleIdx].chainLock.Unlock()
+	status, err = c.Put(head, "y", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.NotContains(t, tc.kv(headIdx), "y")
+
+	// Once the middle member caught up, the failed write is settled before
+	// the next
+	tc.nodes[middleIdx].chainLock.Lock()
+	tc.nodes[middleIdx].chainSeq = 1
+	tc.nodes[middleIdx].chainLock.Unlock()
+	status, err = c.Put(head, "z", "3")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	for _, i := range []int{headIdx, middleIdx, tailIdx} {
+		assert.Equal(t, map[string]any{"x": "1", "y": "2", "z": "3"}, tc.kv(i))
+	}
+}
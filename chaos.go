@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// chaosDropHold is the longest a request dropped on arrival is held before
+// it's answered. Its sender has given up on it by then.
+const chaosDropHold = time.Minute
+
+// Chaos injects faults into the traffic of a replica, as configured through
+// the /admin/chaos endpoints. Requests to other replicas go through its fault
+// network, and requests from other replicas or clients through its
+// middleware. It is only enabled when the replica starts with CHAOS=true.
+type Chaos struct {
+	addr    string
+	network *FaultNetwork
+
+	lock sync.Mutex
+	rng  *rand.Rand
+	// unavailable is the fraction of incoming requests answered with a 503
+	unavailable float64
+	refused     int
+}
+
+func NewChaos(addr string, seed int64) *Chaos {
+	return &Chaos{
+		addr:    addr,
+		network: NewFaultNetwork(seed),
+		rng:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Wrap returns a transport that injects the faults of the outgoing requests
+// into the requests sent through t
+func (ch *Chaos) Wrap(t Transport) Transport {
+	return ch.network.Wrap(ch.addr, t)
+}
+
+// Middleware drops, delays or refuses incoming requests. The chaos endpoints
+// are left alone, so that faults can always be removed.
+func (ch *Chaos) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if strings.HasPrefix(c.Path(), "/admin/chaos") {
+			return next(c)
+		}
+		if from := c.Request().Header.Get(replicaHeader); from != "" {
+			f := ch.network.Link(from, ch.addr)
+			if f.Drop {
+				zap.L().Debug("Chaos: dropping request", zap.String("from", from), zap.String("uri", c.Request().RequestURI))
+				// The server only notices that the sender hung up once the
+				// body has been read
+				io.Copy(io.Discard, c.Request().Body)
+				select {
+				case <-c.Request().Context().Done():
+				case <-time.After(chaosDropHold):
+				}
+				return c.NoContent(http.StatusServiceUnavailable)
+			}
+			time.Sleep(f.Delay)
+		}
+
+		ch.lock.Lock()
+		refuse := ch.unavailable > 0 && ch.rng.Float64() < ch.unavailable
+		if refuse {
+			ch.refused++
+		}
+		ch.lock.Unlock()
+		if refuse {
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Unavailable (chaos)"})
+		}
+		return next(c)
+	}
+}
+
+type ChaosLink struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Drop  bool   `json:"drop"`
+	Delay string `json:"delay,omitempty"`
+}
+
+type ChaosStatus struct {
+	Links              []ChaosLink `json:"links"`
+	FailPercent        float64     `json:"fail-percent"`
+	UnavailablePercent float64     `json:"unavailable-percent"`
+	Stats              FaultStats  `json:"stats"`
+	Refused            int         `json:"refused"`
+}
+
+func (ch *Chaos) Status() ChaosStatus {
+	status := ChaosStatus{
+		Links:       []ChaosLink{},
+		FailPercent: ch.network.Faults().DropRate * 100,
+		Stats:       ch.network.Stats(),
+	}
+	for from, targets := range ch.network.Links() {
+		for to, f := range targets {
+			l := ChaosLink{From: from, To: to, Drop: f.Drop}
+			if f.Delay > 0 {
+				l.Delay = f.Delay.String()
+			}
+			status.Links = append(status.Links, l)
+		}
+	}
+	slices.SortFunc(status.Links, func(a, b ChaosLink) int {
+		return strings.Compare(a.From+" "+a.To, b.From+" "+b.To)
+	})
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	status.UnavailablePercent = ch.unavailable * 100
+	status.Refused = ch.refused
+	return status
+}
+
+type ChaosPeersRequest struct {
+	Peers []string `json:"peers"`
+	// Direction is "to", "from" or "both", the default
+	Direction string `json:"direction"`
+	Drop      bool   `json:"drop"`
+	Delay     string `json:"delay"`
+}
+
+type ChaosPercentRequest struct {
+	Percent float64 `json:"percent"`
+}
+
+func (r *Replica) handleChaosGet(c echo.Context) error {
+	return c.JSON(http.StatusOK, r.chaos.Status())
+}
+
+// handleChaosPeers replaces the faults of the traffic to and from peers. A
+// request with neither drop nor delay removes them.
+func (r *Replica) handleChaosPeers(c echo.Context) error {
+	req := new(ChaosPeersRequest)
+	if err := c.Bind(req); err != nil || len(req.Peers) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	f := LinkFaults{Drop: req.Drop}
+	if req.Delay != "" {
+		d, err := time.ParseDuration(req.Delay)
+		if err != nil || d < 0 {
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid delay"})
+		}
+		f.Delay = d
+	}
+	var to, from bool
+	switch req.Direction {
+	case "to":
+		to = true
+	case "from":
+		from = true
+	case "", "both":
+		to, from = true, true
+	default:
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "direction must be to, from or both"})
+	}
+
+	for _, peer := range req.Peers {
+		if to {
+			r.chaos.network.SetLink(r.addr, peer, f)
+		}
+		if from {
+			r.chaos.network.SetLink(peer, r.addr, f)
+		}
+	}
+	zap.L().Warn("Chaos: set peer faults", zap.Strings("peers", req.Peers), zap.String("direction", req.Direction), zap.Bool("drop", f.Drop), zap.Duration("delay", f.Delay))
+	return c.JSON(http.StatusOK, r.chaos.Status())
+}
+
+// bindPercent binds a ChaosPercentRequest and returns its percentage as a fraction
+func bindPercent(c echo.Context) (float64, bool) {
+	req := new(ChaosPercentRequest)
+	if err := c.Bind(req); err != nil || req.Percent < 0 || req.Percent > 100 {
+		return 0, false
+	}
+	return req.Percent / 100, true
+}
+
+// handleChaosFail makes a percentage of the requests to other replicas fail
+// without being sent
+func (r *Replica) handleChaosFail(c echo.Context) error {
+	rate, ok := bindPercent(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "percent must be between 0 and 100"})
+	}
+	f := r.chaos.network.Faults()
+	f.DropRate = rate
+	r.chaos.network.SetFaults(f)
+	zap.L().Warn("Chaos: failing requests", zap.Float64("rate", rate))
+	return c.JSON(http.StatusOK, r.chaos.Status())
+}
+
+// handleChaosUnavailable makes the replica answer a percentage of the
+// requests it receives with a 503
+func (r *Replica) handleChaosUnavailable(c echo.Context) error {
+	rate, ok := bindPercent(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "percent must be between 0 and 100"})
+	}
+	r.chaos.lock.Lock()
+	r.chaos.unavailable = rate
+	r.chaos.lock.Unlock()
+	zap.L().Warn("Chaos: refusing requests", zap.Float64("rate", rate))
+	return c.JSON(http.StatusOK, r.chaos.Status())
+}
+
+// handleChaosDelete removes every fault
+func (r *Replica) handleChaosDelete(c echo.Context) error {
+	r.chaos.network.Heal()
+	r.chaos.network.SetFaults(Faults{})
+	r.chaos.lock.Lock()
+	r.chaos.unavailable = 0
+	r.chaos.lock.Unlock()
+	zap.L().Warn("Chaos: removed every fault")
+	return c.JSON(http.StatusOK, r.chaos.Status())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withChaos(cfg *ReplicaConfig) {
+	cfg.Chaos = true
+}
+
+// ownerAddrs returns the addresses of the replicas that own key, and of a
+// replica that doesn't
+func ownerAddrs(tc *testCluster, key string) ([]string, string) {
+	var owners []string
+	for _, i := range tc.owners(key) {
+		owners = append(owners, tc.nodes[i].addr)
+	}
+	addrs := tc.addrs()
+	return owners, addrs[slices.IndexFunc(addrs, func(addr string) bool { return !slices.Contains(owners, addr) })]
+}
+
+func Test_ChaosDisabled(t *testing.T) {
+	tc := startCluster(t, 2, 1)
+	status, err := tc.do(http.MethodGet, tc.addrs()[0], "/admin/chaos", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+// Check that requests to the peers a replica drops or delays traffic to are
+// failed or delayed, until the faults are removed
+func Test_ChaosPeers(t *testing.T) {
+	tc := startCluster(t, 4, 2, withChaos)
+	owners, at := ownerAddrs(tc, "x")
+	c := tc.client()
+
+	var chaos ChaosStatus
+	status, err := tc.do(http.MethodPut, at, "/admin/chaos/peers", ChaosPeersRequest{Peers: owners, Direction: "to", Delay: "50ms"}, &chaos)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, chaos.Links, 2)
+	start := time.Now()
+	status, err = c.Put(at, "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	status, err = tc.do(http.MethodPut, at, "/admin/chaos/peers", ChaosPeersRequest{Peers: owners, Direction: "to", Drop: true}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	status, err = c.Put(at, "x", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	status, err = tc.do(http.MethodDelete, at, "/admin/chaos", nil, &chaos)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, chaos.Links)
+	assert.GreaterOrEqual(t, chaos.Stats.Partitioned, 2)
+	status, err = c.Put(at, "x", "3")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+// Check that a replica drops the requests of the peers it drops traffic from,
+// and answers them when the faults are removed
+func Test_ChaosFromPeer(t *testing.T) {
+	tc := startCluster(t, 2, 1, withChaos)
+	addr := tc.addrs()[0]
+	status, err := tc.do(http.MethodPut, addr, "/admin/chaos/peers", ChaosPeersRequest{Peers: []string{"peer:8090"}, Direction: "from", Drop: true}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	get := func(from string) (*http.Response, error) {
+		return SendRequest(HttpRequest{method: http.MethodGet, endpoint: "/view", addr: addr, from: from})
+	}
+	_, err = get("peer:8090")
+	assert.Error(t, err)
+	res, err := get("other:8090")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	status, err = tc.do(http.MethodPut, addr, "/admin/chaos/peers", ChaosPeersRequest{Peers: []string{"peer:8090"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	res, err = get("peer:8090")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+// Check that failing requests to other replicas and refusing requests apply
+// to every request but the chaos endpoints
+func Test_ChaosFailAndUnavailable(t *testing.T) {
+	tc := startCluster(t, 4, 2, withChaos)
+	_, at := ownerAddrs(tc, "x")
+	c := tc.client()
+
+	status, err := tc.do(http.MethodPut, at, "/admin/chaos/fail", ChaosPercentRequest{Percent: 100}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	status, err = c.Put(at, "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	status, err = tc.do(http.MethodPut, at, "/admin/chaos/unavailable", ChaosPercentRequest{Percent: 100}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	status, err = c.Put(at, "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	var chaos ChaosStatus
+	status, err = tc.do(http.MethodGet, at, "/admin/chaos", nil, &chaos)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 100.0, chaos.FailPercent)
+	assert.Equal(t, 100.0, chaos.UnavailablePercent)
+	assert.Equal(t, 1, chaos.Refused)
+	assert.GreaterOrEqual(t, chaos.Stats.Dropped, 2)
+
+	status, err = tc.do(http.MethodPut, at, "/admin/chaos/unavailable", ChaosPercentRequest{Percent: 101}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
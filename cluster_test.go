@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testClientTimeout = 2 * time.Second
+	testEventually    = 5 * time.Second
+	// testSeed seeds the faults injected into test clusters
+	testSeed = 138
+)
+
+// testCluster is a cluster of replicas served in-process on loopback ports,
+// configured the way NewReplica configures a replica from the environment of
+// its container. Clients reach the replicas over HTTP, while the replicas
+// reach each other through faults, which starts out injecting none.
+type testCluster struct {
+	t       *testing.T
+	nodes   []*Replica
+	servers []*httptest.Server
+	net     *memNetwork
+	faults  *FaultNetwork
+
+	lock    sync.Mutex
+	crashed map[int]bool
+}
+
+// startCluster starts `replicas` replicas split into shardCount shards.
+// configure, if given, adjusts the configuration of every replica.
+func startCluster(t *testing.T, replicas int, shardCount int, configure ...func(*ReplicaConfig)) *testCluster {
+	t.Helper()
+	listeners := make([]net.Listener, replicas)
+	addrs := make([]string, replicas)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	tc := &testCluster{
+		t:       t,
+		net:     newMemNetwork(),
+		faults:  NewFaultNetwork(testSeed),
+		crashed: make(map[int]bool),
+	}
+	for i, l := range listeners {
+		cfg := ReplicaConfig{
+			Address:    addrs[i],
+			View:       addrs,
+			ShardCount: shardCount,
+			DataDir:    t.TempDir(),
+			Transport:  tc.faults.Wrap(addrs[i], tc.net),
+		}
+		for _, c := range configure {
+			c(&cfg)
+		}
+		r := NewReplicaWithConfig(cfg)
+
+		e := echo.New()
+		e.HideBanner = true
+		r.routes(e)
+		tc.net.serve(addrs[i], e)
+		srv := httptest.NewUnstartedServer(e)
+		srv.Listener.Close()
+		srv.Listener = l
+		srv.Start()
+		t.Cleanup(srv.Close)
+		tc.servers = append(tc.servers, srv)
+
+		r.outbox.Start()
+		r.startRaft()
+		i := i
+		t.Cleanup(func() {
+			if node := r.getRaft(); node != nil && !tc.isCrashed(i) {
+				node.Stop()
+			}
+		})
+		tc.nodes = append(tc.nodes, r)
+	}
+	return tc
+}
+
+// crash stops serving the i-th replica and stops its raft node, as if its
+// container was killed
+func (tc *testCluster) crash(i int) {
+	tc.lock.Lock()
+	tc.crashed[i] = true
+	tc.lock.Unlock()
+	tc.net.stop(tc.nodes[i].addr)
+	tc.servers[i].CloseClientConnections()
+	tc.servers[i].Close()
+	if node := tc.nodes[i].getRaft(); node != nil {
+		node.Stop()
+	}
+}
+
+func (tc *testCluster) isCrashed(i int) bool {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.crashed[i]
+}
+
+// live returns the addresses of the replicas that haven't crashed
+func (tc *testCluster) live() []string {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	var addrs []string
+	for i, r := range tc.nodes {
+		if !tc.crashed[i] {
+			addrs = append(addrs, r.addr)
+		}
+	}
+	return addrs
+}
+
+func (tc *testCluster) addrs() []string {
+	addrs := make([]string, len(tc.nodes))
+	for i, r := range tc.nodes {
+		addrs[i] = r.addr
+	}
+	return addrs
+}
+
+// owners returns the indices of the replicas of the shard that owns key
+func (tc *testCluster) owners(key string) []int {
+	r := tc.nodes[0]
+	shards := r.getShards()
+	members := shards[findShard(key, shards)]
+	var owners []int
+	for i, node := range tc.nodes {
+		if slices.Contains(members, node.addr) {
+			owners = append(owners, i)
+		}
+	}
+	return owners
+}
+
+// kv returns a copy of the kv store of the i-th replica
+func (tc *testCluster) kv(i int) map[string]any {
+	r := tc.nodes[i]
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	return maps.Clone(r.kv)
+}
+
+// clock returns a copy of the vector clock of the i-th replica
+func (tc *testCluster) clock(i int) VectorClock {
+	r := tc.nodes[i]
+	r.vcLock.Lock()
+	defer r.vcLock.Unlock()
+	return CloneVC(*r.vc)
+}
+
+// eventually fails the test unless cond becomes true within testEventually
+func (tc *testCluster) eventually(cond func() bool, msg string, args ...any) {
+	tc.t.Helper()
+	assert.Eventually(tc.t, cond, testEventually, 10*time.Millisecond, append([]any{msg}, args...)...)
+}
+
+// do sends a request to the replica at addr and decodes its JSON response into
+// res, returning the status code
+func (tc *testCluster) do(method string, addr string, endpoint string, payload any, res any) (int, error) {
+	resp, err := SendRequest(HttpRequest{
+		method:   method,
+		endpoint: endpoint,
+		addr:     addr,
+		payload:  payload,
+		timeout:  testClientTimeout,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if res != nil && resp.StatusCode < http.StatusBadRequest {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding %s %s: %w", method, endpoint, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// testClient is a client of a test cluster that carries its causal metadata
+// from one request to the next
+type testClient struct {
+	do    func(method string, addr string, endpoint string, payload any, res any) (int, error)
+	clock VectorClock
+}
+
+func (tc *testCluster) client() *testClient {
+	return &testClient{do: tc.do, clock: VectorClock{Clocks: make(map[string]int)}}
+}
+
+func (c *testClient) Put(addr string, key string, value any) (int, error) {
+	var res Response
+	status, err := c.do(http.MethodPut, addr, "/kvs/"+key, Request{
+		StoreValue:     StoreValue{Value: value},
+		CausalMetadata: c.clock,
+	}, &res)
+	if err == nil && (status == http.StatusOK || status == http.StatusCreated) {
+		c.clock = res.CausalMetadata
+	}
+	return status, err
+}
+
+func (c *testClient) Get(addr string, key string) (GetResponse, int, error) {
+	var res GetResponse
+	status, err := c.do(http.MethodGet, addr, "/kvs/"+key, Request{CausalMetadata: c.clock}, &res)
+	if err == nil && status == http.StatusOK {
+		c.clock = res.CausalMetadata
+	}
+	return res, status, err
+}
+
+func (c *testClient) Delete(addr string, key string) (int, error) {
+	var res Response
+	status, err := c.do(http.MethodDelete, addr, "/kvs/"+key, Request{CausalMetadata: c.clock}, &res)
+	if err == nil && status == http.StatusOK {
+		c.clock = res.CausalMetadata
+	}
+	return status, err
+}
+
+// Check that writes reach every replica of the owning shard and only them,
+// and that a client reads its writes through any replica
+func Test_ClusterReplicates(t *testing.T) {
+	tc := startCluster(t, 4, 2)
+	addrs := tc.addrs()
+	c := tc.client()
+
+	status, err := c.Put(addrs[0], "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+
+	owners := tc.owners("x")
+	assert.Len(t, owners, 2)
+	for i := range tc.nodes {
+		i := i
+		if slices.Contains(owners, i) {
+			tc.eventually(func() bool { return tc.kv(i)["x"] == "1" }, "replica %d should have x", i)
+		} else {
+			assert.NotContains(t, tc.kv(i), "x")
+		}
+	}
+
+	for _, addr := range addrs {
+		res, status, err := c.Get(addr, "x")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "1", res.Value)
+	}
+
+	status, err = c.Delete(addrs[3], "x")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	for _, i := range owners {
+		i := i
+		tc.eventually(func() bool {
+			_, ok := tc.kv(i)["x"]
+			return !ok
+		}, "replica %d should have deleted x", i)
+
+		// Both writes were coordinated by members of the owning shard
+		writes := 0
+		for _, entry := range tc.clock(i).Clocks {
+			writes += entry
+		}
+		assert.Equal(t, 2, writes)
+	}
+}
+
+// versions returns a copy of the history of key at the i-th replica
+func (tc *testCluster) versions(i int, key string) []Version {
+	r := tc.nodes[i]
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	return slices.Clone(r.versions[key])
+}
+
+// view returns a copy of the view of the i-th replica
+func (tc *testCluster) view(i int) []string {
+	return slices.Clone(tc.nodes[i].getView())
+}
+
+// Check that a replica that can't be reached while forwarding a request is
+// deleted from the views of the replicas that can still reach each other
+func Test_ClusterDetectsPartitionedReplica(t *testing.T) {
+	tc := startCluster(t, 4, 2)
+	addrs := tc.addrs()
+	r := tc.nodes[0]
+	shards := r.getShards()
+	shard := shards[findShard("x", shards)]
+	cut := shard[0]
+	from := slices.IndexFunc(addrs, func(addr string) bool { return !slices.Contains(shard, addr) })
+
+	tc.faults.Partition([]string{cut}, FilterViews(addrs, cut))
+	status, err := tc.client().Put(addrs[from], "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+
+	for i, addr := range addrs {
+		i := i
+		if addr == cut {
+			assert.Contains(t, tc.view(i), addr)
+			continue
+		}
+		tc.eventually(func() bool {
+			return !slices.Contains(tc.view(i), cut)
+		}, "replica %d should have deleted %s from its view", i, cut)
+	}
+}
+
+// Check that replicas converge, and apply every write once, when the requests
+// between them are delayed, duplicated and reordered
+func Test_ClusterConvergesUnderFaults(t *testing.T) {
+	tc := startCluster(t, 4, 2)
+	addrs := tc.addrs()
+	tc.faults.SetFaults(Faults{
+		DuplicateRate: 0.5,
+		ReorderRate:   0.3,
+		Jitter:        20 * time.Millisecond,
+	})
+
+	// Writes go straight to an owner: a duplicated forward is a second write
+	c := tc.client()
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for i, key := range keys {
+		owners := tc.owners(key)
+		status, err := c.Put(addrs[owners[i%len(owners)]], key, key)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, status)
+	}
+
+	for _, key := range keys {
+		for _, i := range tc.owners(key) {
+			i := i
+			tc.eventually(func() bool { return tc.kv(i)[key] == key }, "replica %d should have %s", i, key)
+			// Every key was written once, however many times the write arrived
+			assert.Len(t, tc.versions(i, key), 1, "replica %d should have applied %s once", i, key)
+		}
+	}
+	// The replicas of each shard end up with the same clock
+	for i := range tc.nodes {
+		i := i
+		j := slices.IndexFunc(tc.nodes, func(r *Replica) bool {
+			return r != tc.nodes[i] && r.getShardId() == tc.nodes[i].getShardId()
+		})
+		tc.eventually(func() bool {
+			return maps.Equal(tc.clock(i).Clocks, tc.clock(j).Clocks)
+		}, "replicas %d and %d should have the same clock", i, j)
+	}
+	assert.NotZero(t, tc.faults.Stats().Duplicated)
+}
+
+// Check that a reshard moves every key to its new shard when the requests
+// between replicas are delayed and duplicated
+func Test_ClusterReshardsUnderFaults(t *testing.T) {
+	tc := startCluster(t, 6, 3)
+	addrs := tc.addrs()
+	c := tc.client()
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		status, err := c.Put(addrs[0], key, key)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, status)
+	}
+	for _, key := range keys {
+		for _, i := range tc.owners(key) {
+			i := i
+			tc.eventually(func() bool { return tc.kv(i)[key] == key }, "replica %d should have %s", i, key)
+		}
+	}
+
+	tc.faults.SetFaults(Faults{DuplicateRate: 0.5, Jitter: 20 * time.Millisecond})
+	status, err := tc.do(http.MethodPut, addrs[0], "/shard/reshard", map[string]int{"shard-count": 2}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	for i, r := range tc.nodes {
+		i, r := i, r
+		tc.eventually(func() bool {
+			return r.getShardCount() == 2
+		}, "replica %d should have resharded", i)
+	}
+	for _, key := range keys {
+		owners := tc.owners(key)
+		assert.Len(t, owners, 3)
+		for i := range tc.nodes {
+			if slices.Contains(owners, i) {
+				assert.Equal(t, key, tc.kv(i)[key], "replica %d should have %s", i, key)
+			} else {
+				assert.NotContains(t, tc.kv(i), key)
+			}
+		}
+	}
+	for _, addr := range addrs {
+		for _, key := range keys {
+			res, status, err := c.Get(addr, key)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, key, res.Value)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ConsistencyMode string
+
+const (
+	// ModeCausal replicates writes asynchronously and enforces causal
+	// consistency through vector clocks
+	ModeCausal ConsistencyMode = "causal"
+	// ModeQuorum waits for W replicas of the owning shard to acknowledge a
+	// write and consults R replicas on a read
+	ModeQuorum ConsistencyMode = "quorum"
+	// ModeLinearizable orders every operation through the raft log of the
+	// owning shard
+	ModeLinearizable ConsistencyMode = "linearizable"
+)
+
+// ConsistencyOptions selects how a request to /kvs/:key is served. N, R and W
+// are only used in quorum mode and default to the shard size and a majority of
+// N respectively. With R+W>N, every read quorum overlaps every write quorum, so
+// a read always observes the latest acknowledged write.
+type ConsistencyOptions struct {
+	Mode ConsistencyMode `json:"mode"`
+	N    int             `json:"n,omitempty"`
+	R    int             `json:"r,omitempty"`
+	W    int             `json:"w,omitempty"`
+}
+
+// namespaceOf returns the namespace of a key, which is the part of the key
+// before the first ':', e.g. "users" for "users:42"
+func namespaceOf(key string) string {
+	ns, _, found := strings.Cut(key, ":")
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+// parseNamespaces parses the CONSISTENCY_NAMESPACES configuration, a JSON
+// object mapping namespaces to their consistency options, e.g.
+// {"users": {"mode": "quorum", "r": 2, "w": 2}}
+func parseNamespaces(config string) map[string]ConsistencyOptions {
+	namespaces := make(map[string]ConsistencyOptions)
+	if config == "" {
+		return namespaces
+	}
+	if err := json.Unmarshal([]byte(config), &namespaces); err != nil {
+		panic(err)
+	}
+	for ns, opts := range namespaces {
+		if err := opts.validate(); err != nil {
+			panic(fmt.Errorf("namespace %s: %w", ns, err))
+		}
+	}
+	return namespaces
+}
+
+// usesRaft returns whether any namespace is configured to be linearizable
+func usesRaft(namespaces map[string]ConsistencyOptions) bool {
+	for _, opts := range namespaces {
+		if opts.Mode == ModeLinearizable {
+			return true
+		}
+	}
+	return false
+}
+
+// isStronglyConsistent returns whether key belongs to a linearizable namespace
+// or to a chain replicated shard, in which case its value is owned by the raft
+// log or the chain and must not be repaired
+func (r *Replica) isStronglyConsistent(key string) bool {
+	return r.namespaces[namespaceOf(key)].Mode == ModeLinearizable || r.chainShards[findShard(key, r.getShards())]
+}
+
+func (opts ConsistencyOptions) validate() error {
+	switch opts.Mode {
+	case ModeCausal, ModeQuorum, ModeLinearizable:
+	default:
+		return fmt.Errorf("unknown consistency mode %q", opts.Mode)
+	}
+	if opts.N < 0 || opts.R < 0 || opts.W < 0 {
+		return fmt.Errorf("n, r and w must not be negative")
+	}
+	return nil
+}
+
+// consistencyFor returns the consistency options of a request for key. Options
+// given in the request body or the query string (?consistency=quorum&r=2&w=2)
+// take precedence over the ones configured for the key's namespace, except
+// that linearizability can't be chosen per request: the keys of linearizable
+// namespaces are owned by the raft log, and the other keys are repaired by
+// anti-entropy, so a request can neither write around the log nor through it.
+func (r *Replica) consistencyFor(c echo.Context, key string, request *Request) (ConsistencyOptions, error) {
+	ns := namespaceOf(key)
+	opts, ok := r.namespaces[ns]
+	if !ok {
+		opts = ConsistencyOptions{Mode: ModeCausal}
+	}
+	configured := opts.Mode
+	if request.Consistency != nil {
+		opts = *request.Consistency
+	}
+	if mode := c.QueryParam("consistency"); mode != "" {
+		opts = ConsistencyOptions{Mode: ConsistencyMode(mode)}
+		for param, field := range map[string]*int{"n": &opts.N, "r": &opts.R, "w": &opts.W} {
+			value := c.QueryParam(param)
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s", param)
+			}
+			*field = n
+		}
+	}
+	if err := opts.validate(); err != nil {
+		return opts, err
+	}
+	if configured == ModeLinearizable && opts.Mode != ModeLinearizable {
+		return opts, fmt.Errorf("namespace %q is linearizable", ns)
+	}
+	if configured != ModeLinearizable && opts.Mode == ModeLinearizable {
+		return opts, fmt.Errorf("only keys of linearizable namespaces are linearizable")
+	}
+	if opts.Mode == ModeLinearizable && !r.raftEnabled {
+		return opts, fmt.Errorf("linearizable mode is disabled")
+	}
+	if opts.Mode != ModeQuorum {
+		return opts, nil
+	}
+
+	shardSize := len(r.shardMembers())
+	if opts.N == 0 {
+		opts.N = shardSize
+	}
+	if opts.R == 0 {
+		opts.R = opts.N/2 + 1
+	}
+	if opts.W == 0 {
+		opts.W = opts.N/2 + 1
+	}
+	if opts.N > shardSize || opts.R > opts.N || opts.W > opts.N {
+		return opts, fmt.Errorf("r and w must not exceed n, which must not exceed the shard size %d", shardSize)
+	}
+	return opts, nil
+}
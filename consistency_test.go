@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConsistencyFor(t *testing.T, r *Replica, target string, key string, request *Request) (ConsistencyOptions, error) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	return r.consistencyFor(c, key, request)
+}
+
+func Test_ConsistencyFor(t *testing.T) {
+	r := &Replica{
+		addr:        "a",
+		shardId:     "s0",
+		shards:      map[string][]string{"s0": {"a", "b", "c"}},
+		namespaces:  parseNamespaces(`{"users": {"mode": "quorum", "w": 3}, "config": {"mode": "linearizable"}}`),
+		raftEnabled: true,
+	}
+
+	opts, err := testConsistencyFor(t, r, "/kvs/x", "x", &Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, ModeCausal, opts.Mode)
+
+	// Namespace defaults
+	opts, err = testConsistencyFor(t, r, "/kvs/users:1", "users:1", &Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, ConsistencyOptions{Mode: ModeQuorum, N: 3, R: 2, W: 3}, opts)
+
+	// Query string overrides the namespace
+	opts, err = testConsistencyFor(t, r, "/kvs/users:1?consistency=quorum&r=1", "users:1", &Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, ConsistencyOptions{Mode: ModeQuorum, N: 3, R: 1, W: 2}, opts)
+
+	// Request body overrides the namespace
+	opts, err = testConsistencyFor(t, r, "/kvs/users:1", "users:1", &Request{Consistency: &ConsistencyOptions{Mode: ModeCausal}})
+	assert.NoError(t, err)
+	assert.Equal(t, ModeCausal, opts.Mode)
+
+	// Linearizability can't be overridden or asked for per request
+	opts, err = testConsistencyFor(t, r, "/kvs/config:1?consistency=linearizable", "config:1", &Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, ModeLinearizable, opts.Mode)
+	_, err = testConsistencyFor(t, r, "/kvs/config:1?consistency=quorum", "config:1", &Request{})
+	assert.Error(t, err)
+	_, err = testConsistencyFor(t, r, "/kvs/config:1", "config:1", &Request{Consistency: &ConsistencyOptions{Mode: ModeCausal}})
+	assert.Error(t, err)
+	_, err = testConsistencyFor(t, r, "/kvs/x?consistency=linearizable", "x", &Request{})
+	assert.Error(t, err)
+	_, err = testConsistencyFor(t, r, "/kvs/users:1", "users:1", &Request{Consistency: &ConsistencyOptions{Mode: ModeLinearizable}})
+	assert.Error(t, err)
+
+	_, err = testConsistencyFor(t, r, "/kvs/x?consistency=quorum&w=4", "x", &Request{})
+	assert.Error(t, err)
+	_, err = testConsistencyFor(t, r, "/kvs/x?consistency=eventual", "x", &Request{})
+	assert.Error(t, err)
+}
+
+// Check that the preference list doesn't outgrow a shard that shrank after the
+// quorum was validated
+func Test_PreferenceListShrunkShard(t *testing.T) {
+	r := &Replica{addr: "a", shardId: "s0", shards: map[string][]string{"s0": {"a", "b", "c"}}}
+	assert.Equal(t, []string{"a", "b"}, r.preferenceList(2))
+	r.setShards("s0", 1, map[string][]string{"s0": {"a", "b"}})
+	assert.Equal(t, []string{"a", "b"}, r.preferenceList(3))
+}
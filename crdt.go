@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type CRDTType string
+
+const (
+	GCounterType    CRDTType = "g-counter"
+	PNCounterType   CRDTType = "pn-counter"
+	ORSetType       CRDTType = "or-set"
+	LWWRegisterType CRDTType = "lww-register"
+	LWWMapType      CRDTType = "lww-map"
+)
+
+var ErrUnknownOp = errors.New("unknown operation")
+
+// CRDTState is the state of a state-based CRDT. Merge must be commutative,
+// associative and idempotent, so that replicas that merged the same states in
+// any order and any number of times hold the same value.
+type CRDTState interface {
+	// Apply performs a client operation coordinated by replica, whose clock
+	// timestamps the writes that need ordering
+	Apply(op CRDTOp, replica string, clock *HLC) error
+	// Merge folds other, which has the same type, into the state
+	Merge(other CRDTState)
+	Value() any
+}
+
+func newCRDTState(t CRDTType) (CRDTState, error) {
+	switch t {
+	case GCounterType:
+		return &GCounter{Counts: make(map[string]int)}, nil
+	case PNCounterType:
+		return &PNCounter{P: GCounter{Counts: make(map[string]int)}, N: GCounter{Counts: make(map[string]int)}}, nil
+	case ORSetType:
+		return &ORSet{Tags: make(map[string][]string), Removed: make(map[string]bool), Counters: make(map[string]int)}, nil
+	case LWWRegisterType:
+		return &LWWRegister{}, nil
+	case LWWMapType:
+		return &LWWMap{Fields: make(map[string]LWWRegister)}, nil
+	}
+	return nil, fmt.Errorf("unknown CRDT type %q", t)
+}
+
+// CRDT is a CRDT state tagged with its type
+type CRDT struct {
+	Type  CRDTType  `json:"type"`
+	State CRDTState `json:"state"`
+}
+
+func (c *CRDT) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type  CRDTType        `json:"type"`
+		State json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	state, err := newCRDTState(raw.Type)
+	if err != nil {
+		return err
+	}
+	if len(raw.State) > 0 {
+		if err := json.Unmarshal(raw.State, state); err != nil {
+			return err
+		}
+	}
+	c.Type, c.State = raw.Type, state
+	return nil
+}
+
+// CRDTOp is an operation on the CRDT stored under a key. The fields used
+// depend on the type and the operation:
+//
+//	g-counter:    increment (amount)
+//	pn-counter:   increment, decrement (amount)
+//	or-set:       add, remove (element)
+//	lww-register: set (value)
+//	lww-map:      set (field, value), remove (field)
+type CRDTOp struct {
+	Type    CRDTType `json:"type"`
+	Op      string   `json:"op"`
+	Amount  int      `json:"amount,omitempty"`
+	Element string   `json:"element,omitempty"`
+	Field   string   `json:"field,omitempty"`
+	Value   any      `json:"value,omitempty"`
+}
+
+type CRDTResponse struct {
+	Type    CRDTType `json:"type"`
+	Value   any      `json:"value"`
+	ShardId string   `json:"shard-id"`
+}
+
+// GCounter is a grow-only counter holding the increments coordinated by each
+// replica
+type GCounter struct {
+	Counts map[string]int `json:"counts"`
+}
+
+func (g *GCounter) Apply(op CRDTOp, replica string, clock *HLC) error {
+	if op.Op != "increment" {
+		return ErrUnknownOp
+	}
+	if op.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	g.Counts[replica] += op.Amount
+	return nil
+}
+
+func (g *GCounter) Merge(other CRDTState) {
+	for replica, n := range other.(*GCounter).Counts {
+		g.Counts[replica] = max(g.Counts[replica], n)
+	}
+}
+
+func (g *GCounter) Value() any {
+	sum := 0
+	for _, n := range g.Counts {
+		sum += n
+	}
+	return sum
+}
+
+// PNCounter is a counter made of one grow-only counter for increments and one
+// for decrements
+type PNCounter struct {
+	P GCounter `json:"p"`
+	N GCounter `json:"n"`
+}
+
+func (pn *PNCounter) Apply(op CRDTOp, replica string, clock *HLC) error {
+	switch op.Op {
+	case "increment":
+		return pn.P.Apply(op, replica, clock)
+	case "decrement":
+		op.Op = "increment"
+		return pn.N.Apply(op, replica, clock)
+	}
+	return ErrUnknownOp
+}
+
+func (pn *PNCounter) Merge(other CRDTState) {
+	o := other.(*PNCounter)
+	pn.P.Merge(&o.P)
+	pn.N.Merge(&o.N)
+}
+
+func (pn *PNCounter) Value() any {
+	return pn.P.Value().(int) - pn.N.Value().(int)
+}
+
+// ORSet is an observed-remove set of strings. Every add tags the element with
+// a unique tag, and a remove only removes the tags it has observed, so an add
+// concurrent with a remove wins.
+type ORSet struct {
+	Tags     map[string][]string `json:"tags"`
+	Removed  map[string]bool     `json:"removed"`
+	Counters map[string]int      `json:"counters"`
+}
+
+func (s *ORSet) Apply(op CRDTOp, replica string, clock *HLC) error {
+	switch op.Op {
+	case "add":
+		s.Counters[replica]++
+		tag := fmt.Sprintf("%s/%d", replica, s.Counters[replica])
+		s.Tags[op.Element] = append(s.Tags[op.Element], tag)
+	case "remove":
+		for _, tag := range s.Tags[op.Element] {
+			s.Removed[tag] = true
+		}
+	default:
+		return ErrUnknownOp
+	}
+	return nil
+}
+
+func (s *ORSet) Merge(other CRDTState) {
+	o := other.(*ORSet)
+	for element, tags := range o.Tags {
+		for _, tag := range tags {
+			if !slices.Contains(s.Tags[element], tag) {
+				s.Tags[element] = append(s.Tags[element], tag)
+			}
+		}
+	}
+	maps.Copy(s.Removed, o.Removed)
+	for replica, n := range o.Counters {
+		s.Counters[replica] = max(s.Counters[replica], n)
+	}
+}
+
+func (s *ORSet) Value() any {
+	elements := []string{}
+	for element, tags := range s.Tags {
+		for _, tag := range tags {
+			if !s.Removed[tag] {
+				elements = append(elements, element)
+				break
+			}
+		}
+	}
+	slices.Sort(elements)
+	return elements
+}
+
+// LWWRegister is a last-writer-wins register. Concurrent writes are ordered by
+// their hybrid logical clock timestamps, whose node breaks the ties.
+type LWWRegister struct {
+	Val       any       `json:"value"`
+	Timestamp Timestamp `json:"timestamp"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+func (reg *LWWRegister) newer(other LWWRegister) bool {
+	return reg.Timestamp.Compare(other.Timestamp) > 0
+}
+
+// next returns a write timestamped by clock after the register's current
+// value, however far ahead the clock of the replica that wrote it was
+func (reg *LWWRegister) next(value any, clock *HLC, deleted bool) LWWRegister {
+	return LWWRegister{
+		Val:       value,
+		Timestamp: clock.Update(reg.Timestamp),
+		Deleted:   deleted,
+	}
+}
+
+func (reg *LWWRegister) Apply(op CRDTOp, replica string, clock *HLC) error {
+	if op.Op != "set" {
+		return ErrUnknownOp
+	}
+	*reg = reg.next(op.Value, clock, false)
+	return nil
+}
+
+func (reg *LWWRegister) Merge(other CRDTState) {
+	if o := other.(*LWWRegister); o.newer(*reg) {
+		*reg = *o
+	}
+}
+
+func (reg *LWWRegister) Value() any {
+	return reg.Val
+}
+
+// LWWMap is a map whose fields are last-writer-wins registers. Removed fields
+// are kept as deleted registers so that older writes can't resurrect them.
+type LWWMap struct {
+	Fields map[string]LWWRegister `json:"fields"`
+}
+
+func (m *LWWMap) Apply(op CRDTOp, replica string, clock *HLC) error {
+	field := m.Fields[op.Field]
+	switch op.Op {
+	case "set":
+		m.Fields[op.Field] = field.next(op.Value, clock, false)
+	case "remove":
+		m.Fields[op.Field] = field.next(nil, clock, true)
+	default:
+		return ErrUnknownOp
+	}
+	return nil
+}
+
+func (m *LWWMap) Merge(other CRDTState) {
+	for field, reg := range other.(*LWWMap).Fields {
+		if local, ok := m.Fields[field]; !ok || reg.newer(local) {
+			m.Fields[field] = reg
+		}
+	}
+}
+
+func (m *LWWMap) Value() any {
+	value := make(map[string]any)
+	for field, reg := range m.Fields {
+		if !reg.Deleted {
+			value[field] = reg.Val
+		}
+	}
+	return value
+}
+
+// mergeCRDT merges state into the CRDT stored under key. The caller must hold
+// r.kvLock.
+func (r *Replica) mergeCRDT(key string, state *CRDT) error {
+	local, ok := r.crdts[key]
+	if !ok {
+		r.crdts[key] = state
+		return nil
+	}
+	if local.Type != state.Type {
+		return fmt.Errorf("key holds a %s", local.Type)
+	}
+	local.State.Merge(state.State)
+	return nil
+}
+
+// handleCRDTOp applies an operation to the CRDT stored under the key, creating
+// it if needed, and broadcasts the resulting state to the rest of the shard.
+// CRDTs converge whatever order their states are merged in, so they don't take
+// part in causal consistency.
+func (r *Replica) handleCRDTOp(c echo.Context) error {
+	key := c.Param("key")
+	op := new(CRDTOp)
+	if err := c.Bind(op); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+
+	r.kvLock.Lock()
+	crdt, ok := r.crdts[key]
+	if !ok {
+		state, err := newCRDTState(op.Type)
+		if err != nil {
+			r.kvLock.Unlock()
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+		}
+		crdt = &CRDT{Type: op.Type, State: state}
+	}
+	if crdt.Type != op.Type {
+		r.kvLock.Unlock()
+		return c.JSON(http.StatusConflict, ErrResponse{Error: fmt.Sprintf("key holds a %s", crdt.Type)})
+	}
+	if err := crdt.State.Apply(*op, r.addr, r.hlc); err != nil {
+		r.kvLock.Unlock()
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	r.crdts[key] = crdt
+	value := crdt.State.Value()
+	state, err := json.Marshal(crdt)
+	r.kvLock.Unlock()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrResponse{Error: err.Error()})
+	}
+
+	r.BufferAtSender(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/kvs/" + key + "/crdt",
+		Payload:  json.RawMessage(state),
+		Targets:  FilterViews(r.shardMembers(), r.addr),
+	})
+	return c.JSON(http.StatusOK, CRDTResponse{Type: crdt.Type, Value: value, ShardId: r.getShardId()})
+}
+
+// handleCRDTMerge merges a CRDT state broadcast by another replica
+func (r *Replica) handleCRDTMerge(c echo.Context) error {
+	key := c.Param("key")
+	state := new(CRDT)
+	if err := c.Bind(state); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+	if err := r.mergeCRDT(key, state); err != nil {
+		zap.L().Error("Couldn't merge CRDT", zap.String("key", key), zap.Error(err))
+		return c.JSON(http.StatusConflict, ErrResponse{Error: err.Error()})
+	}
+	crdt := r.crdts[key]
+	return c.JSON(http.StatusOK, CRDTResponse{Type: crdt.Type, Value: crdt.State.Value(), ShardId: r.getShardId()})
+}
+
+func (r *Replica) handleCRDTGet(c echo.Context) error {
+	key := c.Param("key")
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	crdt, ok := r.crdts[key]
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
+	}
+	return c.JSON(http.StatusOK, CRDTResponse{Type: crdt.Type, Value: crdt.State.Value(), ShardId: r.getShardId()})
+}
+
+// mergeCRDTs merges the CRDTs of src into dst. CRDTs whose type differs from
+// the one dst holds under the same key are dropped.
+func mergeCRDTs(dst map[string]*CRDT, src map[string]*CRDT) {
+	for key, crdt := range src {
+		local, ok := dst[key]
+		if !ok {
+			dst[key] = crdt
+			continue
+		}
+		if local.Type != crdt.Type {
+			zap.L().Error("Dropping CRDT of conflicting type", zap.String("key", key), zap.String("type", string(crdt.Type)))
+			continue
+		}
+		local.State.Merge(crdt.State)
+	}
+}
+
+// snapshotCRDTs returns a deep copy of the CRDTs of the replica
+func (r *Replica) snapshotCRDTs() map[string]*CRDT {
+	r.kvLock.RLock()
+	data, err := json.Marshal(r.crdts)
+	r.kvLock.RUnlock()
+	crdts := make(map[string]*CRDT)
+	if err == nil {
+		json.Unmarshal(data, &crdts)
+	}
+	return crdts
+}
+
+// forwardCRDT forwards a CRDT request to the shard owning the key. The body is
+// passed through untouched since it isn't a Request.
+func (r *Replica) forwardCRDT(c echo.Context, nodes []string) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	br := BroadcastRequest{
+		Targets:  nodes,
+		Method:   c.Request().Method,
+		Endpoint: c.Request().URL.RequestURI(),
+	}
+	if len(body) > 0 {
+		br.Payload = json.RawMessage(body)
+	}
+	res, err := r.BroadcastFirst(&br)
+	if err != nil || res == nil {
+		return c.JSON(http.StatusInternalServerError, ErrResponse{Error: "couldn't forward request"})
+	}
+	defer res.Body.Close()
+	return c.Stream(res.StatusCode, "application/json", res.Body)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replicate applies op at replica and returns a copy of the resulting state,
+// as it would be broadcast
+func replicate(t *testing.T, crdt *CRDT, op CRDTOp, replica string) *CRDT {
+	require.NoError(t, crdt.State.Apply(op, replica, NewHLC(replica)))
+	return clone(t, crdt)
+}
+
+func clone(t *testing.T, crdt *CRDT) *CRDT {
+	data, err := json.Marshal(crdt)
+	require.NoError(t, err)
+	state := new(CRDT)
+	require.NoError(t, json.Unmarshal(data, state))
+	return state
+}
+
+func Test_CRDTConverge(t *testing.T) {
+	tests := []struct {
+		typ      CRDTType
+		a, b     []CRDTOp
+		expected any
+	}{
+		{
+			typ:      PNCounterType,
+			a:        []CRDTOp{{Op: "increment", Amount: 5}},
+			b:        []CRDTOp{{Op: "decrement", Amount: 2}, {Op: "increment", Amount: 1}},
+			expected: 4,
+		},
+		{
+			// The add at b is concurrent with the remove at a, so it wins
+			typ:      ORSetType,
+			a:        []CRDTOp{{Op: "add", Element: "x"}, {Op: "remove", Element: "x"}, {Op: "add", Element: "y"}},
+			b:        []CRDTOp{{Op: "add", Element: "x"}},
+			expected: []string{"x", "y"},
+		},
+		{
+			typ:      LWWMapType,
+			a:        []CRDTOp{{Op: "set", Field: "f", Value: "a"}, {Op: "remove", Field: "g"}},
+			b:        []CRDTOp{{Op: "set", Field: "g", Value: "b"}},
+			expected: map[string]any{"f": "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.typ), func(t *testing.T) {
+			a, _ := newCRDTState(tt.typ)
+			b, _ := newCRDTState(tt.typ)
+			stateA, stateB := &CRDT{Type: tt.typ, State: a}, &CRDT{Type: tt.typ, State: b}
+			for _, op := range tt.b {
+				stateB = replicate(t, stateB, op, "b")
+			}
+			for _, op := range tt.a {
+				stateA = replicate(t, stateA, op, "a")
+			}
+
+			// Merging in either order, and more than once, gives the same value
+			ab := map[string]*CRDT{"k": clone(t, stateA)}
+			ba := map[string]*CRDT{"k": stateB}
+			mergeCRDTs(ab, map[string]*CRDT{"k": stateB})
+			mergeCRDTs(ba, map[string]*CRDT{"k": stateA})
+			mergeCRDTs(ba, map[string]*CRDT{"k": stateA})
+			assert.Equal(t, tt.expected, ab["k"].State.Value())
+			assert.Equal(t, tt.expected, ba["k"].State.Value())
+		})
+	}
+}
+
+// Check that counters reject increments that don't increase them
+func Test_CRDTCounterAmount(t *testing.T) {
+	for _, typ := range []CRDTType{GCounterType, PNCounterType} {
+		state, _ := newCRDTState(typ)
+		for _, amount := range []int{0, -1} {
+			assert.Error(t, state.Apply(CRDTOp{Op: "increment", Amount: amount}, "a", NewHLC("a")), "%s incremented by %d", typ, amount)
+		}
+		assert.Equal(t, 0, state.Value())
+	}
+}
+
+// Check that last-writer-wins registers are ordered by hybrid logical clock:
+// a write made after observing a register wins over it even if the clock of
+// the replica that wrote the register was ahead, and writes within the same
+// physical time are ordered by the logical counter
+func Test_LWWRegisterHLC(t *testing.T) {
+	physical := time.Now().UTC()
+	ahead, behind := NewHLC("b"), NewHLC("a")
+	ahead.now = func() time.Time { return physical.Add(time.Hour) }
+	behind.now = func() time.Time { return physical }
+
+	reg := &LWWRegister{}
+	require.NoError(t, reg.Apply(CRDTOp{Op: "set", Value: "x"}, "b", ahead))
+	observed := &LWWRegister{}
+	observed.Merge(reg)
+	require.NoError(t, observed.Apply(CRDTOp{Op: "set", Value: "y"}, "a", behind))
+	reg.Merge(observed)
+	assert.Equal(t, "y", reg.Value())
+	assert.Equal(t, physical.Add(time.Hour), reg.Timestamp.Wall)
+
+	require.NoError(t, observed.Apply(CRDTOp{Op: "set", Value: "z"}, "a", behind))
+	reg.Merge(observed)
+	assert.Equal(t, "z", reg.Value())
+	assert.Equal(t, 2, reg.Timestamp.Logical)
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"maps"
 	"net/http"
-	"strings"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -11,8 +9,14 @@ import (
 
 type Request struct {
 	StoreValue
-	CausalMetadata VectorClock `json:"causal-metadata"`
-	IsBroadcast    bool        `json:"is-broadcast,omitempty"`
+	CausalMetadata VectorClock         `json:"causal-metadata"`
+	IsBroadcast    bool                `json:"is-broadcast,omitempty"`
+	Consistency    *ConsistencyOptions `json:"consistency,omitempty"`
+	Proxied        bool                `json:"proxied,omitempty"`
+	// Context is the token returned by a read, which lets a write supersede
+	// the siblings the client has seen
+	Context string `json:"context,omitempty"`
+	Dot     *Dot   `json:"dot,omitempty"`
 }
 
 type ActionResponse struct {
@@ -23,11 +27,18 @@ type Response struct {
 	Result         string      `json:"result"`
 	CausalMetadata VectorClock `json:"causal-metadata"`
 	ShardId        string      `json:"shard-id"`
+	Quorum         *QuorumInfo `json:"quorum,omitempty"`
+	Context        string      `json:"context,omitempty"`
+	// Timestamp is the hybrid logical clock timestamp of the write made or
+	// read
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
 }
 
 type GetResponse struct {
 	Response
 	StoreValue
+	Version  string `json:"version,omitempty"`
+	Siblings []any  `json:"siblings,omitempty"`
 }
 
 func (r *Replica) handlePut(c echo.Context) error {
@@ -45,64 +56,117 @@ func (r *Replica) handlePut(c echo.Context) error {
 		)
 	}
 
-	// Read client's causal metadata.
-	remoteHost := strings.Split(c.Request().RemoteAddr, ":")[0]
+	if r.isChainShard() {
+		return r.handleChain(c, key, request)
+	}
 
-	// zap.L().Debug("In PUT /kvs/:key", zap.String("remoteHost", remoteHost), zap.String("realIp", c.RealIP()))
+	opts, err := r.consistencyFor(c, key, request)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if opts.Mode == ModeLinearizable {
+		return r.handleLinearizable(c, key, request)
+	}
+	ctx, err := decodeContext(request.Context)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid context"})
+	}
 
-	clientClock := GetClientVectorClock(request, remoteHost)
+	// Read client's causal metadata.
+	clientClock := GetClientVectorClock(request)
 	// zap.L().Info("Client Clock is (initially):", zap.Any("clientClock", clientClock.Clocks), zap.String("clientClockSelf", clientClock.Self))
 
+	// Acknowledge redelivered broadcasts without applying them twice
+	if request.IsBroadcast && r.vc.HasApplied(clientClock, &r.vcLock) {
+		return c.JSON(http.StatusOK, Response{Result: "already applied", CausalMetadata: clientClock, ShardId: r.getShardId()})
+	}
+
 	// Check if all causal dependencies are satisfied
-	if !r.vc.IsReadyFor(clientClock, false, &r.vcLock) {
+	ready, err := r.waitReady(c, clientClock, false)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if !ready {
 		return c.JSON(
 			http.StatusServiceUnavailable,
 			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
 		)
 	}
 
+	if !request.IsBroadcast {
+		// Checked under the key's lock, which prepared transactions take too
+		defer r.lockKey(key)()
+		if r.txns.IsLocked(key) {
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Key is locked by a transaction; try again later"})
+		}
+	}
+	r.kvLock.Lock()
+	ctx, dot := r.writeDot(key, ctx, request)
+	r.kvLock.Unlock()
+
 	// Prepare broadcast
+	var quorum *QuorumInfo
 	if !request.IsBroadcast {
+		r.coordLock.Lock()
+		defer r.coordLock.Unlock()
+		clientClock = r.nextWriteClock(clientClock)
 		copiedClock := CloneVC(clientClock)
 		broadcastPayload := Request{
 			StoreValue:     StoreValue{Value: request.Value},
 			CausalMetadata: copiedClock,
 			IsBroadcast:    true,
+			Context:        encodeContext(ctx),
+			Dot:            &dot,
 		}
 
-		r.BufferAtSender(&BufferAtSenderRequest{
+		shardBroadcast := &BufferAtSenderRequest{
 			Method:   http.MethodPut,
 			Payload:  broadcastPayload,
 			Endpoint: "/kvs/" + key,
-			Targets:  FilterViews(r.shards[r.shardId], r.addr),
-		})
-
-		// Broadcast the metadata to views not in the current shard
-		r.BufferAtSender(&BufferAtSenderRequest{
-			Method:   http.MethodPut,
-			Endpoint: "/cm",
-			Payload: CMRequest{
+			Targets:  FilterViews(r.shardMembers(), r.addr),
+			Hint: &Hint{
+				Method:         http.MethodPut,
+				Key:            key,
+				Value:          request.Value,
 				CausalMetadata: copiedClock,
+				Context:        broadcastPayload.Context,
+				Dot:            &dot,
 			},
-			Targets: FilterViews(r.View, r.shards[r.shardId]...),
-		})
+		}
+		if opts.Mode == ModeQuorum {
+			quorum = r.replicateQuorum(shardBroadcast, opts)
+		} else {
+			r.BufferAtSender(shardBroadcast)
+		}
 	}
 
-	// Update both vector clocks
-	r.vc.Accept(&clientClock, false, &r.vcLock)
-	zap.L().Info("After accepting PUT,", zap.Any("serverVC", r.vc.Clocks), zap.String("serverClockSelf", r.vc.Self), zap.Any("clientVC", clientClock.Clocks), zap.Any("clientClockSelf", clientClock.Self))
+	// Update both vector clocks along with the kv store, so that snapshot
+	// reads never see a clock covering a write that isn't applied yet
+	r.kvLock.Lock()
+	r.acceptWrite(&clientClock)
 	_, ok := r.kv[key]
+	r.applyDVV(key, ctx, dot, request.Value, false, clientClock)
+	siblings, context := r.siblings(key)
+	r.kvLock.Unlock()
+	clientClock.Self = ""
+	zap.L().Info("After accepting PUT,", zap.Any("serverVC", r.vc.Clocks), zap.String("serverClockSelf", r.vc.Self), zap.Any("clientVC", clientClock.Clocks), zap.Any("clientClockSelf", clientClock.Self))
 
 	if !ok {
-		r.kv[key] = request.Value
 		// Still need to return the updated causal metadata
 		// zap.L().Debug("Created kv", zap.String("key", key), zap.Any("value", r.kv[key]), zap.String("producer IP", c.RealIP()))
-		return c.JSON(http.StatusCreated, Response{Result: "created", CausalMetadata: clientClock})
+		return c.JSON(quorumStatus(http.StatusCreated, quorum), Response{Result: "created", CausalMetadata: clientClock, Quorum: quorum, Context: context, Timestamp: clientClock.Timestamp})
+	}
+
+	// The write didn't supersede every concurrent write
+	if len(siblings) > 1 {
+		return c.JSON(quorumStatus(http.StatusOK, quorum), GetResponse{
+			Response: Response{Result: "siblings", CausalMetadata: clientClock, ShardId: r.getShardId(), Quorum: quorum, Context: context, Timestamp: clientClock.Timestamp},
+			Siblings: siblings,
+		})
 	}
 
-	r.kv[key] = request.Value
-	zap.L().Debug("Replaced kv", zap.String("key", key), zap.Any("value", r.kv[key]), zap.String("producer IP", c.RealIP()))
-	return c.JSON(http.StatusOK, Response{Result: "replaced", CausalMetadata: clientClock, ShardId: r.shardId})
+	zap.L().Debug("Replaced kv", zap.String("key", key), zap.Any("value", request.Value), zap.String("producer IP", c.RealIP()))
+	return c.JSON(quorumStatus(http.StatusOK, quorum), Response{Result: "replaced", CausalMetadata: clientClock, ShardId: r.getShardId(), Quorum: quorum, Context: context, Timestamp: clientClock.Timestamp})
 }
 
 func (r *Replica) handleGet(c echo.Context) error {
@@ -111,18 +175,48 @@ func (r *Replica) handleGet(c echo.Context) error {
 
 	_ = c.Bind(request)
 
-	clientClock := GetClientVectorClock(request, c.Request().RemoteAddr)
+	clientClock := GetClientVectorClock(request)
+
+	if isHistoricalRead(c) {
+		return r.handleVersionGet(c, key, clientClock)
+	}
+
+	if r.isChainShard() {
+		return r.handleChain(c, key, request)
+	}
+
+	opts, err := r.consistencyFor(c, key, request)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if opts.Mode == ModeLinearizable {
+		return r.handleLinearizable(c, key, request)
+	}
+	if opts.Mode == ModeQuorum {
+		return r.quorumGet(c, key, clientClock, opts)
+	}
 
 	// Check if all causal dependencies are satisfied
-	if !r.vc.IsReadyFor(clientClock, true, &r.vcLock) {
-		zap.L().Warn("This should not happen. Causal dependencies are not satisfied", zap.Any("cm", *r.vc), zap.Any("clientClock", clientClock))
+	ready, err := r.waitReady(c, clientClock, true)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if !ready {
+		r.vcLock.Lock()
+		cm := CloneVC(*r.vc)
+		r.vcLock.Unlock()
+		zap.L().Warn("This should not happen. Causal dependencies are not satisfied", zap.Any("cm", cm), zap.Any("clientClock", clientClock))
 		return c.JSON(
 			http.StatusServiceUnavailable,
 			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
 		)
 	}
 
+	r.kvLock.RLock()
 	val, ok := r.kv[key]
+	latest, _ := r.latestVersion(key)
+	siblings, context := r.siblings(key)
+	r.kvLock.RUnlock()
 
 	if !ok {
 		// Not sure why we don't need causal metadata here, shouldn't this count as the reader finding out about a potential delete event or that a write to this key has not yet happened?
@@ -137,11 +231,15 @@ func (r *Replica) handleGet(c echo.Context) error {
 		Response: Response{
 			Result:         "found",
 			CausalMetadata: clientClock,
-			ShardId:        r.shardId,
+			ShardId:        r.getShardId(),
+			Context:        context,
+			Timestamp:      latest.Clock.Timestamp,
 		},
 		StoreValue: StoreValue{
 			Value: val,
 		},
+		Version:  latest.Version,
+		Siblings: siblings,
 	})
 }
 
@@ -151,60 +249,106 @@ func (r *Replica) handleDelete(c echo.Context) error {
 
 	_ = c.Bind(request)
 
-	clientClock := GetClientVectorClock(request, c.Request().RemoteAddr)
+	clientClock := GetClientVectorClock(request)
+
+	if r.isChainShard() {
+		return r.handleChain(c, key, request)
+	}
+
+	opts, err := r.consistencyFor(c, key, request)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if opts.Mode == ModeLinearizable {
+		return r.handleLinearizable(c, key, request)
+	}
+	ctx, err := decodeContext(request.Context)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid context"})
+	}
+
+	if request.IsBroadcast && r.vc.HasApplied(clientClock, &r.vcLock) {
+		return c.JSON(http.StatusOK, Response{Result: "already applied", CausalMetadata: clientClock, ShardId: r.getShardId()})
+	}
 
-	if !r.vc.IsReadyFor(clientClock, false, &r.vcLock) {
+	ready, err := r.waitReady(c, clientClock, false)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if !ready {
 		return c.JSON(
 			http.StatusServiceUnavailable,
 			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
 		)
 	}
 
-	_, ok := r.kv[key]
-	if !ok {
+	if !request.IsBroadcast {
+		// Checked under the key's lock, which prepared transactions take too
+		defer r.lockKey(key)()
+		if r.txns.IsLocked(key) {
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Key is locked by a transaction; try again later"})
+		}
+	}
+	r.kvLock.Lock()
+	if _, ok := r.kv[key]; !ok {
+		r.kvLock.Unlock()
 		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
 	}
+	ctx, dot := r.writeDot(key, ctx, request)
+	r.kvLock.Unlock()
 
 	// Prepare broadcast
+	var quorum *QuorumInfo
 	if !request.IsBroadcast {
-		copiedClock := VectorClock{
-			Self:   clientClock.Self,
-			Clocks: make(map[string]int),
-		}
-		maps.Copy(copiedClock.Clocks, clientClock.Clocks)
+		r.coordLock.Lock()
+		defer r.coordLock.Unlock()
+		clientClock = r.nextWriteClock(clientClock)
+		copiedClock := CloneVC(clientClock)
 		broadcastPayload := Request{
 			StoreValue:     StoreValue{Value: request.Value},
 			CausalMetadata: copiedClock,
 			IsBroadcast:    true,
+			Context:        encodeContext(ctx),
+			Dot:            &dot,
 		}
 
-		r.BufferAtSender(&BufferAtSenderRequest{
+		shardBroadcast := &BufferAtSenderRequest{
 			Method:   http.MethodDelete,
 			Payload:  broadcastPayload,
 			Endpoint: "/kvs/" + key,
-			Targets:  FilterViews(r.shards[r.shardId], r.addr),
-		})
-
-		r.BufferAtSender(&BufferAtSenderRequest{
-			Method: http.MethodPut,
-			Payload: CMRequest{
+			Targets:  FilterViews(r.shardMembers(), r.addr),
+			Hint: &Hint{
+				Method:         http.MethodDelete,
+				Key:            key,
 				CausalMetadata: copiedClock,
+				Context:        broadcastPayload.Context,
+				Dot:            &dot,
 			},
-			Endpoint: "/cm",
-			Targets:  FilterViews(r.View, r.shards[r.shardId]...),
-		})
+		}
+		if opts.Mode == ModeQuorum {
+			quorum = r.replicateQuorum(shardBroadcast, opts)
+		} else {
+			r.BufferAtSender(shardBroadcast)
+		}
 	}
 
-	r.vc.Accept(&clientClock, false, &r.vcLock)
-
-	delete(r.kv, key)
+	r.kvLock.Lock()
+	r.acceptWrite(&clientClock)
+	r.applyDVV(key, ctx, dot, nil, true, clientClock)
+	_, context := r.siblings(key)
+	r.kvLock.Unlock()
+	clientClock.Self = ""
 
 	// zap.L().Info("In DELETE /kvs/:key", zap.String("key", key), zap.String("ip", c.RealIP()))
 
-	return c.JSON(http.StatusOK, Response{Result: "deleted", CausalMetadata: clientClock, ShardId: r.shardId})
+	return c.JSON(quorumStatus(http.StatusOK, quorum), Response{Result: "deleted", CausalMetadata: clientClock, ShardId: r.getShardId(), Quorum: quorum, Context: context, Timestamp: clientClock.Timestamp})
 }
 
 func (r *Replica) handleDataTransfer(c echo.Context) error {
-	zap.L().Info("Replica "+r.addr+" has ", zap.Int("# keys", len(r.kv)))
-	return c.JSON(http.StatusOK, DataTransfer{Kv: r.kv, Vc: *r.vc})
+	r.chainLock.Lock()
+	seq := r.chainSeq
+	r.chainLock.Unlock()
+	kv, vc, dvvs := r.snapshotData()
+	zap.L().Info("Replica "+r.addr+" has ", zap.Int("# keys", len(kv)))
+	return c.JSON(http.StatusOK, DataTransfer{Kv: kv, Vc: vc, ChainSeq: seq, Crdts: r.snapshotCRDTs(), Dvvs: dvvs})
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"slices"
+)
+
+// Dot identifies a single write to a key: the replica that coordinated it and
+// how many writes to the key that replica had coordinated
+type Dot struct {
+	Id      string `json:"id"`
+	Counter int    `json:"counter"`
+}
+
+type Sibling struct {
+	Dot       Dot        `json:"dot"`
+	Value     any        `json:"value"`
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+}
+
+// KeyDVV is the dotted version vector of a key. VV summarizes the writes the
+// replica has seen, and Siblings holds the values of the writes no other write
+// has superseded, which are concurrent with each other. DeletedAt is the
+// timestamp of the latest deletion seen, which identifies its version.
+type KeyDVV struct {
+	VV        map[string]int `json:"vv"`
+	Siblings  []Sibling      `json:"siblings,omitempty"`
+	DeletedAt *Timestamp     `json:"deleted-at,omitempty"`
+}
+
+func (d *KeyDVV) seen(dot Dot) bool {
+	return d.VV[dot.Id] >= dot.Counter
+}
+
+// has returns whether the write identified by dot is one of d's siblings
+func (d *KeyDVV) has(dot Dot) bool {
+	return slices.ContainsFunc(d.Siblings, func(s Sibling) bool { return s.Dot == dot })
+}
+
+func (d *KeyDVV) clone() *KeyDVV {
+	return &KeyDVV{VV: maps.Clone(d.VV), Siblings: slices.Clone(d.Siblings), DeletedAt: d.DeletedAt}
+}
+
+// merge synchronizes d with o, the version vector of the key at another
+// replica. A sibling seen by one side but not kept by it was superseded there,
+// so only the siblings the other side kept or hasn't seen yet are kept. It
+// returns whether d changed.
+func (d *KeyDVV) merge(o *KeyDVV) bool {
+	changed := false
+	var kept []Sibling
+	for _, s := range d.Siblings {
+		if !o.seen(s.Dot) || o.has(s.Dot) {
+			kept = append(kept, s)
+		} else {
+			changed = true
+		}
+	}
+	for _, s := range o.Siblings {
+		if !d.seen(s.Dot) {
+			kept = append(kept, s)
+			changed = true
+		}
+	}
+	d.Siblings = kept
+	d.observeDeletion(o.DeletedAt)
+	for id, n := range o.VV {
+		if n > d.VV[id] {
+			d.VV[id] = n
+			changed = true
+		}
+	}
+	return changed
+}
+
+// observeDeletion records a deletion stamped with ts if it is the latest one
+func (d *KeyDVV) observeDeletion(ts *Timestamp) {
+	if ts != nil && (d.DeletedAt == nil || ts.Compare(*d.DeletedAt) > 0) {
+		d.DeletedAt = ts
+	}
+}
+
+// update applies the write identified by dot and stamped with ts, made by a
+// client that had seen the writes in ctx. The siblings in ctx are superseded,
+// and the written value becomes a sibling unless the write is a deletion. It
+// returns false if the write was already applied.
+func (d *KeyDVV) update(ctx map[string]int, dot Dot, value any, deleted bool, ts *Timestamp) bool {
+	if d.seen(dot) {
+		return false
+	}
+	var kept []Sibling
+	for _, s := range d.Siblings {
+		if ctx[s.Dot.Id] < s.Dot.Counter {
+			kept = append(kept, s)
+		}
+	}
+	if deleted {
+		d.observeDeletion(ts)
+	} else {
+		kept = append(kept, Sibling{Dot: dot, Value: value, Timestamp: ts})
+	}
+	d.Siblings = kept
+	for id, n := range ctx {
+		d.VV[id] = max(d.VV[id], n)
+	}
+	d.VV[dot.Id] = max(d.VV[dot.Id], dot.Counter)
+	return true
+}
+
+// encodeContext returns the opaque context token given to clients
+func encodeContext(vv map[string]int) string {
+	data, _ := json.Marshal(vv)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeContext parses a context token. An empty token decodes to a nil
+// context.
+func decodeContext(token string) (map[string]int, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var vv map[string]int
+	err = json.Unmarshal(data, &vv)
+	return vv, err
+}
+
+// keyDVV returns the dotted version vector of key. The caller must hold
+// r.kvLock.
+func (r *Replica) keyDVV(key string) *KeyDVV {
+	d, ok := r.dvvs[key]
+	if !ok {
+		d = &KeyDVV{VV: make(map[string]int)}
+		r.dvvs[key] = d
+	}
+	return d
+}
+
+// writeDot returns the context and dot of a write to key. Clients write in the
+// context of the token they supply, or in the context of this replica if they
+// don't, so that a write without a token supersedes what the replica has.
+// Broadcasts carry the dot chosen by the replica that coordinated the write.
+// The caller must hold r.kvLock, and the key lock unless request is a
+// broadcast.
+func (r *Replica) writeDot(key string, ctx map[string]int, request *Request) (map[string]int, Dot) {
+	d := r.keyDVV(key)
+	if ctx == nil {
+		ctx = maps.Clone(d.VV)
+	}
+	if request.IsBroadcast && request.Dot != nil {
+		return ctx, *request.Dot
+	}
+	return ctx, Dot{Id: r.addr, Counter: d.VV[r.addr] + 1}
+}
+
+// winner returns the sibling with the greatest timestamp, which the kv store
+// holds. Hybrid logical clock timestamps are totally ordered, so every replica
+// picks the same one.
+func (d *KeyDVV) winner() Sibling {
+	w := d.Siblings[0]
+	for _, s := range d.Siblings[1:] {
+		var ts, wts Timestamp
+		if s.Timestamp != nil {
+			ts = *s.Timestamp
+		}
+		if w.Timestamp != nil {
+			wts = *w.Timestamp
+		}
+		if c := ts.Compare(wts); c > 0 || (c == 0 && s.Dot.Id > w.Dot.Id) {
+			w = s
+		}
+	}
+	return w
+}
+
+// applyDVV applies a write identified by dot to key and makes the kv store
+// hold the winning sibling. The caller must hold r.kvLock.
+func (r *Replica) applyDVV(key string, ctx map[string]int, dot Dot, value any, deleted bool, clock VectorClock) {
+	d := r.keyDVV(key)
+	if !d.update(ctx, dot, value, deleted, clock.Timestamp) {
+		return
+	}
+	if len(d.Siblings) == 0 {
+		if _, ok := r.kv[key]; ok {
+			r.deleteKey(key, clock)
+		}
+	} else {
+		w := d.winner()
+		clock = CloneVC(clock)
+		clock.Timestamp = w.Timestamp
+		r.setKey(key, w.Value, clock)
+	}
+}
+
+// mergeDVV merges o, the version vector of key at another replica, into the
+// version vector of key and makes the kv store hold the winning sibling. It
+// returns whether the kv store changed. The caller must hold r.kvLock.
+func (r *Replica) mergeDVV(key string, o *KeyDVV) bool {
+	d := r.keyDVV(key)
+	var prev *Dot
+	if len(d.Siblings) > 0 {
+		w := d.winner()
+		prev = &w.Dot
+	}
+	if !d.merge(o) {
+		return false
+	}
+	_, exists := r.kv[key]
+	if len(d.Siblings) == 0 {
+		if exists {
+			r.deleteKey(key, VectorClock{Timestamp: d.DeletedAt})
+		}
+		return exists
+	}
+	w := d.winner()
+	if exists && prev != nil && *prev == w.Dot {
+		return false
+	}
+	r.setKey(key, w.Value, VectorClock{Timestamp: w.Timestamp})
+	return true
+}
+
+// snapshotDVVs returns a copy of the version vectors of the keys for which
+// keep returns true
+func (r *Replica) snapshotDVVs(keep func(key string) bool) map[string]*KeyDVV {
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	dvvs := make(map[string]*KeyDVV)
+	for k, d := range r.dvvs {
+		if keep(k) {
+			dvvs[k] = d.clone()
+		}
+	}
+	return dvvs
+}
+
+// siblings returns the values of the concurrent writes to key, or nil if
+// there aren't any, along with the context token of the key. The caller must
+// hold r.kvLock.
+func (r *Replica) siblings(key string) ([]any, string) {
+	d, ok := r.dvvs[key]
+	if !ok {
+		return nil, ""
+	}
+	var values []any
+	if len(d.Siblings) > 1 {
+		for _, s := range d.Siblings {
+			values = append(values, s.Value)
+		}
+	}
+	return values, encodeContext(d.VV)
+}
+
+// lockKey serializes the writes to key coordinated by this replica, so that
+// their dots are broadcast in order, and returns the function releasing it
+func (r *Replica) lockKey(key string) func() {
+	l := &r.keyLocks[merkleBucket(key)]
+	l.Lock()
+	return l.Unlock
+}
+
+// lockKeys takes the locks of every key in keys, in a fixed order, and
+// returns the function releasing them
+func (r *Replica) lockKeys(keys []string) func() {
+	var buckets []int
+	for _, k := range keys {
+		buckets = append(buckets, merkleBucket(k))
+	}
+	slices.Sort(buckets)
+	buckets = slices.Compact(buckets)
+	for _, b := range buckets {
+		r.keyLocks[b].Lock()
+	}
+	return func() {
+		for _, b := range buckets {
+			r.keyLocks[b].Unlock()
+		}
+	}
+}
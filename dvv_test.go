@@ -0,0 +1,95 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DVVSiblings(t *testing.T) {
+	d := &KeyDVV{VV: make(map[string]int)}
+
+	// Two writes made without seeing each other are kept as siblings
+	later, earlier := Timestamp{Wall: time.Unix(2, 0)}, Timestamp{Wall: time.Unix(1, 0)}
+	assert.True(t, d.update(nil, Dot{Id: "a", Counter: 1}, "x", false, &later))
+	assert.True(t, d.update(nil, Dot{Id: "b", Counter: 1}, "y", false, &earlier))
+	assert.Len(t, d.Siblings, 2)
+	// The kv store holds the sibling with the greatest timestamp, whatever
+	// order they arrived in
+	assert.Equal(t, "x", d.winner().Value)
+
+	// Redelivered writes are ignored
+	assert.False(t, d.update(nil, Dot{Id: "a", Counter: 1}, "x", false, nil))
+
+	// A write made in the context of both siblings resolves them
+	ctx, err := decodeContext(encodeContext(d.VV))
+	assert.NoError(t, err)
+	assert.True(t, d.update(ctx, Dot{Id: "a", Counter: 2}, "z", false, nil))
+	assert.Equal(t, []Sibling{{Dot: Dot{Id: "a", Counter: 2}, Value: "z"}}, d.Siblings)
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, d.VV)
+
+	// A deletion only removes the siblings it has seen
+	d.update(map[string]int{"a": 1, "b": 1}, Dot{Id: "b", Counter: 2}, nil, true, nil)
+	assert.Len(t, d.Siblings, 1)
+	d.update(map[string]int{"a": 2, "b": 2}, Dot{Id: "b", Counter: 3}, nil, true, nil)
+	assert.Empty(t, d.Siblings)
+
+	_, err = decodeContext("not a token")
+	assert.Error(t, err)
+}
+
+// Check that the siblings of a key survive the writes of the kv store, and
+// that deleting a missing key leaves no version vector behind
+func Test_ApplyDVVKeepsSiblings(t *testing.T) {
+	r := &Replica{kv: make(map[string]any), versions: make(map[string][]Version), dvvs: make(map[string]*KeyDVV)}
+	later, earlier := Timestamp{Wall: time.Unix(2, 0)}, Timestamp{Wall: time.Unix(1, 0)}
+	r.applyDVV("k", nil, Dot{Id: "a", Counter: 1}, "x", false, VectorClock{Timestamp: &later})
+	r.applyDVV("k", nil, Dot{Id: "b", Counter: 1}, "y", false, VectorClock{Timestamp: &earlier})
+	assert.Equal(t, "x", r.kv["k"])
+	assert.Len(t, r.dvvs["k"].Siblings, 2)
+
+	r.setKey("k", "z", VectorClock{})
+	assert.Len(t, r.dvvs["k"].Siblings, 2)
+
+	tc := startCluster(t, 2, 1)
+	status, err := tc.client().Delete(tc.addrs()[0], "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status)
+	tc.nodes[0].kvLock.RLock()
+	defer tc.nodes[0].kvLock.RUnlock()
+	assert.NotContains(t, tc.nodes[0].dvvs, "missing")
+}
+
+// Check that merging the version vectors of two replicas keeps the siblings
+// neither side superseded, whichever side merges
+func Test_DVVMerge(t *testing.T) {
+	ts := func(sec int64) *Timestamp { return &Timestamp{Wall: time.Unix(sec, 0)} }
+	a := &KeyDVV{VV: make(map[string]int)}
+	a.update(nil, Dot{Id: "a", Counter: 1}, "x", false, ts(1))
+	b := a.clone()
+	// a overwrites x, while b writes y concurrently
+	a.update(maps.Clone(a.VV), Dot{Id: "a", Counter: 2}, "x2", false, ts(2))
+	b.update(nil, Dot{Id: "b", Counter: 1}, "y", false, ts(3))
+
+	ab, ba := a.clone(), b.clone()
+	assert.True(t, ab.merge(b))
+	assert.True(t, ba.merge(a))
+	for _, d := range []*KeyDVV{ab, ba} {
+		assert.ElementsMatch(t, []Sibling{
+			{Dot: Dot{Id: "a", Counter: 2}, Value: "x2", Timestamp: ts(2)},
+			{Dot: Dot{Id: "b", Counter: 1}, Value: "y", Timestamp: ts(3)},
+		}, d.Siblings)
+		assert.Equal(t, "y", d.winner().Value)
+		assert.Equal(t, map[string]int{"a": 2, "b": 1}, d.VV)
+	}
+	assert.False(t, ab.merge(ba))
+
+	// A deletion the other side hasn't seen wins over the value it deleted
+	deleted := ab.clone()
+	deleted.update(maps.Clone(ab.VV), Dot{Id: "a", Counter: 3}, nil, true, ts(4))
+	assert.True(t, ab.merge(deleted))
+	assert.Empty(t, ab.Siblings)
+}
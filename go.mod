@@ -1,6 +1,6 @@
 module github.com/girivad/CSE138_Assignment3
 
-go 1.21
+go 1.25
 
 require (
 	github.com/labstack/echo/v4 v4.11.4
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxHints     = 1000
+	defaultMaxHintAge   = time.Hour
+	hintDeliveryBackoff = time.Second
+)
+
+// Hint is a replicated write that couldn't be delivered to Target, kept by
+// the sender until Target is reachable again
+type Hint struct {
+	Target         string      `json:"target"`
+	Method         string      `json:"method"`
+	Key            string      `json:"key"`
+	Value          any         `json:"value,omitempty"`
+	CausalMetadata VectorClock `json:"causal-metadata"`
+	Context        string      `json:"context,omitempty"`
+	Dot            *Dot        `json:"dot,omitempty"`
+	CreatedAt      time.Time   `json:"created-at"`
+}
+
+type HintsResponse struct {
+	Count int    `json:"count"`
+	Hints []Hint `json:"hints"`
+}
+
+// HintStore is a bounded, persisted list of hints in the order they were
+// created. When full, the oldest hints are dropped first.
+type HintStore struct {
+	lock     sync.Mutex
+	path     string
+	maxHints int
+	maxAge   time.Duration
+	hints    []Hint
+}
+
+func NewHintStore(dataDir string, maxHints string, maxAge string) *HintStore {
+	hs := &HintStore{
+		path:     filepath.Join(dataDir, "hints.json"),
+		maxHints: defaultMaxHints,
+		maxAge:   defaultMaxHintAge,
+	}
+	if maxHints != "" {
+		n, err := strconv.Atoi(maxHints)
+		if err != nil {
+			panic(err)
+		}
+		hs.maxHints = n
+	}
+	if maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			panic(err)
+		}
+		hs.maxAge = d
+	}
+	if err := loadJSON(hs.path, &hs.hints); err != nil {
+		zap.L().Error("Couldn't load hints", zap.String("path", hs.path), zap.Error(err))
+	}
+	return hs
+}
+
+// Add stores a hint, evicting the oldest hints beyond the store's capacity
+func (hs *HintStore) Add(h Hint) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	hs.hints = append(hs.hints, h)
+	hs.expire()
+	if over := len(hs.hints) - hs.maxHints; over > 0 {
+		zap.L().Warn("Hint store full, dropping oldest hints", zap.Int("dropped", over))
+		hs.hints = hs.hints[over:]
+	}
+	hs.save()
+}
+
+// List returns the hints that haven't expired yet
+func (hs *HintStore) List() []Hint {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.expire()
+	return append([]Hint(nil), hs.hints...)
+}
+
+// Remove drops a delivered hint
+func (hs *HintStore) Remove(h Hint) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	for i, stored := range hs.hints {
+		if stored.Target == h.Target && stored.Key == h.Key && stored.CreatedAt.Equal(h.CreatedAt) {
+			hs.hints = append(hs.hints[:i], hs.hints[i+1:]...)
+			break
+		}
+	}
+	hs.save()
+}
+
+// Pending reports whether any hints for target are waiting to be delivered
+func (hs *HintStore) Pending(target string) bool {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.expire()
+	return slices.ContainsFunc(hs.hints, func(h Hint) bool { return h.Target == target })
+}
+
+// HighestClock returns the greatest entry of self in the causal metadata of
+// the stored hints
+func (hs *HintStore) HighestClock(self string) int {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	highest := 0
+	for _, h := range hs.hints {
+		highest = max(highest, h.CausalMetadata.Clocks[self])
+	}
+	return highest
+}
+
+// expire drops hints older than maxAge. The caller must hold hs.lock.
+func (hs *HintStore) expire() {
+	cutoff := time.Now().Add(-hs.maxAge)
+	var kept []Hint
+	for _, h := range hs.hints {
+		if h.CreatedAt.After(cutoff) {
+			kept = append(kept, h)
+		}
+	}
+	if dropped := len(hs.hints) - len(kept); dropped > 0 {
+		zap.L().Warn("Dropping expired hints", zap.Int("dropped", dropped))
+	}
+	hs.hints = kept
+}
+
+// save persists the hints. The caller must hold hs.lock.
+func (hs *HintStore) save() {
+	if err := saveJSON(hs.path, hs.hints); err != nil {
+		zap.L().Error("Couldn't persist hints", zap.String("path", hs.path), zap.Error(err))
+	}
+}
+
+// runHintedHandoff periodically delivers hints to their targets. Hints for
+// the same target are delivered in the order they were created, and delivery
+// to a target stops at the first hint it doesn't accept.
+func (r *Replica) runHintedHandoff() {
+	for r.sleep(hintDeliveryBackoff) {
+
+		blocked := make(map[string]bool)
+		for _, h := range r.hints.List() {
+			if blocked[h.Target] {
+				continue
+			}
+			if !r.deliverHint(h) {
+				blocked[h.Target] = true
+				continue
+			}
+			zap.L().Info("Delivered hint", zap.String("target", h.Target), zap.String("key", h.Key))
+			r.hints.Remove(h)
+		}
+	}
+}
+
+func (r *Replica) deliverHint(h Hint) bool {
+	res, err := r.transport.Send(HttpRequest{
+		method:   h.Method,
+		endpoint: "/kvs/" + h.Key,
+		addr:     h.Target,
+		payload: Request{
+			StoreValue:     StoreValue{Value: h.Value},
+			CausalMetadata: h.CausalMetadata,
+			IsBroadcast:    true,
+			Context:        h.Context,
+			Dot:            h.Dot,
+		},
+	})
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	// A 404 means the key a DELETE was meant for is already gone at the target
+	return res.StatusCode < 300 || res.StatusCode == http.StatusNotFound
+}
+
+func (r *Replica) handleHintsGet(c echo.Context) error {
+	hints := r.hints.List()
+	return c.JSON(http.StatusOK, HintsResponse{Count: len(hints), Hints: hints})
+}
+
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "data"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HintStoreBounded(t *testing.T) {
+	hs := NewHintStore(t.TempDir(), "3", "")
+	for i := 0; i < 5; i++ {
+		hs.Add(Hint{Target: "a", Key: fmt.Sprintf("key%d", i), CreatedAt: time.Now()})
+	}
+
+	hints := hs.List()
+	assert.Len(t, hints, 3)
+	assert.Equal(t, "key2", hints[0].Key)
+	assert.Equal(t, "key4", hints[2].Key)
+}
+
+func Test_HintStoreExpires(t *testing.T) {
+	hs := NewHintStore(t.TempDir(), "", "1m")
+	hs.Add(Hint{Target: "a", Key: "old", CreatedAt: time.Now().Add(-2 * time.Minute)})
+	hs.Add(Hint{Target: "a", Key: "new", CreatedAt: time.Now()})
+
+	hints := hs.List()
+	assert.Len(t, hints, 1)
+	assert.Equal(t, "new", hints[0].Key)
+}
+
+func Test_HintStorePersists(t *testing.T) {
+	dir := t.TempDir()
+	hs := NewHintStore(dir, "", "")
+	hs.Add(Hint{Target: "a", Key: "k1", CreatedAt: time.Now()})
+	hs.Add(Hint{Target: "b", Key: "k2", CreatedAt: time.Now()})
+	hs.Remove(hs.List()[0])
+
+	hints := NewHintStore(dir, "", "").List()
+	assert.Len(t, hints, 1)
+	assert.Equal(t, "k2", hints[0].Key)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type opKind int
+
+const (
+	opWrite opKind = iota
+	opRead
+)
+
+// historyOp is a client operation recorded by a History. Every write writes a
+// unique value, so that reads can be traced back to the write they observed.
+type historyOp struct {
+	Index  int
+	Client int
+	Kind   opKind
+	Key    string
+	Value  string
+	// Found is false for reads that didn't find the key
+	Found bool
+	// Addr is the replica that served the operation, and Clock the causal
+	// metadata the client held once it completed
+	Addr  string
+	Clock VectorClock
+}
+
+func (op historyOp) String() string {
+	var s string
+	switch {
+	case op.Kind == opWrite:
+		s = fmt.Sprintf("#%d client %d wrote %s=%s", op.Index, op.Client, op.Key, op.Value)
+	case op.Found:
+		s = fmt.Sprintf("#%d client %d read %s=%s", op.Index, op.Client, op.Key, op.Value)
+	default:
+		s = fmt.Sprintf("#%d client %d read %s (not found)", op.Index, op.Client, op.Key)
+	}
+	if op.Addr != "" {
+		s += fmt.Sprintf(" at %s with %v", op.Addr, op.Clock.Clocks)
+	}
+	return s
+}
+
+// History records the operations of every client in the order they completed
+type History struct {
+	lock sync.Mutex
+	ops  []historyOp
+}
+
+func (h *History) record(op historyOp) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	op.Index = len(h.ops)
+	h.ops = append(h.ops, op)
+}
+
+func (h *History) Ops() []historyOp {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return slices.Clone(h.ops)
+}
+
+// CausalViolation is a read that didn't observe a write in the causal past of
+// its client. Trace is the chain of operations through which the missed write
+// entered the causal past, ending with the read.
+type CausalViolation struct {
+	Guarantee string
+	Read      historyOp
+	Missed    historyOp
+	Trace     []historyOp
+}
+
+func (v *CausalViolation) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s violated: %s missed %s\n", v.Guarantee, v.Read, v.Missed)
+	for _, op := range v.Trace {
+		fmt.Fprintf(&b, "\t%s\n", op)
+	}
+	return b.String()
+}
+
+// causalPast maps each write in the causal past of a client to the operation
+// of the client that brought it in: the write itself, or a read
+type causalPast map[int]int
+
+// checkCausal checks that every read observed the writes to its key in the
+// causal past of its client, which covers read-your-writes, monotonic reads
+// and writes-follow-reads. A read may return a write concurrent with those,
+// but not one that a write in the causal past overwrote. It returns the
+// first violation, or nil if the history is causally consistent.
+func checkCausal(ops []historyOp) *CausalViolation {
+	writes := make(map[string]int)
+	byClient := make(map[int][]historyOp)
+	var clients []int
+	for _, op := range ops {
+		if op.Kind == opWrite {
+			writes[op.Value] = op.Index
+		}
+		if _, ok := byClient[op.Client]; !ok {
+			clients = append(clients, op.Client)
+		}
+		byClient[op.Client] = append(byClient[op.Client], op)
+	}
+	slices.Sort(clients)
+
+	// writePast is the causal past of each write, the write included, as seen
+	// by its client when it wrote it
+	writePast := make(map[int]causalPast)
+	pasts := make(map[int]causalPast)
+	next := make(map[int]int)
+	for _, client := range clients {
+		pasts[client] = make(causalPast)
+	}
+
+	// Clients are replayed in their own order, and a read is only replayed
+	// once the write it observed has been
+	for progress := true; progress; {
+		progress = false
+		for _, client := range clients {
+			for next[client] < len(byClient[client]) {
+				op := byClient[client][next[client]]
+				past := pasts[client]
+				if op.Kind == opWrite {
+					past[op.Index] = op.Index
+					writePast[op.Index] = clonePast(past)
+				} else {
+					source, found := writes[op.Value]
+					if op.Found && (!found || writePast[source] == nil) {
+						break
+					}
+					if v := checkRead(ops, writes, writePast, pasts, op); v != nil {
+						return v
+					}
+					if op.Found {
+						for w := range writePast[source] {
+							if _, ok := past[w]; !ok {
+								past[w] = op.Index
+							}
+						}
+					}
+				}
+				next[client]++
+				progress = true
+			}
+		}
+	}
+
+	for _, client := range clients {
+		if next[client] < len(byClient[client]) {
+			op := byClient[client][next[client]]
+			return &CausalViolation{Guarantee: "causality", Read: op, Trace: []historyOp{op}}
+		}
+	}
+	return nil
+}
+
+func clonePast(past causalPast) causalPast {
+	c := make(causalPast, len(past))
+	for w, cause := range past {
+		c[w] = cause
+	}
+	return c
+}
+
+// checkRead checks a read against the causal past of its client
+func checkRead(ops []historyOp, writes map[string]int, writePast map[int]causalPast, pasts map[int]causalPast, read historyOp) *CausalViolation {
+	past := pasts[read.Client]
+	source := -1
+	if read.Found {
+		source = writes[read.Value]
+	}
+
+	var missed []int
+	for w := range past {
+		if ops[w].Key != read.Key || w == source {
+			continue
+		}
+		// The returned write is fine if the write isn't after it
+		if source >= 0 {
+			if _, overwritten := writePast[w][source]; !overwritten {
+				continue
+			}
+		}
+		missed = append(missed, w)
+	}
+	if len(missed) == 0 {
+		return nil
+	}
+	w := slices.Min(missed)
+
+	v := &CausalViolation{Read: read, Missed: ops[w]}
+	cause := ops[past[w]]
+	switch {
+	case cause.Index == w:
+		v.Guarantee = "read-your-writes"
+	case cause.Value == ops[w].Value:
+		v.Guarantee = "monotonic reads"
+	default:
+		v.Guarantee = "writes-follow-reads"
+	}
+	v.Trace = append(explain(ops, writes, writePast, past, w), read)
+	return v
+}
+
+// explain returns the chain of operations through which w entered past
+func explain(ops []historyOp, writes map[string]int, writePast map[int]causalPast, past causalPast, w int) []historyOp {
+	cause := ops[past[w]]
+	if cause.Index == w {
+		return []historyOp{ops[w]}
+	}
+	source := writes[cause.Value]
+	if source == w {
+		return []historyOp{ops[w], cause}
+	}
+	return append(explain(ops, writes, writePast, writePast[source], w), ops[source], cause)
+}
+
+func Test_CheckCausal(t *testing.T) {
+	write := func(client int, key, value string) historyOp {
+		return historyOp{Client: client, Kind: opWrite, Key: key, Value: value}
+	}
+	read := func(client int, key, value string) historyOp {
+		return historyOp{Client: client, Kind: opRead, Key: key, Value: value, Found: value != ""}
+	}
+
+	tests := []struct {
+		name      string
+		ops       []historyOp
+		guarantee string
+		trace     []int
+	}{
+		{
+			name: "consistent",
+			ops: []historyOp{
+				write(0, "x", "a"), write(1, "x", "b"), read(0, "x", "b"),
+				read(1, "x", "b"), write(0, "y", "c"), read(1, "y", "c"), read(1, "x", "b"),
+			},
+		},
+		{
+			name:      "read-your-writes",
+			ops:       []historyOp{write(0, "x", "a"), write(1, "y", "b"), read(0, "x", "")},
+			guarantee: "read-your-writes",
+			trace:     []int{0, 2},
+		},
+		{
+			name:      "monotonic reads",
+			ops:       []historyOp{write(0, "x", "a"), write(0, "x", "b"), read(1, "x", "b"), read(1, "x", "a")},
+			guarantee: "monotonic reads",
+			trace:     []int{1, 2, 3},
+		},
+		{
+			name: "writes-follow-reads",
+			ops: []historyOp{
+				write(0, "x", "a"), read(1, "x", "a"), write(1, "y", "b"),
+				write(2, "z", "c"), read(2, "y", "b"), read(2, "x", ""),
+			},
+			guarantee: "writes-follow-reads",
+			trace:     []int{0, 1, 2, 4, 5},
+		},
+		{
+			name:      "read from the future",
+			ops:       []historyOp{read(0, "x", "b"), write(0, "y", "a"), read(1, "y", "a"), write(1, "x", "b")},
+			guarantee: "causality",
+			trace:     []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &History{}
+			for _, op := range tt.ops {
+				h.record(op)
+			}
+			v := checkCausal(h.Ops())
+			if tt.guarantee == "" {
+				if v != nil {
+					t.Fatal(v)
+				}
+				return
+			}
+			if v == nil {
+				t.Fatalf("expected a %s violation", tt.guarantee)
+			}
+			var trace []int
+			for _, op := range v.Trace {
+				trace = append(trace, op.Index)
+			}
+			if v.Guarantee != tt.guarantee || !slices.Equal(trace, tt.trace) {
+				t.Fatalf("expected a %s violation with trace %v, got %s", tt.guarantee, tt.trace, v)
+			}
+		})
+	}
+}
+
+// historyClient performs random operations on a test cluster and records them
+// in a History
+type historyClient struct {
+	*testClient
+	id      int
+	history *History
+	rng     *rand.Rand
+	writes  int
+}
+
+const historyRetries = 10
+
+func (hc *historyClient) put(addr string, key string) error {
+	hc.writes++
+	value := fmt.Sprintf("c%d-%d", hc.id, hc.writes)
+	for try := 0; try < historyRetries; try++ {
+		status, err := hc.Put(addr, key, value)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case http.StatusOK, http.StatusCreated:
+			hc.history.record(historyOp{Client: hc.id, Kind: opWrite, Key: key, Value: value, Addr: addr, Clock: CloneVC(hc.clock)})
+			return nil
+		case http.StatusServiceUnavailable:
+			time.Sleep(20 * time.Millisecond)
+		default:
+			return fmt.Errorf("PUT %s at %s: unexpected status %d", key, addr, status)
+		}
+	}
+	return fmt.Errorf("PUT %s at %s: unavailable", key, addr)
+}
+
+func (hc *historyClient) get(addr string, key string) error {
+	for try := 0; try < historyRetries; try++ {
+		res, status, err := hc.Get(addr, key)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case http.StatusOK:
+			hc.history.record(historyOp{Client: hc.id, Kind: opRead, Key: key, Value: fmt.Sprint(res.Value), Found: true, Addr: addr, Clock: CloneVC(hc.clock)})
+			return nil
+		case http.StatusNotFound:
+			hc.history.record(historyOp{Client: hc.id, Kind: opRead, Key: key, Addr: addr, Clock: CloneVC(hc.clock)})
+			return nil
+		case http.StatusServiceUnavailable:
+			time.Sleep(20 * time.Millisecond)
+		default:
+			return fmt.Errorf("GET %s at %s: unexpected status %d", key, addr, status)
+		}
+	}
+	return fmt.Errorf("GET %s at %s: unavailable", key, addr)
+}
+
+// Test_CausalHistory runs clients that read and write a few keys through
+// random replicas of a sharded cluster, and checks the recorded history. The
+// replicas delay and reorder the writes they replicate, so reads through a
+// replica the writes haven't reached yet must wait for them.
+func Test_CausalHistory(t *testing.T) {
+	tc := startCluster(t, 4, 2)
+	addrs := tc.addrs()
+	tc.faults.SetFaults(Faults{
+		DuplicateRate: 0.2,
+		ReorderRate:   0.3,
+		Jitter:        20 * time.Millisecond,
+	})
+	keys := []string{"x", "y", "z"}
+	h := &History{}
+
+	const clientCount, opCount = 4, 30
+	errs := make(chan error, clientCount)
+	for id := 0; id < clientCount; id++ {
+		hc := &historyClient{
+			testClient: tc.client(),
+			id:         id,
+			history:    h,
+			rng:        rand.New(rand.NewSource(int64(id))),
+		}
+		go func() {
+			for i := 0; i < opCount; i++ {
+				addr := addrs[hc.rng.Intn(len(addrs))]
+				key := keys[hc.rng.Intn(len(keys))]
+				var err error
+				if hc.rng.Intn(2) == 0 {
+					err = hc.put(addr, key)
+				} else {
+					err = hc.get(addr, key)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < clientCount; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v := checkCausal(h.Ops()); v != nil {
+		t.Fatal(v)
+	}
+	if stats := tc.faults.Stats(); stats.Reordered == 0 {
+		t.Fatalf("no replicated request was reordered: %+v", stats)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cmp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp: the physical time of the
+// write, a logical counter ordering the events that happened within the same
+// physical time, and the replica that stamped it, which breaks the remaining
+// ties so that timestamps are totally ordered
+type Timestamp struct {
+	Wall    time.Time `json:"wall"`
+	Logical int       `json:"logical"`
+	Node    string    `json:"node,omitempty"`
+}
+
+func (t Timestamp) Compare(o Timestamp) int {
+	if c := t.Wall.Compare(o.Wall); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(t.Logical, o.Logical); c != 0 {
+		return c
+	}
+	return strings.Compare(t.Node, o.Node)
+}
+
+func (t Timestamp) IsZero() bool {
+	return t.Wall.IsZero() && t.Logical == 0
+}
+
+// maxTimestamp returns the greater of two timestamps
+func maxTimestamp(a Timestamp, b Timestamp) Timestamp {
+	if a.Compare(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// HLC is a hybrid logical clock. Its timestamps stay close to physical time,
+// but never go backwards and are always greater than the timestamps of the
+// events it observed, so they respect causality even when physical clocks are
+// skewed.
+type HLC struct {
+	lock sync.Mutex
+	node string
+	last Timestamp
+	now  func() time.Time
+}
+
+func NewHLC(node string) *HLC {
+	return &HLC{node: node, now: func() time.Time { return time.Now().UTC() }}
+}
+
+// Now returns the timestamp of a local event
+func (h *HLC) Now() Timestamp {
+	return h.Update(Timestamp{})
+}
+
+// Update observes a timestamp received from another replica or a client, and
+// returns the timestamp of the event, which is greater than both ts and every
+// timestamp returned before
+func (h *HLC) Update(ts Timestamp) Timestamp {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pt := h.now()
+	wall := h.last.Wall
+	if ts.Wall.After(wall) {
+		wall = ts.Wall
+	}
+	switch {
+	case pt.After(wall):
+		h.last = Timestamp{Wall: pt}
+	case wall.Equal(h.last.Wall) && wall.Equal(ts.Wall):
+		h.last.Logical = max(h.last.Logical, ts.Logical) + 1
+	case wall.Equal(h.last.Wall):
+		h.last.Logical++
+	default:
+		h.last = Timestamp{Wall: wall, Logical: ts.Logical + 1}
+	}
+	h.last.Node = h.node
+	return h.last
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HLC(t *testing.T) {
+	physical := time.Unix(100, 0).UTC()
+	h := NewHLC("a")
+	h.now = func() time.Time { return physical }
+
+	t1 := h.Now()
+	assert.Equal(t, Timestamp{Wall: physical, Node: "a"}, t1)
+
+	// Timestamps keep increasing while the physical clock stands still
+	t2 := h.Now()
+	assert.Equal(t, 1, t2.Logical)
+	assert.Equal(t, 1, t2.Compare(t1))
+
+	// A timestamp from a replica whose clock is ahead is observed
+	remote := Timestamp{Wall: physical.Add(time.Second), Logical: 5, Node: "b"}
+	t3 := h.Update(remote)
+	assert.Equal(t, remote.Wall, t3.Wall)
+	assert.Equal(t, 6, t3.Logical)
+	assert.Equal(t, 1, t3.Compare(remote))
+
+	// Once the physical clock catches up, the logical counter resets
+	physical = physical.Add(2 * time.Second)
+	assert.Equal(t, Timestamp{Wall: physical, Node: "a"}, h.Now())
+
+	// Ties between replicas are broken by node
+	assert.Equal(t, -1, Timestamp{Wall: physical, Node: "a"}.Compare(Timestamp{Wall: physical, Node: "b"}))
+}
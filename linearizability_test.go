@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// linOp is a client operation on a key along with the logical times at which
+// the client sent it and got its response
+type linOp struct {
+	Client int
+	Key    string
+	Kind   opKind
+	Value  string
+	// Found is false for reads that didn't find the key
+	Found bool
+	// Created is true for writes that created the key
+	Created      bool
+	Call, Return int64
+	// Pending is true for writes the client got no answer to, which may or
+	// may not have taken effect
+	Pending bool
+}
+
+func (op linOp) String() string {
+	switch {
+	case op.Kind == opWrite && op.Pending:
+		return fmt.Sprintf("put %s=%s -> ?", op.Key, op.Value)
+	case op.Kind == opWrite && op.Created:
+		return fmt.Sprintf("put %s=%s -> created", op.Key, op.Value)
+	case op.Kind == opWrite:
+		return fmt.Sprintf("put %s=%s -> replaced", op.Key, op.Value)
+	case op.Found:
+		return fmt.Sprintf("get %s -> %s", op.Key, op.Value)
+	default:
+		return fmt.Sprintf("get %s -> not found", op.Key)
+	}
+}
+
+// LinHistory records client operations with the logical times of their calls
+// and returns
+type LinHistory struct {
+	clock atomic.Int64
+	lock  sync.Mutex
+	ops   []linOp
+}
+
+func (h *LinHistory) now() int64 {
+	return h.clock.Add(1)
+}
+
+func (h *LinHistory) record(op linOp) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+func (h *LinHistory) Ops() []linOp {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return slices.Clone(h.ops)
+}
+
+// registerState is the state of a key in the sequential specification of
+// /kvs/:key
+type registerState struct {
+	value  string
+	exists bool
+}
+
+func (s registerState) step(op linOp) (registerState, bool) {
+	if op.Kind == opRead {
+		return s, op.Found == s.exists && (!op.Found || op.Value == s.value)
+	}
+	if !op.Pending && op.Created == s.exists {
+		return s, false
+	}
+	return registerState{value: op.Value, exists: true}, true
+}
+
+// linResult is the result of checking the operations on one key. Longest is
+// the longest sequence of operations, as indices into Ops, that the checker
+// could linearize.
+type linResult struct {
+	Key          string
+	Linearizable bool
+	Ops          []linOp
+	Longest      []int
+}
+
+// checkLinearizable checks the history of every key separately, since keys
+// are independent registers
+func checkLinearizable(ops []linOp) []linResult {
+	byKey := make(map[string][]linOp)
+	for _, op := range ops {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	var results []linResult
+	for key, ops := range byKey {
+		ok, longest := checkRegister(ops)
+		results = append(results, linResult{Key: key, Linearizable: ok, Ops: ops, Longest: longest})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results
+}
+
+// linEntry is the call or the return of an operation in the event list of
+// checkRegister
+type linEntry struct {
+	op   int
+	call bool
+	time int64
+	// match is the return of a call, or nil if the call is pending
+	match      *linEntry
+	prev, next *linEntry
+}
+
+func (e *linEntry) lift() {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	if m := e.match; m != nil {
+		m.prev.next = m.next
+		if m.next != nil {
+			m.next.prev = m.prev
+		}
+	}
+}
+
+func (e *linEntry) unlift() {
+	if m := e.match; m != nil {
+		m.prev.next = m
+		if m.next != nil {
+			m.next.prev = m
+		}
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+// checkRegister searches for a linearization of the operations on a register
+// with the algorithm of Wing and Gong as improved by Lowe, the one used by
+// Knossos and Porcupine: operations are linearized in the order of their
+// calls as long as no return is passed over, backtracking when the register
+// can't take the next operation, and states already explored are skipped.
+// Pending writes may be left out.
+func checkRegister(ops []linOp) (bool, []int) {
+	var entries []*linEntry
+	remaining := 0
+	for i, op := range ops {
+		call := &linEntry{op: i, call: true, time: op.Call}
+		entries = append(entries, call)
+		if !op.Pending {
+			call.match = &linEntry{op: i, time: op.Return}
+			entries = append(entries, call.match)
+			remaining++
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].time < entries[j].time })
+	head := &linEntry{}
+	prev := head
+	for _, e := range entries {
+		e.prev, prev.next = prev, e
+		prev = e
+	}
+
+	type frame struct {
+		entry *linEntry
+		state registerState
+	}
+	var (
+		stack      []frame
+		longest    []int
+		state      registerState
+		linearized = make([]byte, len(ops))
+		explored   = make(map[string]bool)
+	)
+	entry := head.next
+	for remaining > 0 {
+		if entry != nil && entry.call {
+			if next, ok := state.step(ops[entry.op]); ok {
+				linearized[entry.op] = 1
+				key := fmt.Sprintf("%s|%t|%s", linearized, next.exists, next.value)
+				if !explored[key] {
+					explored[key] = true
+					stack = append(stack, frame{entry: entry, state: state})
+					state = next
+					entry.lift()
+					if entry.match != nil {
+						remaining--
+					}
+					if len(stack) > len(longest) {
+						longest = longest[:0]
+						for _, f := range stack {
+							longest = append(longest, f.entry.op)
+						}
+					}
+					entry = head.next
+					continue
+				}
+				linearized[entry.op] = 0
+			}
+			entry = entry.next
+			continue
+		}
+
+		// An operation returned before it could be linearized
+		if len(stack) == 0 {
+			return false, longest
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		linearized[f.entry.op] = 0
+		f.entry.unlift()
+		if f.entry.match != nil {
+			remaining++
+		}
+		entry = f.entry.next
+	}
+
+	longest = longest[:0]
+	for _, f := range stack {
+		longest = append(longest, f.entry.op)
+	}
+	return true, longest
+}
+
+// visualizeLinearizability renders the history of every key that isn't
+// linearizable as a timeline with one line per operation, ordered by call,
+// followed by the longest linearization the checker found
+func visualizeLinearizability(results []linResult) []byte {
+	var b bytes.Buffer
+	for _, res := range results {
+		if res.Linearizable {
+			continue
+		}
+		fmt.Fprintf(&b, "key %s is not linearizable\n\n", res.Key)
+
+		var times []int64
+		for _, op := range res.Ops {
+			times = append(times, op.Call)
+			if !op.Pending {
+				times = append(times, op.Return)
+			}
+		}
+		slices.Sort(times)
+		column := func(t int64) int {
+			i, _ := slices.BinarySearch(times, t)
+			return i
+		}
+
+		order := make([]int, len(res.Ops))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool { return res.Ops[order[i]].Call < res.Ops[order[j]].Call })
+		inLongest := make(map[int]bool)
+		for _, i := range res.Longest {
+			inLongest[i] = true
+		}
+		for _, i := range order {
+			op := res.Ops[i]
+			end := len(times)
+			if !op.Pending {
+				end = column(op.Return)
+			}
+			start := column(op.Call)
+			bar := strings.Repeat(" ", start) + "[" + strings.Repeat("-", max(end-start-1, 0))
+			if op.Pending {
+				bar += ">"
+			} else {
+				bar += "]"
+			}
+			mark := " "
+			if !inLongest[i] {
+				mark = "*"
+			}
+			fmt.Fprintf(&b, "%s client %-3d %-*s  %s\n", mark, op.Client, len(times)+1, bar, op)
+		}
+		b.WriteString("\n* not part of the longest linearization\n\nlongest linearization:\n")
+		for n, i := range res.Longest {
+			fmt.Fprintf(&b, "%4d. client %d %s\n", n+1, res.Ops[i].Client, res.Ops[i])
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// assertLinearizable fails the test if the history isn't linearizable, and
+// writes the visualization of the failing keys to a file named after the test
+func assertLinearizable(t *testing.T, ops []linOp) {
+	t.Helper()
+	results := checkLinearizable(ops)
+	var failed []string
+	for _, res := range results {
+		if !res.Linearizable {
+			failed = append(failed, res.Key)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	path := filepath.Join(os.TempDir(), name+"-linearizability.txt")
+	if err := os.WriteFile(path, visualizeLinearizability(results), 0644); err != nil {
+		t.Errorf("couldn't write the visualization: %v", err)
+	}
+	t.Fatalf("history of keys %v isn't linearizable, see %s", failed, path)
+}
+
+func Test_CheckLinearizable(t *testing.T) {
+	put := func(client int, value string, created bool, call, ret int64) linOp {
+		return linOp{Client: client, Key: "x", Kind: opWrite, Value: value, Created: created, Call: call, Return: ret}
+	}
+	get := func(client int, value string, call, ret int64) linOp {
+		return linOp{Client: client, Key: "x", Kind: opRead, Value: value, Found: value != "", Call: call, Return: ret}
+	}
+	pending := func(client int, value string, call int64) linOp {
+		return linOp{Client: client, Key: "x", Kind: opWrite, Value: value, Call: call, Pending: true}
+	}
+
+	tests := []struct {
+		name         string
+		ops          []linOp
+		linearizable bool
+	}{
+		{
+			name:         "concurrent read sees either value",
+			ops:          []linOp{put(0, "a", true, 1, 2), put(0, "b", false, 3, 6), get(1, "a", 4, 5), get(1, "b", 7, 8)},
+			linearizable: true,
+		},
+		{
+			name:         "stale read",
+			ops:          []linOp{put(0, "a", true, 1, 2), put(0, "b", false, 3, 4), get(1, "a", 5, 6)},
+			linearizable: false,
+		},
+		{
+			name:         "reads go back in time",
+			ops:          []linOp{put(0, "a", true, 1, 2), put(0, "b", false, 3, 10), get(1, "b", 4, 5), get(2, "a", 6, 7)},
+			linearizable: false,
+		},
+		{
+			name:         "two writes create the key",
+			ops:          []linOp{put(0, "a", true, 1, 3), put(1, "b", true, 2, 4)},
+			linearizable: false,
+		},
+		{
+			name:         "pending write observed",
+			ops:          []linOp{pending(0, "a", 1), get(1, "", 2, 3), get(1, "a", 4, 5), put(2, "b", false, 6, 7)},
+			linearizable: true,
+		},
+		{
+			name:         "pending write left out",
+			ops:          []linOp{pending(0, "a", 1), put(1, "b", true, 2, 3), get(1, "b", 4, 5)},
+			linearizable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := checkLinearizable(tt.ops)
+			if results[0].Linearizable != tt.linearizable {
+				t.Fatalf("expected linearizable=%t\n%s", tt.linearizable, visualizeLinearizability(results))
+			}
+			if !tt.linearizable && len(visualizeLinearizability(results)) == 0 {
+				t.Fatal("expected a visualization of the history")
+			}
+		})
+	}
+}
+
+// linClient performs random operations on a test cluster and records them in
+// a LinHistory
+type linClient struct {
+	id      int
+	tc      *testCluster
+	history *LinHistory
+	rng     *rand.Rand
+	writes  int
+}
+
+// put writes a new value to key, returning false if it failed
+func (lc *linClient) put(addr string, key string) bool {
+	lc.writes++
+	op := linOp{Client: lc.id, Key: key, Kind: opWrite, Value: fmt.Sprintf("c%d-%d", lc.id, lc.writes)}
+	op.Call = lc.history.now()
+	status, err := lc.tc.do(http.MethodPut, addr, "/kvs/"+key, Request{StoreValue: StoreValue{Value: op.Value}}, nil)
+	op.Return = lc.history.now()
+	switch {
+	case err == nil && status == http.StatusCreated:
+		op.Created = true
+	case err == nil && status == http.StatusOK:
+	default:
+		op.Pending = true
+	}
+	lc.history.record(op)
+	return !op.Pending
+}
+
+// get reads key, returning false if it failed
+func (lc *linClient) get(addr string, key string) bool {
+	op := linOp{Client: lc.id, Key: key, Kind: opRead}
+	op.Call = lc.history.now()
+	var res GetResponse
+	status, err := lc.tc.do(http.MethodGet, addr, "/kvs/"+key, Request{}, &res)
+	op.Return = lc.history.now()
+	switch {
+	case err == nil && status == http.StatusOK:
+		op.Found = true
+		op.Value = fmt.Sprint(res.Value)
+	case err == nil && status == http.StatusNotFound:
+	default:
+		// A failed read has no effect
+		return false
+	}
+	lc.history.record(op)
+	return true
+}
+
+// raftLeader returns the index of the replica leading the raft group of the
+// cluster, waiting for one to be elected
+func raftLeader(t *testing.T, tc *testCluster) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, r := range tc.nodes {
+			if node := r.getRaft(); node != nil && !tc.isCrashed(i) {
+				if _, state, _ := node.Status(); state == Leader {
+					return i
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no raft leader was elected")
+	return -1
+}
+
+// Test_LinearizableHistory runs clients against the strongly consistent modes
+// through random replicas of a shard, and checks that the recorded history is
+// linearizable. The raft leader, or the tail of the chain, is crashed halfway
+// through.
+func Test_LinearizableHistory(t *testing.T) {
+	modes := []struct {
+		name      string
+		configure func(*ReplicaConfig)
+		keys      []string
+		// crashed returns the replica to crash
+		crashed func(t *testing.T, tc *testCluster) int
+	}{
+		{
+			name:      "raft",
+			configure: func(cfg *ReplicaConfig) { cfg.ConsistencyNamespaces = `{"lin": {"mode": "linearizable"}}` },
+			keys:      []string{"lin:x", "lin:y"},
+			crashed:   raftLeader,
+		},
+		{
+			name:      "chain",
+			configure: func(cfg *ReplicaConfig) { cfg.ChainShards = "s0" },
+			keys:      []string{"x", "y"},
+			crashed: func(t *testing.T, tc *testCluster) int {
+				tail := tc.nodes[0].chainTail()
+				return slices.IndexFunc(tc.nodes, func(r *Replica) bool { return r.addr == tail })
+			},
+		},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			tc := startCluster(t, 3, 1, mode.configure)
+			mode.crashed(t, tc)
+			h := &LinHistory{}
+			keys := mode.keys
+
+			// Clients go on until they made opCount/2 operations once the
+			// crash is over
+			const clientCount, opCount = 3, 30
+			var done sync.WaitGroup
+			var completed atomic.Int64
+			var crashed atomic.Bool
+			for id := 0; id < clientCount; id++ {
+				lc := &linClient{id: id, tc: tc, history: h, rng: rand.New(rand.NewSource(int64(id)))}
+				done.Add(1)
+				go func() {
+					defer done.Done()
+					for after := 0; after < opCount/2; {
+						if crashed.Load() {
+							after++
+						}
+						live := tc.live()
+						addr := live[lc.rng.Intn(len(live))]
+						key := keys[lc.rng.Intn(len(keys))]
+						var ok bool
+						if lc.rng.Intn(2) == 0 {
+							ok = lc.put(addr, key)
+						} else {
+							ok = lc.get(addr, key)
+						}
+						completed.Add(1)
+						// Back off while the shard elects a new leader
+						if !ok {
+							time.Sleep(50 * time.Millisecond)
+						}
+					}
+				}()
+			}
+
+			for completed.Load() < clientCount*opCount/2 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			tc.crash(mode.crashed(t, tc))
+			crashedAt := h.now()
+			crashed.Store(true)
+			done.Wait()
+
+			ops := h.Ops()
+			if !slices.ContainsFunc(ops, func(op linOp) bool { return op.Call > crashedAt && !op.Pending }) {
+				t.Fatal("no operation succeeded after the crash")
+			}
+
+			assertLinearizable(t, ops)
+		})
+	}
+}
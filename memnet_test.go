@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownAddr = errors.New("no replica at address")
+	errConnRefused = errors.New("connection refused")
+)
+
+// memNetwork is a Transport that hands requests straight to the handlers of
+// in-process replicas, without going through sockets. Wrapped in a
+// FaultNetwork, it lets tests fail the requests between replicas while clients
+// still reach every replica over HTTP.
+type memNetwork struct {
+	lock     sync.Mutex
+	handlers map[string]http.Handler
+	down     map[string]bool
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		handlers: make(map[string]http.Handler),
+		down:     make(map[string]bool),
+	}
+}
+
+// serve routes the requests to addr to h
+func (n *memNetwork) serve(addr string, h http.Handler) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.handlers[addr] = h
+}
+
+// stop refuses the requests to addr, as if its replica was killed
+func (n *memNetwork) stop(addr string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.down[addr] = true
+}
+
+func (n *memNetwork) Send(r HttpRequest) (*http.Response, error) {
+	n.lock.Lock()
+	h, ok := n.handlers[r.addr]
+	down := n.down[r.addr]
+	n.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", r.addr, errUnknownAddr)
+	}
+	if down {
+		return nil, fmt.Errorf("%s: %w", r.addr, errConnRefused)
+	}
+
+	body, err := json.Marshal(r.payload)
+	if err != nil {
+		return nil, err
+	}
+	req := httptest.NewRequest(r.method, "http://"+r.addr+r.endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if r.from != "" {
+		req.Header.Set(replicaHeader, r.from)
+	}
+
+	timeout := r.timeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(rec, req)
+	}()
+	select {
+	case <-done:
+		return rec.Result(), nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("%s %s to %s: %w", r.method, r.endpoint, r.addr, ErrTimedOut)
+	}
+}
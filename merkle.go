@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+)
+
+// merkleLeaves is the number of buckets the key space of a shard is split into.
+// It must be a power of two so that every level of the tree halves cleanly.
+const merkleLeaves = 64
+
+// MerkleTree stores the hashes of a replica's kv store. Levels[0] holds the
+// root and the last level holds one hash per bucket of keys.
+type MerkleTree struct {
+	Levels [][]string `json:"levels"`
+}
+
+// merkleBucket maps a key to one of the merkleLeaves buckets.
+func merkleBucket(key string) int {
+	hashedKey := sha1.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(hashedKey[:2])) % merkleLeaves
+}
+
+// bucketKv splits kv into its merkle buckets.
+func bucketKv(kv map[string]any) []map[string]any {
+	buckets := make([]map[string]any, merkleLeaves)
+	for i := range buckets {
+		buckets[i] = make(map[string]any)
+	}
+	for k, v := range kv {
+		buckets[merkleBucket(k)][k] = v
+	}
+	return buckets
+}
+
+// hashBucket hashes the key-value pairs of a bucket in key order. Values are
+// hashed through their JSON encoding, so that two replicas which received the
+// same value over the wire agree on its hash.
+func hashBucket(bucket map[string]any) string {
+	keys := make([]string, 0, len(bucket))
+	for k := range bucket {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	h := sha1.New()
+	for _, k := range keys {
+		value, _ := json.Marshal(bucket[k])
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(value)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BuildMerkleTree builds the merkle tree of kv bottom up.
+func BuildMerkleTree(kv map[string]any) *MerkleTree {
+	var leaves []string
+	for _, bucket := range bucketKv(kv) {
+		leaves = append(leaves, hashBucket(bucket))
+	}
+
+	levels := [][]string{leaves}
+	for level := leaves; len(level) > 1; {
+		var parents []string
+		for i := 0; i < len(level); i += 2 {
+			sum := sha1.Sum([]byte(level[i] + level[i+1]))
+			parents = append(parents, hex.EncodeToString(sum[:]))
+		}
+		levels = append([][]string{parents}, levels...)
+		level = parents
+	}
+
+	return &MerkleTree{Levels: levels}
+}
+
+// Diff returns the buckets whose hashes differ between t and other, descending
+// only into the subtrees whose hashes don't match.
+func (t *MerkleTree) Diff(other *MerkleTree) []int {
+	if !t.sameShape(other) {
+		// Trees of different shapes can't be compared, so every bucket differs
+		all := make([]int, merkleLeaves)
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	candidates := []int{0}
+	for depth := range t.Levels {
+		var next []int
+		for _, i := range candidates {
+			if t.Levels[depth][i] == other.Levels[depth][i] {
+				continue
+			}
+			if depth == len(t.Levels)-1 {
+				next = append(next, i)
+			} else {
+				next = append(next, 2*i, 2*i+1)
+			}
+		}
+		candidates = next
+	}
+	return candidates
+}
+
+func (t *MerkleTree) sameShape(other *MerkleTree) bool {
+	if len(t.Levels) != len(other.Levels) {
+		return false
+	}
+	for depth := range t.Levels {
+		if len(t.Levels[depth]) != len(other.Levels[depth]) {
+			return false
+		}
+	}
+	return true
+}
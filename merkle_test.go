@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKv(keys int) map[string]any {
+	kv := make(map[string]any)
+	for i := 0; i < keys; i++ {
+		kv[fmt.Sprintf("key%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	return kv
+}
+
+func Test_MerkleTreeEqual(t *testing.T) {
+	a := BuildMerkleTree(testKv(200))
+	b := BuildMerkleTree(testKv(200))
+
+	assert.Len(t, a.Levels[0], 1)
+	assert.Len(t, a.Levels[len(a.Levels)-1], merkleLeaves)
+	assert.Empty(t, a.Diff(b))
+}
+
+func Test_MerkleTreeDiff(t *testing.T) {
+	kv := testKv(200)
+	a := BuildMerkleTree(kv)
+
+	kv["key7"] = "changed"
+	delete(kv, "key42")
+	kv["new-key"] = 1
+	b := BuildMerkleTree(kv)
+
+	expected := map[int]bool{
+		merkleBucket("key7"):    true,
+		merkleBucket("key42"):   true,
+		merkleBucket("new-key"): true,
+	}
+	diff := a.Diff(b)
+	assert.Len(t, diff, len(expected))
+	for _, bucket := range diff {
+		assert.True(t, expected[bucket])
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	outboxMinBackoff = 100 * time.Millisecond
+	outboxMaxBackoff = 10 * time.Second
+	// outboxMaxFailures is how many times in a row a request can fail to reach
+	// its target before it is handed to onUnreachable
+	outboxMaxFailures = 5
+	// outboxMaxAge is how long an entry is retried before it is dropped and left
+	// to anti-entropy
+	outboxMaxAge = time.Minute * 15
+	// outboxDrainTimeout is how long a drain waits for the entries before it,
+	// well within the timeout of the bulk request asking for it
+	outboxDrainTimeout = 2 * time.Second
+)
+
+// OutboxEntry is a request waiting to be delivered to a single target
+type OutboxEntry struct {
+	Seq        uint64          `json:"seq"`
+	Method     string          `json:"method"`
+	Endpoint   string          `json:"endpoint"`
+	Payload    json.RawMessage `json:"payload"`
+	Hint       *Hint           `json:"hint,omitempty"`
+	Op         Operation       `json:"op,omitempty"`
+	Attempts   int             `json:"attempts"`
+	EnqueuedAt time.Time       `json:"enqueued-at"`
+}
+
+type OutboxTargetStatus struct {
+	Depth    int       `json:"depth"`
+	Attempts int       `json:"head-attempts"`
+	Oldest   time.Time `json:"oldest"`
+}
+
+type OutboxStatus struct {
+	Depth     int                           `json:"depth"`
+	Delivered int                           `json:"delivered"`
+	Retries   int                           `json:"retries"`
+	Dropped   int                           `json:"dropped"`
+	Targets   map[string]OutboxTargetStatus `json:"targets"`
+}
+
+// Outbox is a persisted set of per-target FIFO queues. Each non-empty queue is
+// drained by its own worker, so a slow or unavailable target only delays the
+// requests addressed to it, and requests to the same target are delivered in
+// the order they were enqueued.
+type Outbox struct {
+	lock    sync.Mutex
+	path    string
+	Queues  map[string][]OutboxEntry `json:"queues"`
+	NextSeq uint64                   `json:"next-seq"`
+	running map[string]bool
+
+	delivered int
+	retries   int
+	dropped   int
+
+	// onUnreachable is called with entries whose target didn't respond
+	onUnreachable func(target string, e OutboxEntry)
+	// diverted reports whether entries handed to onUnreachable are still
+	// waiting to reach target. Later entries are held back until they have,
+	// so that they don't overtake them.
+	diverted  func(target string) bool
+	transport Transport
+	// seed seeds the backoff jitter of the workers. Each worker draws from
+	// its own source, so that its retries don't depend on the others'.
+	seed int64
+	done chan struct{}
+}
+
+func NewOutbox(dataDir string, onUnreachable func(target string, e OutboxEntry)) *Outbox {
+	o := &Outbox{
+		path:          filepath.Join(dataDir, "outbox.json"),
+		Queues:        make(map[string][]OutboxEntry),
+		running:       make(map[string]bool),
+		onUnreachable: onUnreachable,
+		transport:     defaultPool,
+		seed:          time.Now().UnixNano(),
+		done:          make(chan struct{}),
+	}
+	if err := loadJSON(o.path, o); err != nil {
+		zap.L().Error("Couldn't load outbox", zap.String("path", o.path), zap.Error(err))
+	}
+	if o.Queues == nil {
+		o.Queues = make(map[string][]OutboxEntry)
+	}
+	return o
+}
+
+// Start resumes delivery of the entries persisted before a restart
+func (o *Outbox) Start() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for target := range o.Queues {
+		o.startWorker(target)
+	}
+}
+
+// Stop stops the workers. Undelivered entries stay persisted.
+func (o *Outbox) Stop() {
+	close(o.done)
+}
+
+// Enqueue appends a request to the queue of each target
+func (o *Outbox) Enqueue(pr *BufferAtSenderRequest) error {
+	payload, err := json.Marshal(pr.Payload)
+	if err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, target := range pr.Targets {
+		o.NextSeq++
+		o.Queues[target] = append(o.Queues[target], OutboxEntry{
+			Seq:        o.NextSeq,
+			Method:     pr.Method,
+			Endpoint:   pr.Endpoint,
+			Payload:    payload,
+			Hint:       pr.Hint,
+			Op:         pr.Op,
+			EnqueuedAt: time.Now(),
+		})
+	}
+	o.save()
+	for _, target := range pr.Targets {
+		o.startWorker(target)
+	}
+	return nil
+}
+
+// Drain waits until the entries enqueued before the call were delivered or
+// given up on, and reports whether they were within timeout
+func (o *Outbox) Drain(timeout time.Duration) bool {
+	o.lock.Lock()
+	fence := o.NextSeq
+	o.lock.Unlock()
+	deadline := time.Now().Add(timeout)
+	for o.pendingUpTo(fence) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// pendingUpTo reports whether any queue holds an entry numbered up to seq
+func (o *Outbox) pendingUpTo(seq uint64) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, q := range o.Queues {
+		// Entries are numbered in the order they are enqueued
+		if len(q) > 0 && q[0].Seq <= seq {
+			return true
+		}
+	}
+	return false
+}
+
+// HighestClock returns the greatest entry of self in the causal metadata of
+// the queued requests, which counts the writes self coordinated that some
+// targets haven't received yet
+func (o *Outbox) HighestClock(self string) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	highest := 0
+	for _, q := range o.Queues {
+		for _, e := range q {
+			var payload struct {
+				CausalMetadata VectorClock `json:"causal-metadata"`
+			}
+			if err := json.Unmarshal(e.Payload, &payload); err == nil {
+				highest = max(highest, payload.CausalMetadata.Clocks[self])
+			}
+		}
+	}
+	return highest
+}
+
+// Status returns the depth of every queue
+func (o *Outbox) Status() OutboxStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	status := OutboxStatus{
+		Delivered: o.delivered,
+		Retries:   o.retries,
+		Dropped:   o.dropped,
+		Targets:   make(map[string]OutboxTargetStatus),
+	}
+	for target, q := range o.Queues {
+		if len(q) == 0 {
+			continue
+		}
+		status.Depth += len(q)
+		status.Targets[target] = OutboxTargetStatus{
+			Depth:    len(q),
+			Attempts: q[0].Attempts,
+			Oldest:   q[0].EnqueuedAt,
+		}
+	}
+	return status
+}
+
+// startWorker starts draining target's queue unless it is already being
+// drained. The caller must hold o.lock.
+func (o *Outbox) startWorker(target string) {
+	if o.running[target] || len(o.Queues[target]) == 0 {
+		return
+	}
+	o.running[target] = true
+	go o.run(target)
+}
+
+func (o *Outbox) run(target string) {
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	rng := rand.New(rand.NewSource(o.seed ^ int64(h.Sum64())))
+	backoff := outboxMinBackoff
+	failures := 0
+	for {
+		o.lock.Lock()
+		q := o.Queues[target]
+		if len(q) == 0 || o.stopped() {
+			delete(o.running, target)
+			if len(q) == 0 {
+				delete(o.Queues, target)
+			}
+			o.lock.Unlock()
+			return
+		}
+		e := q[0]
+		o.lock.Unlock()
+
+		if time.Since(e.EnqueuedAt) > outboxMaxAge {
+			zap.L().Error("Outbox entry timed out", zap.String("target", target), zap.String("method", e.Method), zap.String("endpoint", e.Endpoint))
+			o.pop(target, &o.dropped)
+			continue
+		}
+
+		if o.diverted != nil && o.diverted(target) {
+			o.wait(rng, &backoff)
+			continue
+		}
+
+		res, err := o.transport.Send(HttpRequest{
+			method:   e.Method,
+			endpoint: e.Endpoint,
+			addr:     target,
+			payload:  e.Payload,
+			op:       e.Op,
+		})
+		if err != nil {
+			zap.L().Warn("Request failed to", zap.String("addr", target), zap.String("method", e.Method), zap.Error(err))
+			if failures++; failures < outboxMaxFailures {
+				o.retry(target)
+				o.wait(rng, &backoff)
+				continue
+			}
+			o.pop(target, &o.dropped)
+			o.onUnreachable(target, e)
+			failures = 0
+			backoff = outboxMinBackoff
+			continue
+		}
+		failures = 0
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		// Retry if status code is 503
+		if res.StatusCode == http.StatusServiceUnavailable {
+			o.retry(target)
+			o.wait(rng, &backoff)
+			continue
+		}
+
+		o.pop(target, &o.delivered)
+		backoff = outboxMinBackoff
+	}
+}
+
+func (o *Outbox) stopped() bool {
+	select {
+	case <-o.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry counts another attempt at the head of target's queue
+func (o *Outbox) retry(target string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.retries++
+	if q := o.Queues[target]; len(q) > 0 {
+		q[0].Attempts++
+	}
+}
+
+// wait sleeps for a jittered backoff, or until the outbox is stopped, and
+// doubles the backoff
+func (o *Outbox) wait(rng *rand.Rand, backoff *time.Duration) {
+	select {
+	case <-o.done:
+	case <-time.After(jitter(rng, *backoff)):
+	}
+	*backoff = min(2**backoff, outboxMaxBackoff)
+}
+
+// pop removes the head of target's queue and increments counter
+func (o *Outbox) pop(target string, counter *int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.Queues[target] = o.Queues[target][1:]
+	*counter++
+	o.save()
+}
+
+// save persists the queues. The caller must hold o.lock.
+func (o *Outbox) save() {
+	if err := saveJSON(o.path, o); err != nil {
+		zap.L().Error("Couldn't persist outbox", zap.String("path", o.path), zap.Error(err))
+	}
+}
+
+// jitter returns a random duration in [d/2, d)
+func jitter(rng *rand.Rand, d time.Duration) time.Duration {
+	return d/2 + time.Duration(rng.Int63n(int64(d/2)))
+}
+
+// handleUnreachable hands replicated writes off to the hint store and deletes
+// any other unreachable target from the view
+func (replica *Replica) handleUnreachable(target string, e OutboxEntry) {
+	if e.Hint != nil {
+		hint := *e.Hint
+		hint.Target = target
+		hint.CreatedAt = time.Now()
+		zap.L().Warn("Handing off request", zap.String("address", target), zap.String("key", hint.Key))
+		replica.hints.Add(hint)
+		return
+	}
+	// Delete the view if it didn't respond
+	zap.L().Warn("Deleting view", zap.String("address", target))
+	replica.removeFromView(target)
+}
+
+func (r *Replica) handleOutboxGet(c echo.Context) error {
+	return c.JSON(http.StatusOK, r.outbox.Status())
+}
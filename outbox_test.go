@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check that requests to a target are delivered in order, retrying on 503s
+func Test_OutboxOrderedRetries(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		tries    int
+		received []int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		tries++
+		if tries <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var n int
+		json.NewDecoder(r.Body).Decode(&n)
+		received = append(received, n)
+	}))
+	defer srv.Close()
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	o := NewOutbox(t.TempDir(), func(string, OutboxEntry) {
+		t.Error("target should be reachable")
+	})
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, o.Enqueue(&BufferAtSenderRequest{
+			Method:   http.MethodPut,
+			Payload:  i,
+			Endpoint: "/",
+			Targets:  []string{target},
+		}))
+	}
+
+	assert.Eventually(t, func() bool {
+		return o.Status().Depth == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []int{1, 2, 3}, received)
+	assert.Equal(t, 3, o.Status().Delivered)
+	assert.Equal(t, 2, o.Status().Retries)
+}
+
+// Check that queued requests survive a restart
+func Test_OutboxPersists(t *testing.T) {
+	dir := t.TempDir()
+	o := NewOutbox(dir, nil)
+	o.lock.Lock()
+	// Pretend a worker is already draining the queue so nothing is sent
+	o.running["unreachable:1"] = true
+	o.lock.Unlock()
+	assert.NoError(t, o.Enqueue(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Payload:  "value",
+		Endpoint: "/kvs/key",
+		Targets:  []string{"unreachable:1"},
+	}))
+
+	status := NewOutbox(dir, nil).Status()
+	assert.Equal(t, 1, status.Depth)
+	assert.Equal(t, 1, status.Targets["unreachable:1"].Depth)
+}
+
+// Check that a restarted replica doesn't give the sequence numbers of the
+// writes still waiting in its outbox or hint store to new writes, although
+// the other replicas haven't counted them
+func Test_RestoreWriteCounter(t *testing.T) {
+	dir := t.TempDir()
+	r := &Replica{
+		addr:   "self:1",
+		vc:     &VectorClock{Clocks: map[string]int{"self:1": 3}},
+		outbox: NewOutbox(dir, nil),
+		hints:  NewHintStore(dir, "", ""),
+		hlc:    NewHLC("self:1"),
+	}
+	r.outbox.running["peer:1"] = true
+	assert.NoError(t, r.outbox.Enqueue(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Payload:  Request{CausalMetadata: VectorClock{Self: "self:1", Clocks: map[string]int{"self:1": 5}}},
+		Endpoint: "/kvs/x",
+		Targets:  []string{"peer:1"},
+	}))
+	r.restoreWriteCounter()
+	assert.Equal(t, 5, r.nextWriteClock(VectorClock{Clocks: make(map[string]int)}).Clocks["self:1"])
+
+	r.hints.Add(Hint{Target: "peer:2", CausalMetadata: VectorClock{Clocks: map[string]int{"self:1": 7}}, CreatedAt: time.Now()})
+	r.restoreWriteCounter()
+	assert.Equal(t, 7, r.nextWriteClock(VectorClock{Clocks: make(map[string]int)}).Clocks["self:1"])
+}
+
+// Check that entries are sent with the timeout of their operation, so a bulk
+// transfer isn't cut off by the replication timeout
+func Test_OutboxBulkTimeout(t *testing.T) {
+	target := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	o := NewOutbox(t.TempDir(), func(string, OutboxEntry) {
+		t.Error("bulk request should not time out")
+	})
+	o.transport = senderTransport{
+		timeouts: Timeouts{Replication: 10 * time.Millisecond},
+		next:     NewClientPool(PoolConfig{}),
+	}
+	assert.NoError(t, o.Enqueue(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/shard/update",
+		Targets:  []string{target},
+		Op:       OpBulk,
+	}))
+
+	assert.Eventually(t, func() bool {
+		return o.Status().Delivered == 1
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// Check that requests are retried before their target is deemed unreachable,
+// and that later requests don't overtake a diverted one
+func Test_OutboxDivertsUnreachable(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		diverted []uint64
+		pending  bool
+	)
+	o := NewOutbox(t.TempDir(), func(target string, e OutboxEntry) {
+		lock.Lock()
+		defer lock.Unlock()
+		diverted = append(diverted, e.Seq)
+		pending = true
+	})
+	o.diverted = func(string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return pending
+	}
+	t.Cleanup(o.Stop)
+	for range 2 {
+		assert.NoError(t, o.Enqueue(&BufferAtSenderRequest{
+			Method:   http.MethodPut,
+			Endpoint: "/kvs/key",
+			Targets:  []string{"127.0.0.1:1"},
+			Hint:     &Hint{Key: "key"},
+		}))
+	}
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(diverted) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, outboxMaxFailures-1, o.Status().Retries)
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, []uint64{1}, diverted)
+	pending = false
+	lock.Unlock()
+	assert.Equal(t, 1, o.Status().Depth)
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(diverted) == 2
+	}, 20*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []uint64{1, 2}, diverted)
+}
+
+// Check that a drain waits until the queued entries are delivered
+func Test_OutboxDrain(t *testing.T) {
+	o := NewOutbox(t.TempDir(), nil)
+	assert.True(t, o.Drain(0))
+
+	o.lock.Lock()
+	// Pretend a worker is already draining the queue so nothing is sent
+	o.running["unreachable:1"] = true
+	o.lock.Unlock()
+	assert.NoError(t, o.Enqueue(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/kvs/key",
+		Targets:  []string{"unreachable:1"},
+	}))
+	assert.False(t, o.Drain(50*time.Millisecond))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		o.pop("unreachable:1", &o.delivered)
+	}()
+	assert.True(t, o.Drain(time.Second))
+}
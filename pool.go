@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Operation is the kind of work a request between replicas does, which
+// decides how long its sender waits for it
+type Operation int
+
+const (
+	// OpReplication covers writes, reads and coordination between replicas
+	OpReplication Operation = iota
+	// OpBulk covers transfers of a replica's whole key space
+	OpBulk
+	// OpHealth covers view changes, which remove the replicas that fail
+	// to answer
+	OpHealth
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OpBulk:
+		return "bulk"
+	case OpHealth:
+		return "health"
+	default:
+		return "replication"
+	}
+}
+
+// Timeouts are the timeouts of the requests of each operation
+type Timeouts struct {
+	Replication time.Duration
+	Bulk        time.Duration
+	Health      time.Duration
+}
+
+const (
+	defaultBulkTimeout         = 5 * time.Second
+	defaultHealthTimeout       = 200 * time.Millisecond
+	defaultMaxIdleConnsPerPeer = 8
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+var defaultTimeouts = Timeouts{
+	Replication: defaultRequestTimeout,
+	Bulk:        defaultBulkTimeout,
+	Health:      defaultHealthTimeout,
+}
+
+// For returns the timeout of op, or its default if unset
+func (t Timeouts) For(op Operation) time.Duration {
+	d, def := t.Replication, defaultTimeouts.Replication
+	switch op {
+	case OpBulk:
+		d, def = t.Bulk, defaultTimeouts.Bulk
+	case OpHealth:
+		d, def = t.Health, defaultTimeouts.Health
+	}
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// PoolConfig holds the settings of a ClientPool. Zero values use the
+// defaults.
+type PoolConfig struct {
+	Timeouts
+	// MaxIdleConnsPerPeer bounds the connections kept open to each peer
+	// between requests
+	MaxIdleConnsPerPeer int
+	IdleConnTimeout     time.Duration
+}
+
+// parsePoolConfig parses the timeouts of each operation as durations and the
+// number of idle connections per peer. Empty settings keep their default.
+func parsePoolConfig(replication, bulk, health, maxIdle string) PoolConfig {
+	parse := func(s string) time.Duration {
+		if s == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			panic(err)
+		}
+		return d
+	}
+	cfg := PoolConfig{
+		Timeouts: Timeouts{
+			Replication: parse(replication),
+			Bulk:        parse(bulk),
+			Health:      parse(health),
+		},
+	}
+	if maxIdle != "" {
+		n, err := strconv.Atoi(maxIdle)
+		if err != nil {
+			panic(err)
+		}
+		cfg.MaxIdleConnsPerPeer = n
+	}
+	return cfg
+}
+
+// PeerMetrics count the requests sent to a peer
+type PeerMetrics struct {
+	Requests int `json:"requests"`
+	// Failures counts the requests that got no response, including those
+	// that timed out
+	Failures    int            `json:"failures"`
+	Timeouts    int            `json:"timeouts"`
+	InFlight    int            `json:"in-flight"`
+	ConnsOpened int            `json:"conns-opened"`
+	Operations  map[string]int `json:"operations"`
+	// AvgLatency is the average time to the response headers of the
+	// requests that got a response
+	AvgLatency string `json:"avg-latency"`
+
+	latency   time.Duration
+	responses int
+}
+
+type PoolMetrics struct {
+	Timeouts map[string]string      `json:"timeouts"`
+	Peers    map[string]PeerMetrics `json:"peers"`
+}
+
+// peerClient holds the connections to a peer
+type peerClient struct {
+	client  *http.Client
+	metrics PeerMetrics
+}
+
+// ClientPool is the Transport that sends requests over HTTP. It keeps a
+// client per peer, whose connections are kept alive between requests.
+type ClientPool struct {
+	cfg PoolConfig
+
+	lock  sync.Mutex
+	peers map[string]*peerClient
+}
+
+func NewClientPool(cfg PoolConfig) *ClientPool {
+	if cfg.MaxIdleConnsPerPeer == 0 {
+		cfg.MaxIdleConnsPerPeer = defaultMaxIdleConnsPerPeer
+	}
+	if cfg.IdleConnTimeout == 0 {
+		cfg.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	return &ClientPool{
+		cfg:   cfg,
+		peers: make(map[string]*peerClient),
+	}
+}
+
+// defaultPool sends the requests of SendRequest
+var defaultPool = NewClientPool(PoolConfig{})
+
+// peer returns the client of addr, creating it on first use. The caller must
+// hold p.lock.
+func (p *ClientPool) peer(addr string) *peerClient {
+	if pc, ok := p.peers[addr]; ok {
+		return pc
+	}
+	pc := &peerClient{metrics: PeerMetrics{Operations: make(map[string]int)}}
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	pc.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err == nil {
+					p.lock.Lock()
+					pc.metrics.ConnsOpened++
+					p.lock.Unlock()
+				}
+				return conn, err
+			},
+			MaxIdleConns:        p.cfg.MaxIdleConnsPerPeer,
+			MaxIdleConnsPerHost: p.cfg.MaxIdleConnsPerPeer,
+			IdleConnTimeout:     p.cfg.IdleConnTimeout,
+		},
+	}
+	p.peers[addr] = pc
+	return pc
+}
+
+func (p *ClientPool) Send(r HttpRequest) (*http.Response, error) {
+	requestURL, err := url.Parse(fmt.Sprintf("http://%s%s", r.addr, r.endpoint))
+	if err != nil {
+		zap.L().Error("Couldn't parse URL", zap.Error(err))
+		return nil, err
+	}
+
+	json, err := json.Marshal(r.payload)
+	if err != nil {
+		zap.L().Error("Couldn't marshal to JSON", zap.Error(err))
+		return nil, err
+	}
+
+	timeout := r.timeout
+	if timeout == 0 {
+		timeout = p.cfg.For(r.op)
+	}
+	// The deadline covers reading the body too, so it's only released
+	// once the body is closed
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequestWithContext(ctx, r.method, requestURL.String(), bytes.NewBuffer(json))
+	if err != nil {
+		cancel()
+		zap.L().Error("Couldn't construct request", zap.Error(err))
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if r.from != "" {
+		req.Header.Set(replicaHeader, r.from)
+	}
+
+	p.lock.Lock()
+	pc := p.peer(r.addr)
+	pc.metrics.Requests++
+	pc.metrics.InFlight++
+	pc.metrics.Operations[r.op.String()]++
+	p.lock.Unlock()
+
+	start := time.Now()
+	res, err := pc.client.Do(req)
+
+	p.lock.Lock()
+	pc.metrics.InFlight--
+	if err != nil {
+		pc.metrics.Failures++
+		if errors.Is(err, context.DeadlineExceeded) {
+			pc.metrics.Timeouts++
+		}
+	} else {
+		pc.metrics.latency += time.Since(start)
+		pc.metrics.responses++
+	}
+	p.lock.Unlock()
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelBody releases the deadline of a request when its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Metrics returns a copy of the metrics of every peer
+func (p *ClientPool) Metrics() PoolMetrics {
+	m := PoolMetrics{
+		Timeouts: make(map[string]string),
+		Peers:    make(map[string]PeerMetrics),
+	}
+	for _, op := range []Operation{OpReplication, OpBulk, OpHealth} {
+		m.Timeouts[op.String()] = p.cfg.For(op).String()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for addr, pc := range p.peers {
+		pm := pc.metrics
+		pm.Operations = make(map[string]int, len(pc.metrics.Operations))
+		for op, n := range pc.metrics.Operations {
+			pm.Operations[op] = n
+		}
+		if pm.responses > 0 {
+			pm.AvgLatency = (pm.latency / time.Duration(pm.responses)).String()
+		}
+		m.Peers[addr] = pm
+	}
+	return m
+}
+
+// CloseIdle closes the connections that aren't carrying a request
+func (p *ClientPool) CloseIdle() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pc := range p.peers {
+		pc.client.CloseIdleConnections()
+	}
+}
+
+// drain reads the rest of the body of res and closes it, so that its
+// connection can be reused
+func drain(res *http.Response) {
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func (r *Replica) handleTransportMetrics(c echo.Context) error {
+	return c.JSON(http.StatusOK, r.pool.Metrics())
+}
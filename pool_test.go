@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClientPool_ReusesConnections(t *testing.T) {
+	addr := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"ok":true}`))
+	})
+	pool := NewClientPool(PoolConfig{})
+
+	for range 5 {
+		res, err := pool.Send(HttpRequest{method: http.MethodPut, endpoint: "/kvs/x", addr: addr, payload: map[string]any{"value": 1}})
+		assert.NoError(t, err)
+		drain(res)
+	}
+
+	m := pool.Metrics().Peers[addr]
+	assert.Equal(t, 5, m.Requests)
+	assert.Equal(t, 1, m.ConnsOpened)
+	assert.Equal(t, 0, m.InFlight)
+	assert.Equal(t, map[string]int{"replication": 5}, m.Operations)
+	assert.NotEmpty(t, m.AvgLatency)
+}
+
+// Check that requests time out according to their operation, unless they set
+// their own timeout
+func Test_ClientPool_TimeoutsByOperation(t *testing.T) {
+	addr := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	pool := NewClientPool(PoolConfig{Timeouts: Timeouts{Replication: 10 * time.Millisecond, Health: 10 * time.Millisecond}})
+
+	_, err := pool.Send(HttpRequest{method: http.MethodGet, endpoint: "/data", addr: addr})
+	assert.Error(t, err)
+	_, err = pool.Send(HttpRequest{method: http.MethodGet, endpoint: "/view", addr: addr, op: OpHealth})
+	assert.Error(t, err)
+	res, err := pool.Send(HttpRequest{method: http.MethodGet, endpoint: "/data", addr: addr, op: OpBulk})
+	assert.NoError(t, err)
+	drain(res)
+	res, err = pool.Send(HttpRequest{method: http.MethodGet, endpoint: "/data", addr: addr, timeout: time.Second})
+	assert.NoError(t, err)
+	drain(res)
+
+	m := pool.Metrics()
+	assert.Equal(t, map[string]string{"replication": "10ms", "bulk": defaultBulkTimeout.String(), "health": "10ms"}, m.Timeouts)
+	assert.Equal(t, 4, m.Peers[addr].Requests)
+	assert.Equal(t, 2, m.Peers[addr].Failures)
+	assert.Equal(t, 2, m.Peers[addr].Timeouts)
+}
+
+// Check that a response's body can still be read after the response arrives,
+// within the timeout of its request
+func Test_ClientPool_ReadsBodyAfterResponse(t *testing.T) {
+	addr := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(" second"))
+	})
+	pool := NewClientPool(PoolConfig{})
+
+	res, err := pool.Send(HttpRequest{method: http.MethodGet, endpoint: "/data", addr: addr, op: OpBulk})
+	assert.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "first second", string(body))
+	assert.NoError(t, res.Body.Close())
+}
+
+func Test_parsePoolConfig(t *testing.T) {
+	cfg := parsePoolConfig("1s", "", "50ms", "2")
+	assert.Equal(t, time.Second, cfg.For(OpReplication))
+	assert.Equal(t, defaultBulkTimeout, cfg.For(OpBulk))
+	assert.Equal(t, 50*time.Millisecond, cfg.For(OpHealth))
+	assert.Equal(t, 2, cfg.MaxIdleConnsPerPeer)
+	assert.Panics(t, func() { parsePoolConfig("soon", "", "", "") })
+}
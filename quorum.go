@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// QuorumInfo reports the quorum achieved by a request in quorum mode
+type QuorumInfo struct {
+	N        int      `json:"n"`
+	R        int      `json:"r,omitempty"`
+	W        int      `json:"w,omitempty"`
+	Acks     int      `json:"acks"`
+	Replicas []string `json:"replicas"`
+}
+
+type QuorumErrResponse struct {
+	ErrResponse
+	Quorum *QuorumInfo `json:"quorum"`
+}
+
+// preferenceList returns the n replicas of the shard that hold the quorum. n
+// was checked against the size of the shard when the request arrived, so the
+// list is shorter if the shard shrank since.
+func (r *Replica) preferenceList(n int) []string {
+	members := r.shardMembers()
+	return members[:min(n, len(members))]
+}
+
+// quorumStatus downgrades a successful status to 202 if the write quorum
+// wasn't reached, meaning the write was accepted but may not be visible to
+// quorum reads until the outbox delivers it
+func quorumStatus(status int, quorum *QuorumInfo) int {
+	if quorum != nil && quorum.Acks < quorum.W {
+		return http.StatusAccepted
+	}
+	return status
+}
+
+// replicateQuorum sends the write in pr to the replicas of the preference list
+// and waits until W of them, including this replica, acknowledged it. Replicas
+// that fail to acknowledge the write, as well as the replicas of the shard
+// outside the preference list, receive it through the outbox.
+func (r *Replica) replicateQuorum(pr *BufferAtSenderRequest, opts ConsistencyOptions) *QuorumInfo {
+	pref := r.preferenceList(opts.N)
+	quorum := &QuorumInfo{N: opts.N, W: opts.W}
+	if slices.Contains(pref, r.addr) {
+		quorum.Acks++
+		quorum.Replicas = append(quorum.Replicas, r.addr)
+	}
+
+	var async []string
+	acks := make(chan string, len(pr.Targets))
+	sent := 0
+	for _, target := range pr.Targets {
+		if !slices.Contains(pref, target) {
+			async = append(async, target)
+			continue
+		}
+		sent++
+		go func(target string) {
+			res, err := r.transport.Send(HttpRequest{
+				method:   pr.Method,
+				endpoint: pr.Endpoint,
+				addr:     target,
+				payload:  pr.Payload,
+			})
+			if err == nil {
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+			}
+			if err != nil || res.StatusCode >= 300 {
+				retry := *pr
+				retry.Targets = []string{target}
+				r.BufferAtSender(&retry)
+				acks <- ""
+				return
+			}
+			acks <- target
+		}(target)
+	}
+
+	if len(async) > 0 {
+		rest := *pr
+		rest.Targets = async
+		r.BufferAtSender(&rest)
+	}
+
+	for i := 0; i < sent && quorum.Acks < quorum.W; i++ {
+		if target := <-acks; target != "" {
+			quorum.Acks++
+			quorum.Replicas = append(quorum.Replicas, target)
+		}
+	}
+	return quorum
+}
+
+// quorumGet reads key from R replicas of the preference list and responds with
+// the most up-to-date value among them, repairing the stale ones
+func (r *Replica) quorumGet(c echo.Context, key string, clientClock VectorClock, opts ConsistencyOptions) error {
+	pref := r.preferenceList(opts.N)
+	peers := pref
+	var states []replicaKeyState
+	if slices.Contains(pref, r.addr) {
+		states = append(states, replicaKeyState{KeyState: r.keyState(key), addr: r.addr})
+		peers = FilterViews(pref, r.addr)
+	}
+	states = append(states, r.getKeyStates(key, peers, opts.R-len(states))...)
+
+	quorum := &QuorumInfo{N: opts.N, R: opts.R, Acks: len(states)}
+	for _, s := range states {
+		quorum.Replicas = append(quorum.Replicas, s.addr)
+	}
+	if quorum.Acks < quorum.R {
+		return c.JSON(http.StatusInternalServerError, QuorumErrResponse{
+			ErrResponse: ErrResponse{Error: "read quorum not reached"},
+			Quorum:      quorum,
+		})
+	}
+
+	best, ok := freshestState(states, restrictVC(clientClock, r.shardMembers()))
+	if !ok {
+		return c.JSON(
+			http.StatusServiceUnavailable,
+			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
+		)
+	}
+	r.pushStale(key, states, best)
+
+	if !best.Exists {
+		return c.JSON(http.StatusNotFound, QuorumErrResponse{
+			ErrResponse: ErrResponse{Error: "Key does not exist"},
+			Quorum:      quorum,
+		})
+	}
+
+	maps.Copy(clientClock.Clocks, best.Vc.Clocks)
+	return c.JSON(http.StatusOK, GetResponse{
+		Response: Response{
+			Result:         "found",
+			CausalMetadata: clientClock,
+			ShardId:        r.getShardId(),
+			Quorum:         quorum,
+		},
+		StoreValue: StoreValue{
+			Value: best.Value,
+		},
+	})
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	raftHeartbeatInterval = 50 * time.Millisecond
+	raftElectionTimeout   = 300 * time.Millisecond
+	raftTickInterval      = 10 * time.Millisecond
+	raftProposalTimeout   = 2 * time.Second
+)
+
+var (
+	ErrNotLeader      = errors.New("not the raft leader")
+	ErrRaftTimeout    = errors.New("timed out waiting for the raft log")
+	ErrLostLeadership = errors.New("lost leadership before the entry was committed")
+)
+
+type RaftState int
+
+const (
+	Follower RaftState = iota
+	Candidate
+	Leader
+)
+
+func (s RaftState) String() string {
+	switch s {
+	case Leader:
+		return "leader"
+	case Candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// RaftCommand is a write to the kv store. An empty Method is a no-op, which a
+// new leader appends to commit the entries of previous terms.
+type RaftCommand struct {
+	Method string `json:"method,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Value  any    `json:"value,omitempty"`
+	// Timestamp is stamped by the leader, so that the write's version has the
+	// same id on every replica
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+}
+
+type LogEntry struct {
+	Term    int         `json:"term"`
+	Command RaftCommand `json:"command"`
+}
+
+type RequestVoteArgs struct {
+	Term         int    `json:"term"`
+	CandidateId  string `json:"candidate-id"`
+	LastLogIndex int    `json:"last-log-index"`
+	LastLogTerm  int    `json:"last-log-term"`
+}
+
+type RequestVoteReply struct {
+	Term        int  `json:"term"`
+	VoteGranted bool `json:"vote-granted"`
+}
+
+type AppendEntriesArgs struct {
+	Term         int        `json:"term"`
+	LeaderId     string     `json:"leader-id"`
+	PrevLogIndex int        `json:"prev-log-index"`
+	PrevLogTerm  int        `json:"prev-log-term"`
+	Entries      []LogEntry `json:"entries"`
+	LeaderCommit int        `json:"leader-commit"`
+}
+
+type AppendEntriesReply struct {
+	Term    int  `json:"term"`
+	Success bool `json:"success"`
+	// ConflictIndex is where the leader should retry from after a failure
+	ConflictIndex int `json:"conflict-index"`
+}
+
+// RaftTransport delivers RPCs to the other members of the group
+type RaftTransport interface {
+	RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+}
+
+// RaftPersistentState is the state a node must persist before responding to
+// RPCs. Log[0] is a sentinel so that log indexes start at 1.
+type RaftPersistentState struct {
+	CurrentTerm int        `json:"current-term"`
+	VotedFor    string     `json:"voted-for"`
+	Log         []LogEntry `json:"log"`
+}
+
+type RaftStorage interface {
+	Save(state RaftPersistentState) error
+	Load() (RaftPersistentState, error)
+}
+
+type fileRaftStorage struct {
+	path string
+}
+
+func raftStoragePath(dataDir string, shardId string) string {
+	return filepath.Join(dataDir, "raft-"+shardId+".json")
+}
+
+func NewFileRaftStorage(dataDir string, shardId string) RaftStorage {
+	return &fileRaftStorage{path: raftStoragePath(dataDir, shardId)}
+}
+
+func (s *fileRaftStorage) Save(state RaftPersistentState) error {
+	return saveJSON(s.path, state)
+}
+
+func (s *fileRaftStorage) Load() (RaftPersistentState, error) {
+	var state RaftPersistentState
+	err := loadJSON(s.path, &state)
+	return state, err
+}
+
+type raftWaiter struct {
+	term   int
+	result chan any
+}
+
+// RaftNode is a member of the raft group of a shard. Committed commands are
+// passed to apply in log order, and the value apply returns is handed back to
+// the proposer.
+type RaftNode struct {
+	mu        sync.Mutex
+	id        string
+	peers     []string
+	transport RaftTransport
+	storage   RaftStorage
+	apply     func(RaftCommand) any
+
+	state       RaftState
+	currentTerm int
+	votedFor    string
+	log         []LogEntry
+	leaderId    string
+
+	commitIndex int
+	lastApplied int
+	nextIndex   map[string]int
+	matchIndex  map[string]int
+
+	lastHeartbeat   time.Time
+	lastBroadcast   time.Time
+	electionTimeout time.Duration
+	waiters         map[int]raftWaiter
+	done            chan struct{}
+}
+
+func NewRaftNode(id string, peers []string, transport RaftTransport, storage RaftStorage, apply func(RaftCommand) any) *RaftNode {
+	rn := &RaftNode{
+		id:        id,
+		peers:     peers,
+		transport: transport,
+		storage:   storage,
+		apply:     apply,
+		waiters:   make(map[int]raftWaiter),
+		done:      make(chan struct{}),
+	}
+	state, err := storage.Load()
+	if err != nil {
+		zap.L().Error("Couldn't load raft state", zap.Error(err))
+	}
+	rn.currentTerm, rn.votedFor, rn.log = state.CurrentTerm, state.VotedFor, state.Log
+	if len(rn.log) == 0 {
+		rn.log = []LogEntry{{}}
+	}
+	rn.resetElectionTimer()
+	return rn
+}
+
+// Start runs the node's election and heartbeat timers until Stop is called
+func (rn *RaftNode) Start() {
+	go func() {
+		ticker := time.NewTicker(raftTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rn.done:
+				return
+			case <-ticker.C:
+				rn.tick()
+			}
+		}
+	}()
+}
+
+func (rn *RaftNode) Stop() {
+	close(rn.done)
+}
+
+// Status returns the node's term, state and the leader it knows about
+func (rn *RaftNode) Status() (term int, state RaftState, leader string) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.currentTerm, rn.state, rn.leaderId
+}
+
+// SetPeers replaces the other members of the group
+func (rn *RaftNode) SetPeers(peers []string) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.peers = peers
+	for _, p := range peers {
+		if _, ok := rn.nextIndex[p]; !ok && rn.state == Leader {
+			rn.nextIndex[p] = len(rn.log)
+			rn.matchIndex[p] = 0
+		}
+	}
+}
+
+func (rn *RaftNode) tick() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	switch {
+	case rn.state == Leader && time.Since(rn.lastBroadcast) >= raftHeartbeatInterval:
+		rn.broadcastAppend()
+	case rn.state != Leader && time.Since(rn.lastHeartbeat) >= rn.electionTimeout:
+		rn.startElection()
+	}
+}
+
+// resetElectionTimer picks a new randomized election timeout. The caller must
+// hold rn.mu.
+func (rn *RaftNode) resetElectionTimer() {
+	rn.lastHeartbeat = time.Now()
+	rn.electionTimeout = raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+}
+
+// persist saves the node's persistent state. The caller must hold rn.mu.
+func (rn *RaftNode) persist() {
+	err := rn.storage.Save(RaftPersistentState{
+		CurrentTerm: rn.currentTerm,
+		VotedFor:    rn.votedFor,
+		Log:         rn.log,
+	})
+	if err != nil {
+		zap.L().Error("Couldn't persist raft state", zap.Error(err))
+	}
+}
+
+func (rn *RaftNode) lastLogIndex() int {
+	return len(rn.log) - 1
+}
+
+func (rn *RaftNode) majority() int {
+	return (len(rn.peers)+1)/2 + 1
+}
+
+// becomeFollower steps down, adopting term if it is newer. The caller must hold
+// rn.mu.
+func (rn *RaftNode) becomeFollower(term int) {
+	if term > rn.currentTerm {
+		rn.currentTerm = term
+		rn.votedFor = ""
+		rn.leaderId = ""
+		rn.persist()
+	}
+	if rn.state != Follower {
+		zap.L().Info("Raft node stepping down", zap.String("id", rn.id), zap.Int("term", rn.currentTerm))
+	}
+	rn.state = Follower
+}
+
+// startElection campaigns for leadership of the next term. The caller must
+// hold rn.mu.
+func (rn *RaftNode) startElection() {
+	rn.state = Candidate
+	rn.currentTerm++
+	rn.votedFor = rn.id
+	rn.leaderId = ""
+	rn.persist()
+	rn.resetElectionTimer()
+
+	term := rn.currentTerm
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateId:  rn.id,
+		LastLogIndex: rn.lastLogIndex(),
+		LastLogTerm:  rn.log[rn.lastLogIndex()].Term,
+	}
+	zap.L().Info("Raft node starting election", zap.String("id", rn.id), zap.Int("term", term))
+
+	votes := 1
+	if votes >= rn.majority() {
+		rn.becomeLeader()
+		return
+	}
+	for _, peer := range rn.peers {
+		go func(peer string) {
+			reply, err := rn.transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+			rn.mu.Lock()
+			defer rn.mu.Unlock()
+			if reply.Term > rn.currentTerm {
+				rn.becomeFollower(reply.Term)
+				return
+			}
+			if rn.state != Candidate || rn.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= rn.majority() {
+				rn.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the group and appends a no-op so that entries from
+// previous terms get committed. The caller must hold rn.mu.
+func (rn *RaftNode) becomeLeader() {
+	zap.L().Info("Raft node became leader", zap.String("id", rn.id), zap.Int("term", rn.currentTerm))
+	rn.state = Leader
+	rn.leaderId = rn.id
+	rn.nextIndex = make(map[string]int)
+	rn.matchIndex = make(map[string]int)
+	for _, peer := range rn.peers {
+		rn.nextIndex[peer] = len(rn.log)
+		rn.matchIndex[peer] = 0
+	}
+	rn.log = append(rn.log, LogEntry{Term: rn.currentTerm})
+	rn.persist()
+	rn.advanceCommit()
+	rn.broadcastAppend()
+}
+
+// broadcastAppend replicates the log to every peer. The caller must hold
+// rn.mu.
+func (rn *RaftNode) broadcastAppend() {
+	rn.lastBroadcast = time.Now()
+	for _, peer := range rn.peers {
+		go rn.replicateTo(peer)
+	}
+}
+
+func (rn *RaftNode) replicateTo(peer string) {
+	rn.mu.Lock()
+	if rn.state != Leader {
+		rn.mu.Unlock()
+		return
+	}
+	next := rn.nextIndex[peer]
+	if next < 1 {
+		next = 1
+	}
+	args := AppendEntriesArgs{
+		Term:         rn.currentTerm,
+		LeaderId:     rn.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  rn.log[next-1].Term,
+		Entries:      append([]LogEntry(nil), rn.log[next:]...),
+		LeaderCommit: rn.commitIndex,
+	}
+	rn.mu.Unlock()
+
+	reply, err := rn.transport.AppendEntries(peer, args)
+	if err != nil {
+		return
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if reply.Term > rn.currentTerm {
+		rn.becomeFollower(reply.Term)
+		return
+	}
+	if rn.state != Leader || rn.currentTerm != args.Term {
+		return
+	}
+	if !reply.Success {
+		rn.nextIndex[peer] = max(1, min(reply.ConflictIndex, rn.nextIndex[peer]-1))
+		return
+	}
+	if match := args.PrevLogIndex + len(args.Entries); match > rn.matchIndex[peer] {
+		rn.matchIndex[peer] = match
+		rn.nextIndex[peer] = match + 1
+		rn.advanceCommit()
+	}
+}
+
+// advanceCommit commits the latest entry of the current term that is stored
+// on a majority. The caller must hold rn.mu.
+func (rn *RaftNode) advanceCommit() {
+	for n := rn.lastLogIndex(); n > rn.commitIndex; n-- {
+		if rn.log[n].Term != rn.currentTerm {
+			break
+		}
+		replicas := 1
+		for _, peer := range rn.peers {
+			if rn.matchIndex[peer] >= n {
+				replicas++
+			}
+		}
+		if replicas >= rn.majority() {
+			rn.commitIndex = n
+			rn.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted applies the committed entries that weren't applied yet and
+// hands their results to the waiting proposers. The caller must hold rn.mu.
+func (rn *RaftNode) applyCommitted() {
+	for rn.lastApplied < rn.commitIndex {
+		rn.lastApplied++
+		entry := rn.log[rn.lastApplied]
+		var result any
+		if entry.Command.Method != "" {
+			result = rn.apply(entry.Command)
+		}
+		if w, ok := rn.waiters[rn.lastApplied]; ok {
+			if w.term != entry.Term {
+				result = ErrLostLeadership
+			}
+			w.result <- result
+			delete(rn.waiters, rn.lastApplied)
+		}
+	}
+}
+
+// Propose appends cmd to the log and waits until it is applied, returning
+// the result of applying it
+func (rn *RaftNode) Propose(cmd RaftCommand) (any, error) {
+	rn.mu.Lock()
+	if rn.state != Leader {
+		rn.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	rn.log = append(rn.log, LogEntry{Term: rn.currentTerm, Command: cmd})
+	rn.persist()
+	index := rn.lastLogIndex()
+	w := raftWaiter{term: rn.currentTerm, result: make(chan any, 1)}
+	rn.waiters[index] = w
+	rn.advanceCommit()
+	rn.broadcastAppend()
+	rn.mu.Unlock()
+
+	select {
+	case result := <-w.result:
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+		return result, nil
+	case <-time.After(raftProposalTimeout):
+		rn.mu.Lock()
+		delete(rn.waiters, index)
+		rn.mu.Unlock()
+		return nil, ErrRaftTimeout
+	}
+}
+
+// ReadIndex returns once the node's state machine reflects every write that
+// was committed before the call, after confirming with a majority that the
+// node is still the leader. Reads served afterwards are linearizable.
+func (rn *RaftNode) ReadIndex() error {
+	deadline := time.Now().Add(raftProposalTimeout)
+
+	// A leader only knows the latest commit index once it committed an entry
+	// of its own term
+	var readIndex, term int
+	for {
+		rn.mu.Lock()
+		if rn.state != Leader {
+			rn.mu.Unlock()
+			return ErrNotLeader
+		}
+		if rn.log[rn.commitIndex].Term == rn.currentTerm {
+			readIndex, term = rn.commitIndex, rn.currentTerm
+			rn.mu.Unlock()
+			break
+		}
+		rn.mu.Unlock()
+		if time.Now().After(deadline) {
+			return ErrRaftTimeout
+		}
+		time.Sleep(raftTickInterval)
+	}
+
+	if !rn.confirmLeadership(term) {
+		return ErrNotLeader
+	}
+
+	for {
+		rn.mu.Lock()
+		applied := rn.lastApplied >= readIndex
+		rn.mu.Unlock()
+		if applied {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrRaftTimeout
+		}
+		time.Sleep(raftTickInterval)
+	}
+}
+
+// confirmLeadership sends a heartbeat to every peer and returns whether a
+// majority still recognizes this node as the leader of term
+func (rn *RaftNode) confirmLeadership(term int) bool {
+	rn.mu.Lock()
+	peers := rn.peers
+	majority := rn.majority()
+	args := make(map[string]AppendEntriesArgs)
+	for _, peer := range peers {
+		prev := min(rn.nextIndex[peer]-1, rn.lastLogIndex())
+		prev = max(prev, 0)
+		args[peer] = AppendEntriesArgs{
+			Term:         term,
+			LeaderId:     rn.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  rn.log[prev].Term,
+			LeaderCommit: rn.commitIndex,
+		}
+	}
+	rn.mu.Unlock()
+
+	acks := make(chan bool, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			reply, err := rn.transport.AppendEntries(peer, args[peer])
+			acks <- err == nil && reply.Term <= term
+		}(peer)
+	}
+
+	confirmed := 1
+	for range peers {
+		if confirmed >= majority {
+			break
+		}
+		if <-acks {
+			confirmed++
+		}
+	}
+	return confirmed >= majority
+}
+
+func (rn *RaftNode) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if args.Term > rn.currentTerm {
+		rn.becomeFollower(args.Term)
+	}
+	reply := RequestVoteReply{Term: rn.currentTerm}
+	if args.Term < rn.currentTerm {
+		return reply
+	}
+
+	lastTerm := rn.log[rn.lastLogIndex()].Term
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= rn.lastLogIndex())
+	if (rn.votedFor == "" || rn.votedFor == args.CandidateId) && upToDate {
+		rn.votedFor = args.CandidateId
+		rn.persist()
+		rn.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+func (rn *RaftNode) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if args.Term < rn.currentTerm {
+		return AppendEntriesReply{Term: rn.currentTerm}
+	}
+	if args.Term > rn.currentTerm || rn.state != Follower {
+		rn.becomeFollower(args.Term)
+	}
+	rn.leaderId = args.LeaderId
+	rn.resetElectionTimer()
+
+	reply := AppendEntriesReply{Term: rn.currentTerm}
+	if args.PrevLogIndex > rn.lastLogIndex() {
+		reply.ConflictIndex = rn.lastLogIndex() + 1
+		return reply
+	}
+	if conflictTerm := rn.log[args.PrevLogIndex].Term; conflictTerm != args.PrevLogTerm {
+		// Skip back over the whole conflicting term
+		i := args.PrevLogIndex
+		for i > 1 && rn.log[i-1].Term == conflictTerm {
+			i--
+		}
+		reply.ConflictIndex = i
+		return reply
+	}
+
+	changed := false
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index <= rn.lastLogIndex() {
+			if rn.log[index].Term == entry.Term {
+				continue
+			}
+			rn.log = rn.log[:index]
+		}
+		rn.log = append(rn.log, args.Entries[i:]...)
+		changed = true
+		break
+	}
+	if changed {
+		rn.persist()
+	}
+
+	if commit := min(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)); commit > rn.commitIndex {
+		rn.commitIndex = commit
+		rn.applyCommitted()
+	}
+	reply.Success = true
+	return reply
+}
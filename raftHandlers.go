@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// raftLeaderHeader is set on responses to linearizable requests so that
+// replicas forwarding requests to a shard learn who its leader is
+const raftLeaderHeader = "X-Raft-Leader"
+
+type RaftStatusResponse struct {
+	ShardId string `json:"shard-id"`
+	Term    int    `json:"term"`
+	State   string `json:"state"`
+	Leader  string `json:"leader"`
+}
+
+// httpRaftTransport sends raft RPCs to the /raft endpoints of the peers
+type httpRaftTransport struct {
+	transport Transport
+}
+
+func (t httpRaftTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := postJSON(t.transport, peer, "/raft/request-vote", args, &reply)
+	return reply, err
+}
+
+func (t httpRaftTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := postJSON(t.transport, peer, "/raft/append-entries", args, &reply)
+	return reply, err
+}
+
+// postJSON sends payload to endpoint at addr through t and decodes the JSON
+// response into v
+func postJSON(t Transport, addr string, endpoint string, payload any, v any) error {
+	res, err := t.Send(HttpRequest{
+		method:   http.MethodPost,
+		endpoint: endpoint,
+		addr:     addr,
+		payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s to %s returned %d", endpoint, addr, res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (r *Replica) getRaft() *RaftNode {
+	r.raftLock.Lock()
+	defer r.raftLock.Unlock()
+	return r.raft
+}
+
+// startRaft joins the raft group of the replica's shard, or updates the
+// members of the group if the replica already runs it
+func (r *Replica) startRaft() {
+	shardId, shards := r.shardState()
+	if !r.raftEnabled || shardId == "" {
+		return
+	}
+	r.raftLock.Lock()
+	defer r.raftLock.Unlock()
+
+	peers := FilterViews(shards[shardId], r.addr)
+	if r.raft != nil {
+		r.raft.SetPeers(peers)
+		return
+	}
+	zap.L().Info("Starting raft", zap.String("shard-id", shardId), zap.Strings("peers", peers))
+	r.raft = NewRaftNode(r.addr, peers, httpRaftTransport{transport: r.transport}, NewFileRaftStorage(r.dataDir, shardId), r.applyRaftCommand)
+	r.raft.Start()
+}
+
+// resetRaft leaves the replica's raft group and discards its log. The log of a
+// shard is meaningless once its keys were redistributed by a reshard.
+func (r *Replica) resetRaft() {
+	r.raftLock.Lock()
+	defer r.raftLock.Unlock()
+	if r.raft == nil {
+		return
+	}
+	r.raft.Stop()
+	r.raft = nil
+	for shardId := range r.getShards() {
+		os.Remove(raftStoragePath(r.dataDir, shardId))
+	}
+	clear(r.raftLeaders)
+}
+
+// leaderFirst moves the last known raft leader of shardId to the front of nodes
+func (r *Replica) leaderFirst(shardId string, nodes []string) []string {
+	r.raftLock.Lock()
+	leader := r.raftLeaders[shardId]
+	r.raftLock.Unlock()
+	if !slices.Contains(nodes, leader) {
+		return nodes
+	}
+	return append([]string{leader}, FilterViews(nodes, leader)...)
+}
+
+// rememberLeader records the raft leader of shardId reported by res
+func (r *Replica) rememberLeader(shardId string, res *http.Response) {
+	leader := res.Header.Get(raftLeaderHeader)
+	if leader == "" {
+		return
+	}
+	r.raftLock.Lock()
+	defer r.raftLock.Unlock()
+	r.raftLeaders[shardId] = leader
+}
+
+// applyRaftCommand applies a committed command to the kv store and returns the
+// result reported to the client
+func (r *Replica) applyRaftCommand(cmd RaftCommand) any {
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+	_, ok := r.kv[cmd.Key]
+	switch cmd.Method {
+	case http.MethodPut:
+		r.setKey(cmd.Key, cmd.Value, VectorClock{Timestamp: cmd.Timestamp})
+		if ok {
+			return "replaced"
+		}
+		return "created"
+	case http.MethodDelete:
+		if !ok {
+			return "not found"
+		}
+		r.deleteKey(cmd.Key, VectorClock{Timestamp: cmd.Timestamp})
+		return "deleted"
+	}
+	return nil
+}
+
+// handleLinearizable serves a request to /kvs/:key through the raft group of
+// the shard. Requests that reach a follower are proxied to the leader.
+func (r *Replica) handleLinearizable(c echo.Context, key string, request *Request) error {
+	node := r.getRaft()
+	if node == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Raft group not started"})
+	}
+	_, state, leader := node.Status()
+	if state != Leader {
+		return r.proxyToLeader(c, key, request, leader)
+	}
+	c.Response().Header().Set(raftLeaderHeader, r.addr)
+
+	switch c.Request().Method {
+	case http.MethodGet:
+		err := node.ReadIndex()
+		if errors.Is(err, ErrNotLeader) {
+			_, _, leader := node.Status()
+			return r.proxyToLeader(c, key, request, leader)
+		}
+		if err != nil {
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: err.Error()})
+		}
+		r.kvLock.RLock()
+		val, ok := r.kv[key]
+		r.kvLock.RUnlock()
+		if !ok {
+			return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
+		}
+		return c.JSON(http.StatusOK, GetResponse{
+			Response:   Response{Result: "found", ShardId: r.getShardId()},
+			StoreValue: StoreValue{Value: val},
+		})
+	}
+
+	ts := r.hlc.Now()
+	result, err := node.Propose(RaftCommand{
+		Method:    c.Request().Method,
+		Key:       key,
+		Value:     request.Value,
+		Timestamp: &ts,
+	})
+	if errors.Is(err, ErrNotLeader) {
+		_, _, leader := node.Status()
+		return r.proxyToLeader(c, key, request, leader)
+	}
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: err.Error()})
+	}
+
+	switch result {
+	case "created":
+		return c.JSON(http.StatusCreated, Response{Result: "created", ShardId: r.getShardId()})
+	case "not found":
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
+	}
+	return c.JSON(http.StatusOK, Response{Result: result.(string), ShardId: r.getShardId()})
+}
+
+// proxyToLeader forwards a linearizable request to the raft leader
+func (r *Replica) proxyToLeader(c echo.Context, key string, request *Request, leader string) error {
+	if leader == "" || leader == r.addr {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "No raft leader; try again later"})
+	}
+	return r.proxyKvRequest(c, key, request, leader)
+}
+
+func (r *Replica) handleRequestVote(c echo.Context) error {
+	node := r.getRaft()
+	if node == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Raft group not started"})
+	}
+	args := new(RequestVoteArgs)
+	if err := c.Bind(args); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	return c.JSON(http.StatusOK, node.HandleRequestVote(*args))
+}
+
+func (r *Replica) handleAppendEntries(c echo.Context) error {
+	node := r.getRaft()
+	if node == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Raft group not started"})
+	}
+	args := new(AppendEntriesArgs)
+	if err := c.Bind(args); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	return c.JSON(http.StatusOK, node.HandleAppendEntries(*args))
+}
+
+func (r *Replica) handleRaftStatus(c echo.Context) error {
+	node := r.getRaft()
+	if node == nil {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Raft group not started"})
+	}
+	term, state, leader := node.Status()
+	return c.JSON(http.StatusOK, RaftStatusResponse{
+		ShardId: r.getShardId(),
+		Term:    term,
+		State:   state.String(),
+		Leader:  leader,
+	})
+}
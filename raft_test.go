@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memRaftTransport delivers raft RPCs between nodes in the same process.
+// Disconnected nodes neither send nor receive RPCs.
+type memRaftTransport struct {
+	lock         sync.Mutex
+	nodes        map[string]*RaftNode
+	disconnected map[string]bool
+}
+
+var errDisconnected = errors.New("disconnected")
+
+func (t *memRaftTransport) node(from string, to string) (*RaftNode, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.disconnected[from] || t.disconnected[to] {
+		return nil, errDisconnected
+	}
+	return t.nodes[to], nil
+}
+
+func (t *memRaftTransport) from(id string) RaftTransport {
+	return &memRaftEndpoint{t: t, id: id}
+}
+
+func (t *memRaftTransport) setConnected(id string, connected bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.disconnected[id] = !connected
+}
+
+type memRaftEndpoint struct {
+	t  *memRaftTransport
+	id string
+}
+
+func (e *memRaftEndpoint) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	node, err := e.t.node(e.id, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (e *memRaftEndpoint) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	node, err := e.t.node(e.id, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+type memRaftStorage struct {
+	lock  sync.Mutex
+	state RaftPersistentState
+}
+
+func (s *memRaftStorage) Save(state RaftPersistentState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = RaftPersistentState{
+		CurrentTerm: state.CurrentTerm,
+		VotedFor:    state.VotedFor,
+		Log:         append([]LogEntry(nil), state.Log...),
+	}
+	return nil
+}
+
+func (s *memRaftStorage) Load() (RaftPersistentState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state, nil
+}
+
+type raftTestGroup struct {
+	transport *memRaftTransport
+	ids       []string
+	storages  map[string]RaftStorage
+	applied   map[string]map[string]any
+	lock      sync.Mutex
+}
+
+func newRaftTestGroup(t *testing.T, size int, storage func(id string) RaftStorage) *raftTestGroup {
+	g := &raftTestGroup{
+		transport: &memRaftTransport{nodes: make(map[string]*RaftNode), disconnected: make(map[string]bool)},
+		storages:  make(map[string]RaftStorage),
+		applied:   make(map[string]map[string]any),
+	}
+	for i := 0; i < size; i++ {
+		g.ids = append(g.ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range g.ids {
+		g.storages[id] = storage(id)
+		g.start(id)
+	}
+	t.Cleanup(func() {
+		for _, node := range g.transport.nodes {
+			node.Stop()
+		}
+	})
+	return g
+}
+
+// start creates the node from its storage, replaying its log into a fresh kv
+func (g *raftTestGroup) start(id string) {
+	g.lock.Lock()
+	g.applied[id] = make(map[string]any)
+	g.lock.Unlock()
+
+	node := NewRaftNode(id, FilterViews(g.ids, id), g.transport.from(id), g.storages[id], func(cmd RaftCommand) any {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.applied[id][cmd.Key] = cmd.Value
+		return "ok"
+	})
+	g.transport.lock.Lock()
+	g.transport.nodes[id] = node
+	g.transport.lock.Unlock()
+	node.Start()
+}
+
+func (g *raftTestGroup) value(id string, key string) any {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.applied[id][key]
+}
+
+// leader waits until exactly one connected node is the leader of the latest term
+func (g *raftTestGroup) leader(t *testing.T) *RaftNode {
+	var leader *RaftNode
+	require.Eventually(t, func() bool {
+		leader = nil
+		leaders := 0
+		for _, id := range g.ids {
+			g.transport.lock.Lock()
+			node, disconnected := g.transport.nodes[id], g.transport.disconnected[id]
+			g.transport.lock.Unlock()
+			if _, state, _ := node.Status(); state == Leader && !disconnected {
+				leader = node
+				leaders++
+			}
+		}
+		return leaders == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	return leader
+}
+
+func memStorage(string) RaftStorage {
+	return &memRaftStorage{}
+}
+
+func Test_RaftElectsLeader(t *testing.T) {
+	g := newRaftTestGroup(t, 3, memStorage)
+	leader := g.leader(t)
+	term, _, _ := leader.Status()
+
+	// Followers learn who the leader is
+	for _, id := range g.ids {
+		assert.Eventually(t, func() bool {
+			_, _, known := g.transport.nodes[id].Status()
+			return known == leader.id
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// A new leader is elected in a later term when the leader is cut off
+	g.transport.setConnected(leader.id, false)
+	newLeader := g.leader(t)
+	newTerm, _, _ := newLeader.Status()
+	assert.NotEqual(t, leader.id, newLeader.id)
+	assert.Greater(t, newTerm, term)
+}
+
+func Test_RaftReplicatesCommands(t *testing.T) {
+	g := newRaftTestGroup(t, 3, memStorage)
+	leader := g.leader(t)
+
+	result, err := leader.Propose(RaftCommand{Method: "PUT", Key: "k", Value: "v1"})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", result)
+	for _, id := range g.ids {
+		assert.Eventually(t, func() bool { return g.value(id, "k") == "v1" }, time.Second, 10*time.Millisecond)
+	}
+	assert.NoError(t, leader.ReadIndex())
+
+	// Followers can't propose
+	for _, id := range g.ids {
+		if id != leader.id {
+			_, err := g.transport.nodes[id].Propose(RaftCommand{Method: "PUT", Key: "k", Value: "v2"})
+			assert.ErrorIs(t, err, ErrNotLeader)
+		}
+	}
+}
+
+func Test_RaftMinorityCantCommit(t *testing.T) {
+	g := newRaftTestGroup(t, 3, memStorage)
+	leader := g.leader(t)
+	for _, id := range g.ids {
+		if id != leader.id {
+			g.transport.setConnected(id, false)
+		}
+	}
+
+	_, err := leader.Propose(RaftCommand{Method: "PUT", Key: "k", Value: "lost"})
+	assert.Error(t, err)
+	assert.Error(t, leader.ReadIndex())
+}
+
+func Test_RaftLogPersists(t *testing.T) {
+	dir := t.TempDir()
+	g := newRaftTestGroup(t, 3, func(id string) RaftStorage {
+		return NewFileRaftStorage(dir, id)
+	})
+	leader := g.leader(t)
+	for i := 0; i < 5; i++ {
+		_, err := leader.Propose(RaftCommand{Method: "PUT", Key: fmt.Sprintf("k%d", i), Value: i})
+		require.NoError(t, err)
+	}
+
+	// Restart a follower from its persisted log
+	var follower string
+	for _, id := range g.ids {
+		if id != leader.id {
+			follower = id
+			break
+		}
+	}
+	// A majority may have committed the commands before the follower got them
+	require.Eventually(t, func() bool {
+		state, err := g.storages[follower].Load()
+		return err == nil && len(state.Log) >= 7
+	}, 2*time.Second, 10*time.Millisecond)
+	g.transport.nodes[follower].Stop()
+	g.start(follower)
+
+	// The restarted follower re-applies its log once the leader tells it what is committed
+	assert.Eventually(t, func() bool { return g.value(follower, "k4") == float64(4) || g.value(follower, "k4") == 4 }, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// KeyState is the value of a single key at a replica along with the key's
+// version vector and the replica's vector clock when it was read
+type KeyState struct {
+	Value  any         `json:"value"`
+	Exists bool        `json:"exists"`
+	Dvv    *KeyDVV     `json:"dvv,omitempty"`
+	Vc     VectorClock `json:"Vc"`
+}
+
+type replicaKeyState struct {
+	KeyState
+	addr string
+}
+
+// isReadRepair returns whether a GET should be served with read repair, either
+// because it is enabled for the replica or requested with ?read-repair=true
+func (r *Replica) isReadRepair(c echo.Context) bool {
+	if c.Request().Method != http.MethodGet || isHistoricalRead(c) {
+		return false
+	}
+	switch c.QueryParam("read-repair") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return r.readRepair
+}
+
+// getKeyStates fetches the state of key from every node concurrently and
+// returns the states of the first `want` nodes that responded
+func (r *Replica) getKeyStates(key string, nodes []string, want int) []replicaKeyState {
+	results := make(chan *replicaKeyState, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			var state KeyState
+			if err := getJSON(r.transport, OpReplication, node, "/key-state/"+key, &state); err != nil {
+				zap.L().Warn("Couldn't read key state", zap.String("node", node), zap.Error(err))
+				results <- nil
+				return
+			}
+			results <- &replicaKeyState{KeyState: state, addr: node}
+		}(node)
+	}
+
+	var states []replicaKeyState
+	for range nodes {
+		if len(states) >= want {
+			break
+		}
+		if s := <-results; s != nil {
+			states = append(states, *s)
+		}
+	}
+	return states
+}
+
+// freshestState merges the states that satisfy the dependencies of
+// clientClock: the version vectors of the key are merged, so the merged state
+// holds the winning sibling among every write the states have seen, and their
+// clocks are merged too. Keys that aren't versioned anywhere, such as the
+// keys redistributed by a reshard and never written since, take the value of
+// the first state.
+func freshestState(states []replicaKeyState, clientClock VectorClock) (KeyState, bool) {
+	var (
+		lock  sync.Mutex
+		found bool
+	)
+	merged := KeyState{Dvv: &KeyDVV{VV: make(map[string]int)}, Vc: VectorClock{Clocks: make(map[string]int)}}
+	for _, s := range states {
+		if !s.Vc.IsReadyFor(clientClock, true, &lock) {
+			continue
+		}
+		if !found {
+			merged.Value, merged.Exists = s.Value, s.Exists
+			found = true
+		}
+		if s.Dvv != nil {
+			merged.Dvv.merge(s.Dvv)
+		}
+		for replica, entry := range s.Vc.Clocks {
+			merged.Vc.Clocks[replica] = max(merged.Vc.Clocks[replica], entry)
+		}
+	}
+	if len(merged.Dvv.VV) > 0 {
+		merged.Exists = len(merged.Dvv.Siblings) > 0
+		merged.Value = nil
+		if merged.Exists {
+			merged.Value = merged.Dvv.winner().Value
+		}
+	}
+	return merged, found
+}
+
+// readWithRepair reads key from every node of the owning shard, responds with
+// the most up-to-date value and pushes it to the replicas that are behind.
+func (r *Replica) readWithRepair(c echo.Context, key string, nodes []string, clientClock VectorClock) error {
+	states := r.getKeyStates(key, nodes, len(nodes))
+	if len(states) == 0 {
+		return c.JSON(http.StatusInternalServerError, ErrResponse{Error: "couldn't forward request"})
+	}
+
+	best, ok := freshestState(states, restrictVC(clientClock, nodes))
+	if !ok {
+		return c.JSON(
+			http.StatusServiceUnavailable,
+			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
+		)
+	}
+
+	r.pushStale(key, states, best)
+
+	if !best.Exists {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key does not exist"})
+	}
+
+	maps.Copy(clientClock.Clocks, best.Vc.Clocks)
+	return c.JSON(http.StatusOK, GetResponse{
+		Response: Response{
+			Result:         "found",
+			CausalMetadata: clientClock,
+			ShardId:        findShard(key, r.getShards()),
+		},
+		StoreValue: StoreValue{
+			Value: best.Value,
+		},
+	})
+}
+
+// pushStale asynchronously pushes best to the replicas whose version vectors
+// of key miss some of its writes
+func (r *Replica) pushStale(key string, states []replicaKeyState, best KeyState) {
+	for _, s := range states {
+		if stale := s.Dvv == nil && len(best.Dvv.VV) > 0 || s.Dvv != nil && s.Dvv.clone().merge(best.Dvv); stale {
+			go r.pushKeyState(s.addr, key, best)
+		}
+	}
+}
+
+func (r *Replica) pushKeyState(addr string, key string, state KeyState) {
+	res, err := r.transport.Send(HttpRequest{
+		method:   http.MethodPut,
+		endpoint: "/key-state/" + key,
+		addr:     addr,
+		payload:  state,
+	})
+	if err != nil {
+		zap.L().Warn("Read repair failed", zap.String("addr", addr), zap.String("key", key), zap.Error(err))
+		return
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+// keyState returns the local state of key
+func (r *Replica) keyState(key string) KeyState {
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	r.vcLock.Lock()
+	defer r.vcLock.Unlock()
+
+	val, ok := r.kv[key]
+	state := KeyState{Value: val, Exists: ok, Vc: CloneVC(*r.vc)}
+	if d, ok := r.dvvs[key]; ok {
+		state.Dvv = d.clone()
+	}
+	return state
+}
+
+func (r *Replica) handleKeyStateGet(c echo.Context) error {
+	return c.JSON(http.StatusOK, r.keyState(c.Param("key")))
+}
+
+// handleKeyStatePut applies a read repair by merging the version vector of the
+// key it carries into ours, which only takes the writes we are missing. The
+// replica's clock is left untouched because only a single key is repaired;
+// the missed writes themselves still arrive through broadcasts or
+// anti-entropy.
+func (r *Replica) handleKeyStatePut(c echo.Context) error {
+	key := c.Param("key")
+
+	state := new(KeyState)
+	if err := c.Bind(state); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+
+	if state.Dvv == nil || r.isStronglyConsistent(key) {
+		return c.JSON(http.StatusOK, ActionResponse{Result: "up to date"})
+	}
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+	if !r.mergeDVV(key, state.Dvv) {
+		return c.JSON(http.StatusOK, ActionResponse{Result: "up to date"})
+	}
+	zap.L().Info("Read repaired key", zap.String("key", key), zap.Any("value", state.Value), zap.Bool("exists", state.Exists))
+	return c.JSON(http.StatusOK, ActionResponse{Result: "repaired"})
+}
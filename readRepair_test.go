@@ -0,0 +1,75 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check that the freshest state of a key is decided by the key's version
+// vectors, not by the clocks of the replicas, which count the writes to every
+// other key too
+func Test_FreshestStateByKey(t *testing.T) {
+	ts := func(sec int64) *Timestamp { return &Timestamp{Wall: time.Unix(sec, 0)} }
+	old := &KeyDVV{VV: make(map[string]int)}
+	old.update(nil, Dot{Id: "a", Counter: 1}, "x", false, ts(1))
+	fresh := old.clone()
+	fresh.update(map[string]int{"a": 1}, Dot{Id: "b", Counter: 1}, "y", false, ts(2))
+
+	states := []replicaKeyState{
+		// a applied many writes to other keys, but missed the write of y
+		{addr: "a", KeyState: KeyState{Value: "x", Exists: true, Dvv: old, Vc: VectorClock{Clocks: map[string]int{"a": 10, "b": 0}}}},
+		{addr: "b", KeyState: KeyState{Value: "y", Exists: true, Dvv: fresh, Vc: VectorClock{Clocks: map[string]int{"a": 1, "b": 1}}}},
+	}
+	best, ok := freshestState(states, VectorClock{Clocks: make(map[string]int)})
+	assert.True(t, ok)
+	assert.True(t, best.Exists)
+	assert.Equal(t, "y", best.Value)
+	assert.Equal(t, map[string]int{"a": 10, "b": 1}, best.Vc.Clocks)
+
+	// Only a is stale
+	assert.True(t, states[0].Dvv.clone().merge(best.Dvv))
+	assert.False(t, states[1].Dvv.clone().merge(best.Dvv))
+
+	// A deletion a hasn't seen wins too
+	deleted := fresh.clone()
+	deleted.update(maps.Clone(fresh.VV), Dot{Id: "b", Counter: 2}, nil, true, ts(3))
+	states[1].Dvv, states[1].Exists, states[1].Value = deleted, false, nil
+	best, ok = freshestState(states, VectorClock{Clocks: make(map[string]int)})
+	assert.True(t, ok)
+	assert.False(t, best.Exists)
+}
+
+// Check that a read with read repair returns the freshest value of the key
+// and pushes it to the replicas of the owning shard that missed it
+func Test_ReadRepairUpdatesStaleReplica(t *testing.T) {
+	tc := startCluster(t, 4, 2, func(cfg *ReplicaConfig) { cfg.AntiEntropyInterval = "1h" })
+	addrs := tc.addrs()
+	owners := tc.owners("x")
+	fresh, stale := owners[0], owners[1]
+	reader := slices.IndexFunc(tc.nodes, func(r *Replica) bool { return !slices.Contains(tc.nodes[fresh].shardMembers(), r.addr) })
+
+	// The stale replica misses the write until the link is restored
+	tc.faults.SetLink(addrs[fresh], addrs[stale], LinkFaults{Drop: true})
+	cl := tc.client()
+	status, err := cl.Put(addrs[fresh], "x", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotContains(t, tc.kv(stale), "x")
+
+	var res GetResponse
+	status, err = tc.do(http.MethodGet, addrs[reader], "/kvs/x?read-repair=true", Request{CausalMetadata: cl.clock}, &res)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1", res.Value)
+	tc.eventually(func() bool { return tc.kv(stale)["x"] == "1" }, "replica %d wasn't repaired", stale)
+	// The write itself still arrives once the link is restored
+	assert.Zero(t, tc.clock(stale).Clocks[addrs[fresh]])
+	tc.faults.SetLink(addrs[fresh], addrs[stale], LinkFaults{})
+	tc.eventually(func() bool { return tc.clock(stale).Clocks[addrs[fresh]] == 1 }, "replica %d didn't apply the write", stale)
+	assert.Equal(t, "1", tc.kv(stale)["x"])
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -23,26 +26,106 @@ type ViewInfo struct {
 }
 
 type Replica struct {
-	vcLock     sync.Mutex
-	kv         map[string]any
-	vc         *VectorClock
-	addr       string
+	vcLock sync.Mutex
+	kvLock sync.RWMutex
+	// coordLock serializes the writes coordinated by the replica
+	coordLock sync.Mutex
+	kv        map[string]any
+	// versions holds the recent history of each key, deleted keys included
+	versions      map[string][]Version
+	versionPolicy VersionPolicy
+	// dvvs tracks the concurrent writes to each key
+	dvvs     map[string]*KeyDVV
+	keyLocks [merkleLeaves]sync.Mutex
+	// crdts holds the keys written through /kvs/:key/crdt
+	crdts map[string]*CRDT
+	vc    *VectorClock
+	addr  string
+	// shardLock guards the view and the shard mapping. Both are replaced
+	// rather than modified in place, so the slices and maps read under the
+	// lock stay valid after it is released.
+	shardLock  sync.RWMutex
 	shards     map[string][]string
 	shardId    string
 	shardCount int
 	*ViewInfo
+	// dataDir holds the state the replica persists
+	dataDir string
+
+	// readRepair makes remote reads consult every replica of the owning shard
+	readRepair bool
+	namespaces map[string]ConsistencyOptions
+
+	raftEnabled bool
+	raftLock    sync.Mutex
+	raft        *RaftNode
+	// raftLeaders caches the last known raft leader of each shard
+	raftLeaders map[string]string
+	hints       *HintStore
+	// waits parks the requests whose causal dependencies aren't applied yet
+	waits *CausalWaitQueue
+	// hlc stamps the writes coordinated by the replica
+	hlc *HLC
+	// sessions holds the causal context of the client sessions served by the
+	// replica
+	sessions *SessionStore
+
+	txns *TxnLog
+
+	// chainShards are the shards that use chain replication
+	chainShards map[string]bool
+	chainLock   sync.Mutex
+	// chainSeq is the sequence number of the last chain write applied
+	chainSeq uint64
+	// chainLast is the last chain write applied, which is sent again to a
+	// successor that missed it
+	chainLast ChainWrite
+	// chainPending is a write the head sent down the chain without hearing
+	// back from the tail. It may still reach the tail, so the head settles it
+	// before any other write.
+	chainPending *ChainWrite
+
+	outbox *Outbox
+	// transport carries the requests the replica sends to other replicas
+	transport Transport
+	// pool holds the connections to other replicas, unless the replica was
+	// configured with its own transport
+	pool *ClientPool
+	// timeouts are the timeouts of the requests to other replicas
+	timeouts Timeouts
+	// chaos injects faults into the traffic of the replica, if enabled
+	chaos *Chaos
+
+	antiEntropyInterval time.Duration
+	aeLock              sync.Mutex
+	aeMetrics           AntiEntropyMetrics
+	// aeRand picks the peers of anti-entropy rounds
+	aeRand *rand.Rand
+
+	// done is closed when the replica stops
+	done chan struct{}
 }
 
 type DataTransfer struct {
-	Kv map[string]any `json:"Kv"`
-	Vc VectorClock    `json:"Vc"`
+	Kv       map[string]any   `json:"Kv"`
+	Vc       VectorClock      `json:"Vc"`
+	ChainSeq uint64           `json:"ChainSeq,omitempty"`
+	Crdts    map[string]*CRDT `json:"Crdts,omitempty"`
+	// Dvvs are the version vectors of the keys, including the deleted ones
+	Dvvs map[string]*KeyDVV `json:"Dvvs,omitempty"`
 }
 
-func getKvData(addr string) (DataTransfer, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/data", addr))
+func (r *Replica) getKvData(addr string) (DataTransfer, error) {
+	resp, err := r.transport.Send(HttpRequest{
+		method:   http.MethodGet,
+		endpoint: "/data",
+		addr:     addr,
+		op:       OpBulk,
+	})
 	if err != nil {
 		return DataTransfer{}, err
 	}
+	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -61,20 +144,17 @@ func getKvData(addr string) (DataTransfer, error) {
 // most updated state.
 func (r *Replica) initKV(shardId string) {
 	// Get all the shards from the first responsive node
-	r.shardId = shardId
-	res, err := BroadcastFirst(&BroadcastFirstRequest{
-		BroadcastRequest: BroadcastRequest{
-			Method:   http.MethodGet,
-			Targets:  r.GetOtherViews(),
-			Endpoint: "/shard/ids",
-		},
-		srcAddr: r.addr,
+	res, err := r.BroadcastFirst(&BroadcastRequest{
+		Method:   http.MethodGet,
+		Targets:  r.GetOtherViews(),
+		Endpoint: "/shard/ids",
 	})
 	if err != nil {
 		zap.L().Fatal("unable to get shardIds")
 	}
 	var shards ShardIdsResponse
 	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
 	if err != nil {
 		zap.L().Fatal("unable to read response body")
 	}
@@ -82,18 +162,21 @@ func (r *Replica) initKV(shardId string) {
 	if err != nil {
 		zap.L().Fatal("unable to unmarshal response body")
 	}
-	r.shards, err = initShards(len(shards.ShardIds), r.View)
+	mapping, err := initShards(len(shards.ShardIds), r.getView())
 	if err != nil {
 		zap.L().Fatal("unable to initialize shards body")
 	}
+	r.shardLock.Lock()
+	r.shardId, r.shards = shardId, mapping
+	r.shardLock.Unlock()
 	// Get the kv data
-	shard := r.shards[r.shardId]
+	shard := mapping[shardId]
 	var choices []DataTransfer
 	for _, replica := range shard {
 		if replica == r.addr {
 			continue
 		}
-		data, err := getKvData(replica)
+		data, err := r.getKvData(replica)
 		if err != nil {
 			continue
 		}
@@ -101,20 +184,49 @@ func (r *Replica) initKV(shardId string) {
 	}
 
 	slices.SortFunc(choices, func(a, b DataTransfer) int {
+		// Chain writes don't advance the vector clocks
+		if r.isChainShard() {
+			return cmp.Compare(a.ChainSeq, b.ChainSeq)
+		}
 		return int(a.Vc.Compare(&b.Vc))
 	})
 	if len(choices) == 0 {
+		r.restoreWriteCounter()
 		return
 	}
 	last := len(choices) - 1
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
 	r.kv, r.vc = choices[last].Kv, &choices[last].Vc
+	r.resetVersions(choices[last].Dvvs)
 	r.vc.Self = r.addr
+	r.restoreWriteCounter()
+	r.chainSeq = choices[last].ChainSeq
+	// CRDTs don't need the most updated replica, merging them all loses nothing
+	for _, choice := range choices {
+		mergeCRDTs(r.crdts, choice.Crdts)
+	}
+}
+
+// restoreWriteCounter makes the entry of this replica in its clock cover the
+// writes it coordinated before a restart. The other replicas only count the
+// writes they received, so the writes still waiting in the outbox or the hint
+// store are counted from their causal metadata, and their sequence numbers
+// aren't given to new writes.
+func (r *Replica) restoreWriteCounter() {
+	pending := max(r.outbox.HighestClock(r.addr), r.hints.HighestClock(r.addr))
+	r.vcLock.Lock()
+	defer r.vcLock.Unlock()
+	if r.vc.Clocks == nil {
+		r.vc.Clocks = make(map[string]int)
+	}
+	r.vc.Clocks[r.addr] = max(r.vc.Clocks[r.addr], pending)
 }
 
 func (r *Replica) initReplica() {
 	// Skip registration if the shardCount is not 0 indicating that
 	// the replica has come up for the first time
-	if r.shardCount != 0 {
+	if r.getShardCount() != 0 {
 		return
 	}
 	zap.L().Info("Initializing replica", zap.String("addr", r.addr))
@@ -122,8 +234,8 @@ func (r *Replica) initReplica() {
 		"socket-address": r.addr,
 	}
 
-	zap.L().Info("Registering new replica with its views", zap.Strings("views", r.View))
-	Broadcast(&BroadcastRequest{
+	zap.L().Info("Registering new replica with its views", zap.Strings("views", r.getView()))
+	r.Broadcast(&BroadcastRequest{
 		Method:   http.MethodPut,
 		Payload:  payload,
 		Endpoint: "/view",
@@ -162,22 +274,79 @@ func initShards(shardCount int, view []string) (map[string][]string, error) {
 	return shards, nil
 }
 
-func NewReplica() *Replica {
-	address := os.Getenv("SOCKET_ADDRESS")
-	view := os.Getenv("VIEW")
-	shardCountStr := os.Getenv("SHARD_COUNT")
-	var (
-		shardCount int
-		err        error
-	)
-	if shardCountStr != "" {
-		shardCount, err = strconv.Atoi(os.Getenv("SHARD_COUNT"))
+// ReplicaConfig holds the settings of a replica. Settings that are parsed by
+// the component they configure keep the format of their environment variable.
+type ReplicaConfig struct {
+	Address    string
+	View       []string
+	ShardCount int
+	DataDir    string
+
+	ReadRepair            bool
+	Raft                  bool
+	ConsistencyNamespaces string
+	ChainShards           string
+	VersionMaxCount       string
+	VersionRetention      string
+	HintMaxCount          string
+	HintMaxAge            string
+	SessionTTL            string
+	AntiEntropyInterval   string
+	ReplicationTimeout    string
+	BulkTimeout           string
+	HealthTimeout         string
+	MaxIdleConnsPerPeer   string
+
+	// Transport carries the requests to other replicas, over HTTP if nil
+	Transport Transport
+	// Seed seeds the random choices of the replica, such as retry jitter and
+	// anti-entropy peers. Zero picks a random seed.
+	Seed int64
+	// Chaos enables the /admin/chaos endpoints
+	Chaos bool
+}
+
+// ConfigFromEnv reads the settings of the replica from the environment
+func ConfigFromEnv() ReplicaConfig {
+	var shardCount int
+	if shardCountStr := os.Getenv("SHARD_COUNT"); shardCountStr != "" {
+		var err error
+		shardCount, err = strconv.Atoi(shardCountStr)
 		if err != nil {
 			panic(err)
 		}
 	}
+	return ReplicaConfig{
+		Address:    os.Getenv("SOCKET_ADDRESS"),
+		View:       strings.Split(os.Getenv("VIEW"), ","),
+		ShardCount: shardCount,
+		DataDir:    dataDir(),
 
-	shards, err := initShards(shardCount, strings.Split(view, ","))
+		ReadRepair:            os.Getenv("READ_REPAIR") == "true",
+		Raft:                  os.Getenv("RAFT") == "true",
+		ConsistencyNamespaces: os.Getenv("CONSISTENCY_NAMESPACES"),
+		ChainShards:           os.Getenv("CHAIN_SHARDS"),
+		VersionMaxCount:       os.Getenv("VERSION_MAX_COUNT"),
+		VersionRetention:      os.Getenv("VERSION_RETENTION"),
+		HintMaxCount:          os.Getenv("HINT_MAX_COUNT"),
+		HintMaxAge:            os.Getenv("HINT_MAX_AGE"),
+		SessionTTL:            os.Getenv("SESSION_TTL"),
+		AntiEntropyInterval:   os.Getenv("ANTI_ENTROPY_INTERVAL"),
+		ReplicationTimeout:    os.Getenv("REPLICATION_TIMEOUT"),
+		BulkTimeout:           os.Getenv("BULK_TIMEOUT"),
+		HealthTimeout:         os.Getenv("HEALTH_TIMEOUT"),
+		MaxIdleConnsPerPeer:   os.Getenv("MAX_IDLE_CONNS_PER_PEER"),
+		Chaos:                 os.Getenv("CHAOS") == "true",
+	}
+}
+
+func NewReplica() *Replica {
+	return NewReplicaWithConfig(ConfigFromEnv())
+}
+
+func NewReplicaWithConfig(cfg ReplicaConfig) *Replica {
+	address := cfg.Address
+	shards, err := initShards(cfg.ShardCount, cfg.View)
 
 	// Get the nodeShardId of the current node
 	nodeShardId := ""
@@ -192,25 +361,148 @@ func NewReplica() *Replica {
 		panic(err)
 	}
 
-	return &Replica{
+	r := &Replica{
 		addr: address,
 		ViewInfo: &ViewInfo{
-			View: strings.Split(view, ","),
+			View: slices.Clone(cfg.View),
 		},
-		kv: make(map[string]any),
+		kv:       make(map[string]any),
+		versions: make(map[string][]Version),
+		dvvs:     make(map[string]*KeyDVV),
+		crdts:    make(map[string]*CRDT),
+		waits:    NewCausalWaitQueue(),
+		hlc:      NewHLC(address),
 		vc: &VectorClock{
 			Clocks: make(map[string]int),
 			Self:   address,
 		},
-		shardCount: shardCount,
+		shardCount: cfg.ShardCount,
 		shards:     shards,
 		shardId:    nodeShardId,
+		dataDir:    cfg.DataDir,
+
+		readRepair:          cfg.ReadRepair,
+		namespaces:          parseNamespaces(cfg.ConsistencyNamespaces),
+		chainShards:         parseChainShards(cfg.ChainShards),
+		versionPolicy:       parseVersionPolicy(cfg.VersionMaxCount, cfg.VersionRetention),
+		hints:               NewHintStore(cfg.DataDir, cfg.HintMaxCount, cfg.HintMaxAge),
+		sessions:            NewSessionStore(cfg.SessionTTL),
+		antiEntropyInterval: parseAntiEntropyInterval(cfg.AntiEntropyInterval),
+	}
+	r.raftEnabled = cfg.Raft || usesRaft(r.namespaces)
+	r.raftLeaders = make(map[string]string)
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	poolCfg := parsePoolConfig(cfg.ReplicationTimeout, cfg.BulkTimeout, cfg.HealthTimeout, cfg.MaxIdleConnsPerPeer)
+	transport := cfg.Transport
+	if transport == nil {
+		r.pool = NewClientPool(poolCfg)
+		transport = r.pool
+	}
+	if cfg.Chaos {
+		r.chaos = NewChaos(address, seed)
+		transport = r.chaos.Wrap(transport)
+	}
+	r.timeouts = poolCfg.Timeouts
+	r.transport = senderTransport{from: address, timeouts: r.timeouts, next: transport}
+	r.aeRand = rand.New(rand.NewSource(seed))
+	r.outbox = NewOutbox(cfg.DataDir, r.handleUnreachable)
+	r.outbox.transport = r.transport
+	r.outbox.diverted = r.hints.Pending
+	r.outbox.seed = seed
+	r.done = make(chan struct{})
+	r.txns = NewTxnLog(cfg.DataDir)
+	return r
+}
+
+// Start resumes the outbox, joins the raft group of the replica's shard and
+// starts the background tasks
+func (r *Replica) Start() {
+	r.outbox.Start()
+	r.startRaft()
+	go r.runAntiEntropy()
+	go r.runHintedHandoff()
+	go r.runTxnRecovery()
+	go r.runVersionGC()
+	go r.runSessionGC()
+}
+
+// Stop stops the background tasks, the outbox workers and the raft node, and
+// closes the idle connections to other replicas
+func (r *Replica) Stop() {
+	close(r.done)
+	r.outbox.Stop()
+	if node := r.getRaft(); node != nil {
+		node.Stop()
+	}
+	if r.pool != nil {
+		r.pool.CloseIdle()
+	}
+}
+
+// sleep waits for d and returns false if the replica stopped in the meantime
+func (r *Replica) sleep(d time.Duration) bool {
+	select {
+	case <-r.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// shardState returns the id of the replica's shard and the shard mapping,
+// which must not be modified
+func (r *Replica) shardState() (string, map[string][]string) {
+	r.shardLock.RLock()
+	defer r.shardLock.RUnlock()
+	return r.shardId, r.shards
+}
+
+// getShards returns the shard mapping, which must not be modified
+func (r *Replica) getShards() map[string][]string {
+	_, shards := r.shardState()
+	return shards
+}
+
+func (r *Replica) getShardId() string {
+	shardId, _ := r.shardState()
+	return shardId
+}
+
+func (r *Replica) getShardCount() int {
+	r.shardLock.RLock()
+	defer r.shardLock.RUnlock()
+	return r.shardCount
+}
+
+// shardMembers returns the members of the replica's shard
+func (r *Replica) shardMembers() []string {
+	shardId, shards := r.shardState()
+	return shards[shardId]
+}
+
+// setShards replaces the shard mapping and the shard of the replica
+func (r *Replica) setShards(shardId string, shardCount int, shards map[string][]string) {
+	r.shardLock.Lock()
+	defer r.shardLock.Unlock()
+	r.shardId, r.shardCount, r.shards = shardId, shardCount, shards
+}
+
+// getView returns the view of the replica, which must not be modified
+func (r *Replica) getView() []string {
+	r.shardLock.RLock()
+	defer r.shardLock.RUnlock()
+	if len(r.View) == 0 {
+		return []string{r.addr}
 	}
+	return r.View
 }
 
 func (r *Replica) GetOtherViews() []string {
 	otherViews := []string{}
-	for _, view := range r.View {
+	for _, view := range r.getView() {
 		if view != r.addr {
 			otherViews = append(otherViews, view)
 		}
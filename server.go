@@ -15,9 +15,11 @@ func (r *Replica) ReplicaStatus(next echo.HandlerFunc) echo.HandlerFunc {
 		if err := next(c); err != nil {
 			c.Error(err)
 		}
+		r.kvLock.RLock()
+		defer r.kvLock.RUnlock()
 		r.vcLock.Lock()
 		defer r.vcLock.Unlock()
-		zap.L().Info("In Status", zap.Any("kv", r.kv), zap.Strings("views", r.View), zap.Any("ServerVC:", r.vc.Clocks), zap.String("ServerSelf:", r.vc.Self), zap.Any("shards", r.shards))
+		zap.L().Info("In Status", zap.Any("kv", r.kv), zap.Strings("views", r.getView()), zap.Any("ServerVC:", r.vc.Clocks), zap.String("ServerSelf:", r.vc.Self), zap.Any("shards", r.getShards()))
 		return nil
 	}
 }
@@ -28,50 +30,154 @@ func (r *Replica) ForwardRemoteKey(next echo.HandlerFunc) echo.HandlerFunc {
 		if len(key) > 50 {
 			return c.JSON(http.StatusBadRequest, ErrResponse{Error: "Key is too long"})
 		}
-		shardId := findShard(key, r.shards)
+		ownShardId, shards := r.shardState()
+		shardId := findShard(key, shards)
 
 		// If it belongs to the current replica then call the next function
-		if shardId == r.shardId {
+		if shardId == ownShardId {
 			// zap.L().Info("Local key, no need to forward")
 			return next(c)
 		}
 
 		// Otherwise begin forwarding
-		nodes, ok := r.shards[shardId]
+		nodes, ok := shards[shardId]
 		if !ok {
 			zap.L().Error("No nodes to forward to", zap.String("shardId", shardId))
 			return c.JSON(http.StatusInternalServerError, ErrResponse{Error: "No nodes in shard"})
 		}
+		// CRDT operations aren't causally consistent, they're forwarded as is
+		if strings.HasSuffix(c.Path(), "/crdt") {
+			return r.forwardCRDT(c, nodes)
+		}
+
 		method := c.Request().Method
+		endpoint := "/kvs/" + key
+		if query := c.QueryString(); query != "" {
+			endpoint += "?" + query
+		}
 		br := BroadcastRequest{
 			Targets:  nodes,
 			Method:   method,
-			Endpoint: "/kvs/" + key,
+			Endpoint: endpoint,
+		}
+		// Leave the owning replica time to wait for causal dependencies
+		wait, err := causalWait(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+		}
+		if wait > defaultCausalWait {
+			br.Timeout = r.timeouts.For(OpReplication) + wait
 		}
 		// Update causal metadata and send it downstream
 		request := new(Request)
 		if err := c.Bind(request); err != nil {
 			return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
 		}
-		remoteHost := strings.Split(c.Request().RemoteAddr, ":")[0]
-		request.CausalMetadata = GetClientVectorClock(request, remoteHost)
+		request.CausalMetadata = GetClientVectorClock(request)
 		br.Payload = request
 
+		// Linearizable requests go to the leader of the shard's raft group
+		if opts, err := r.consistencyFor(c, key, request); err == nil && opts.Mode == ModeLinearizable {
+			br.Targets = r.leaderFirst(shardId, nodes)
+		}
+
+		// Chain shards serve writes at the head and reads at the tail
+		if r.chainShards[shardId] {
+			br.Targets = chainFirst(method, nodes)
+		}
+
+		if r.isReadRepair(c) && !r.chainShards[shardId] {
+			return r.readWithRepair(c, key, nodes, request.CausalMetadata)
+		}
+
 		// zap.L().Info("Remote key, forwarding request to", zap.String("shardId", shardId), zap.Strings("nodes", nodes))
-		res, err := BroadcastFirst(&BroadcastFirstRequest{
-			BroadcastRequest: br, srcAddr: r.addr,
-		})
+		res, err := r.BroadcastFirst(&br)
 		// Return
-		if err != nil {
+		if err != nil || res == nil {
 			return c.JSON(
 				http.StatusInternalServerError,
 				ErrResponse{Error: "couldn't forward request"},
 			)
 		}
+		defer res.Body.Close()
+		r.rememberLeader(shardId, res)
 		return c.Stream(res.StatusCode, "application/json", res.Body)
 	}
 }
 
+// routes registers the endpoints of the replica on e
+func (r *Replica) routes(e *echo.Echo) {
+	e.POST("/session", r.handleSessionCreate)
+	e.GET("/session/:id", r.handleSessionGet)
+	e.DELETE("/session/:id", r.handleSessionDelete)
+
+	kv := e.Group("/kvs/:key", r.Sessions, r.ForwardRemoteKey)
+	kv.PUT("", r.handlePut)
+	kv.GET("", r.handleGet)
+	kv.DELETE("", r.handleDelete)
+	kv.GET("/crdt", r.handleCRDTGet)
+	kv.POST("/crdt", r.handleCRDTOp)
+	kv.PUT("/crdt", r.handleCRDTMerge)
+
+	e.PUT("/view", r.handleViewPut)
+	e.GET("/view", r.handleViewGet)
+	e.DELETE("/view", r.handleViewDelete)
+
+	sh := e.Group("/shard")
+	sh.PUT("/add-member/:id", r.handleShardMemberPut)
+	sh.GET("/ids", r.handleShardIdGet)
+	sh.GET("/node-shard-id", r.handleShardNodeGet)
+	sh.GET("/members/:id", r.handleShardMembersGet)
+	sh.GET("/key-count/:id", r.handleShardKeyCount)
+	sh.PUT("/reshard", r.handleReshard)
+	sh.PUT("/update", r.handleUpdateShard)
+	sh.PUT("/drain", r.handleShardDrain)
+
+	e.GET("/data", r.handleDataTransfer)
+	e.GET("/key-state/:key", r.handleKeyStateGet)
+	e.PUT("/key-state/:key", r.handleKeyStatePut)
+	e.PUT("/chain", r.handleChainWrite)
+
+	e.POST("/txn", r.handleTxn, r.Sessions)
+	txn := e.Group("/txn")
+	txn.GET("/:id", r.handleTxnStatus)
+	txn.POST("/prepare", r.handleTxnPrepare)
+	txn.POST("/commit", r.handleTxnCommit)
+	txn.POST("/abort", r.handleTxnAbort)
+	txn.PUT("/apply", r.handleTxnApply)
+	txn.PUT("/hold", r.handleTxnHold)
+	txn.PUT("/release", r.handleTxnRelease)
+	txn.POST("/read", r.handleSnapshotRead, r.Sessions)
+	txn.POST("/snapshot", r.handleSnapshotPart)
+
+	ae := e.Group("/anti-entropy")
+	ae.GET("/tree", r.handleMerkleTreeGet)
+	ae.GET("/buckets", r.handleBucketsGet)
+	ae.GET("/metrics", r.handleAntiEntropyMetrics)
+
+	rg := e.Group("/raft")
+	rg.POST("/request-vote", r.handleRequestVote)
+	rg.POST("/append-entries", r.handleAppendEntries)
+	rg.GET("/status", r.handleRaftStatus)
+
+	admin := e.Group("/admin")
+	admin.GET("/hints", r.handleHintsGet)
+	admin.GET("/outbox", r.handleOutboxGet)
+	if r.pool != nil {
+		admin.GET("/transport", r.handleTransportMetrics)
+	}
+
+	if r.chaos != nil {
+		e.Use(r.chaos.Middleware)
+		chaos := admin.Group("/chaos")
+		chaos.GET("", r.handleChaosGet)
+		chaos.DELETE("", r.handleChaosDelete)
+		chaos.PUT("/peers", r.handleChaosPeers)
+		chaos.PUT("/fail", r.handleChaosFail)
+		chaos.PUT("/unavailable", r.handleChaosUnavailable)
+	}
+}
+
 func main() {
 
 	logger, _ := zap.NewDevelopment()
@@ -85,27 +191,9 @@ func main() {
 		Format: "method=${method}, remote_ip=${remote_ip} uri=${uri}, status=${status}\n",
 	}), server.ReplicaStatus, middleware.Recover())
 
-	kv := e.Group("/kvs/:key", server.ForwardRemoteKey)
-	kv.PUT("", server.handlePut)
-	kv.GET("", server.handleGet)
-	kv.DELETE("", server.handleDelete)
-
-	e.PUT("/view", server.handleViewPut)
-	e.GET("/view", server.handleViewGet)
-	e.DELETE("/view", server.handleViewDelete)
-
-	sh := e.Group("/shard")
-	sh.PUT("/add-member/:id", server.handleShardMemberPut)
-	sh.GET("/ids", server.handleShardIdGet)
-	sh.GET("/node-shard-id", server.handleShardNodeGet)
-	sh.GET("/members/:id", server.handleShardMembersGet)
-	sh.GET("/key-count/:id", server.handleShardKeyCount)
-	sh.PUT("/reshard", server.handleReshard)
-	sh.PUT("/update", server.handleUpdateShard)
-
-	e.GET("/data", server.handleDataTransfer)
-	e.PUT("/cm", server.handlePutCM)
+	server.routes(e)
 
 	server.initReplica()
+	server.Start()
 	e.Logger.Fatal(e.Start(":8090"))
 }
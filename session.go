@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSessionTTL  = 30 * time.Minute
+	sessionGCInterval  = time.Minute
+	sessionIdByteCount = 16
+)
+
+// Session is the causal context of a client session: the clock of every write
+// and read made in the session, kept by the replica so that clients sharing a
+// session, or that lose their causal metadata, still see their own writes
+type Session struct {
+	Id       string      `json:"session"`
+	Clock    VectorClock `json:"causal-metadata"`
+	LastSeen time.Time   `json:"last-seen"`
+}
+
+// SessionStore holds the sessions served by the replica and forgets those that
+// stay idle for longer than ttl
+type SessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+}
+
+func NewSessionStore(ttl string) *SessionStore {
+	s := &SessionStore{sessions: make(map[string]*Session), ttl: defaultSessionTTL}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			panic(err)
+		}
+		s.ttl = d
+	}
+	return s
+}
+
+func newSessionId() string {
+	id := make([]byte, sessionIdByteCount)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Create starts a new session with an empty clock
+func (s *SessionStore) Create() Session {
+	session := &Session{
+		Id:       newSessionId(),
+		Clock:    VectorClock{Clocks: make(map[string]int)},
+		LastSeen: time.Now(),
+	}
+	session.Clock.Session = session.Id
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[session.Id] = session
+	return s.copy(session)
+}
+
+// Get returns the session with the given id
+func (s *SessionStore) Get(id string) (Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	return s.copy(session), true
+}
+
+// End forgets the session with the given id, returning false if it's unknown
+func (s *SessionStore) End(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.sessions[id]
+	delete(s.sessions, id)
+	return ok
+}
+
+// Resume merges the clock of the session of clientClock into it. Sessions
+// the replica doesn't know, because another replica issued them or they
+// expired, are adopted with the clock the client sent.
+func (s *SessionStore) Resume(clientClock *VectorClock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[clientClock.Session]
+	if !ok {
+		session = &Session{Id: clientClock.Session, Clock: CloneVC(*clientClock)}
+		s.sessions[session.Id] = session
+	}
+	session.LastSeen = time.Now()
+	for replica, entry := range session.Clock.Clocks {
+		if entry > clientClock.Clocks[replica] {
+			clientClock.Clocks[replica] = entry
+		}
+	}
+	clientClock.observe(session.Clock.Timestamp)
+}
+
+// Save merges the clock returned to the client into its session
+func (s *SessionStore) Save(clientClock VectorClock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[clientClock.Session]
+	if !ok {
+		return
+	}
+	session.LastSeen = time.Now()
+	for replica, entry := range clientClock.Clocks {
+		if entry > session.Clock.Clocks[replica] {
+			session.Clock.Clocks[replica] = entry
+		}
+	}
+	session.Clock.observe(clientClock.Timestamp)
+}
+
+// Expire drops the sessions idle for longer than the ttl and returns how many
+// were dropped
+func (s *SessionStore) Expire(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dropped := 0
+	for id, session := range s.sessions {
+		if now.Sub(session.LastSeen) > s.ttl {
+			delete(s.sessions, id)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (s *SessionStore) copy(session *Session) Session {
+	c := *session
+	c.Clock = CloneVC(session.Clock)
+	return c
+}
+
+// runSessionGC periodically forgets idle sessions
+func (r *Replica) runSessionGC() {
+	for r.sleep(sessionGCInterval) {
+		if dropped := r.sessions.Expire(time.Now()); dropped > 0 {
+			zap.L().Info("Garbage-collected sessions", zap.Int("dropped", dropped))
+		}
+	}
+}
+
+func (r *Replica) handleSessionCreate(c echo.Context) error {
+	return c.JSON(http.StatusCreated, r.sessions.Create())
+}
+
+func (r *Replica) handleSessionGet(c echo.Context) error {
+	session, ok := r.sessions.Get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Session does not exist"})
+	}
+	return c.JSON(http.StatusOK, session)
+}
+
+func (r *Replica) handleSessionDelete(c echo.Context) error {
+	if !r.sessions.End(c.Param("id")) {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Session does not exist"})
+	}
+	return c.JSON(http.StatusOK, ActionResponse{Result: "ended"})
+}
+
+// sessionRecorder holds back the response of a request made in a session, so
+// that its causal metadata can be saved to the session before it's sent
+type sessionRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *sessionRecorder) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *sessionRecorder) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// Sessions is a middleware that resolves the session named in the causal
+// metadata of client requests. The clock of the session is merged into the
+// request, and the causal metadata of the response is merged back into the
+// session and returned with the session id, so that replicas behind the one
+// serving the request never see it.
+func (r *Replica) Sessions(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Body == nil {
+			return next(c)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		var fields map[string]json.RawMessage
+		var clientClock VectorClock
+		if json.Unmarshal(body, &fields) != nil || json.Unmarshal(fields["causal-metadata"], &clientClock) != nil || clientClock.Session == "" {
+			return next(c)
+		}
+		if clientClock.Clocks == nil {
+			clientClock.Clocks = make(map[string]int)
+		}
+		r.sessions.Resume(&clientClock)
+		fields["causal-metadata"], _ = json.Marshal(clientClock)
+		body, _ = json.Marshal(fields)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		res := c.Response()
+		w := res.Writer
+		rec := &sessionRecorder{ResponseWriter: w, status: http.StatusOK}
+		res.Writer = rec
+		err = next(c)
+		res.Writer = w
+		if !res.Committed {
+			return err
+		}
+
+		out := rec.body.Bytes()
+		var resFields map[string]json.RawMessage
+		var resClock VectorClock
+		if json.Unmarshal(out, &resFields) == nil && json.Unmarshal(resFields["causal-metadata"], &resClock) == nil && resClock.Clocks != nil {
+			resClock.Session = clientClock.Session
+			r.sessions.Save(resClock)
+			resFields["causal-metadata"], _ = json.Marshal(resClock)
+			out, _ = json.Marshal(resFields)
+		}
+		w.WriteHeader(rec.status)
+		_, werr := w.Write(out)
+		if err != nil {
+			return err
+		}
+		return werr
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SessionMiddleware(t *testing.T) {
+	r := &Replica{sessions: NewSessionStore("")}
+	session := r.sessions.Create()
+	r.sessions.Save(VectorClock{Session: session.Id, Clocks: map[string]int{"a": 2}})
+
+	e := echo.New()
+	e.PUT("/kvs/:key", func(c echo.Context) error {
+		request := new(Request)
+		if err := c.Bind(request); err != nil {
+			return err
+		}
+		clientClock := GetClientVectorClock(request)
+		// The session's clock is merged into the request, but isn't passed on
+		assert.Equal(t, map[string]int{"a": 2, "b": 1}, clientClock.Clocks)
+		assert.Empty(t, clientClock.Session)
+		clientClock.Clocks["b"]++
+		return c.JSON(http.StatusOK, Response{Result: "replaced", CausalMetadata: clientClock})
+	}, r.Sessions)
+
+	body := `{"value": 1, "causal-metadata": {"Clocks": {"b": 1}, "Session": "` + session.Id + `"}}`
+	req := httptest.NewRequest(http.MethodPut, "/kvs/x", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res Response
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "replaced", res.Result)
+	assert.Equal(t, session.Id, res.CausalMetadata.Session)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, res.CausalMetadata.Clocks)
+
+	saved, ok := r.sessions.Get(session.Id)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, saved.Clock.Clocks)
+}
+
+func Test_SessionExpire(t *testing.T) {
+	s := NewSessionStore("1m")
+	idle := s.Create()
+	active := s.Create()
+	s.sessions[idle.Id].LastSeen = time.Now().Add(-2 * time.Minute)
+
+	assert.Equal(t, 1, s.Expire(time.Now()))
+	_, ok := s.Get(idle.Id)
+	assert.False(t, ok)
+	_, ok = s.Get(active.Id)
+	assert.True(t, ok)
+
+	assert.True(t, s.End(active.Id))
+	assert.False(t, s.End(active.Id))
+}
@@ -34,6 +34,11 @@ type ReshardUpdate struct {
 	ShardId    string              `json:"node-shard-id"`
 	Shards     map[string][]string `json:"shards"`
 	KV         map[string]any      `json:"kv"`
+	CRDTs      map[string]*CRDT    `json:"crdts,omitempty"`
+	Dvvs       map[string]*KeyDVV  `json:"dvvs,omitempty"`
+	// Vc merges the clocks of every shard, so that the new shards cover the
+	// writes coordinated by their members before the reshard
+	Vc VectorClock `json:"vc"`
 }
 
 func (r *Replica) handleReshard(c echo.Context) error {
@@ -48,8 +53,9 @@ func (r *Replica) handleReshard(c echo.Context) error {
 		)
 	}
 
+	ownShardId, shards := r.shardState()
 	totalNodes := 0
-	for _, nodes := range r.shards {
+	for _, nodes := range shards {
 		totalNodes += len(nodes)
 	}
 
@@ -60,41 +66,61 @@ func (r *Replica) handleReshard(c echo.Context) error {
 		)
 	}
 
-	if rr.ShardCount == r.shardCount {
+	if rr.ShardCount == r.getShardCount() {
 		return c.JSON(http.StatusOK, ActionResponse{
 			Result: "resharded"})
 	}
 
 	zap.L().Info("Resharding", zap.String("leader-ip", r.addr))
+	// Wait for the writes still being replicated to reach their replicas, so
+	// that the data fetched from each shard includes them
+	if !r.outbox.Drain(outboxDrainTimeout) {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "couldn't replicate pending writes"})
+	}
+	if failed := r.Broadcast(&BroadcastRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/shard/drain",
+		Targets:  r.GetOtherViews(),
+		Op:       OpBulk,
+	}); len(failed) > 0 {
+		zap.L().Error("Failed to drain outbox of", zap.String("addr", failed[0].address))
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "couldn't replicate pending writes"})
+	}
 	// Aggregate all the key-value pairs
-	allKvs := make(map[string]any)
-	maps.Copy(allKvs, r.kv)
-	for shardId, nodes := range r.shards {
+	allKvs, allVc, allDvvs := r.snapshotData()
+	allCRDTs := r.snapshotCRDTs()
+	for _, shardId := range slices.Sorted(maps.Keys(shards)) {
+		nodes := shards[shardId]
 		// Skip current shard
-		if shardId == r.shardId {
+		if shardId == ownShardId {
 			continue
 		}
 		zap.L().Info("Getting keys from shard", zap.String("shard", shardId), zap.Strings("nodes", nodes))
-		res, err := BroadcastFirst(&BroadcastFirstRequest{
-			BroadcastRequest: BroadcastRequest{
-				Method:   http.MethodGet,
-				Endpoint: "/data",
-				Targets:  nodes,
-			},
+		res, err := r.BroadcastFirst(&BroadcastRequest{
+			Method:   http.MethodGet,
+			Endpoint: "/data",
+			Targets:  nodes,
+			Op:       OpBulk,
 		})
 		if err != nil || res == nil {
 			zap.L().Error("Failed to fetch data for", zap.String("shardId", shardId), zap.Error(err))
 			return c.JSON(http.StatusInternalServerError, ErrResponse{Error: "couldn't fetch data"})
 		}
 		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
 		var data DataTransfer
 		json.Unmarshal(body, &data)
 		zap.L().Info("Got _ keys from _ shard:", zap.Int("key-count", len(data.Kv)), zap.String("shard:", shardId))
 		maps.Copy(allKvs, data.Kv)
+		maps.Copy(allDvvs, data.Dvvs)
+		mergeCRDTs(allCRDTs, data.Crdts)
+		for replica, entry := range data.Vc.Clocks {
+			allVc.Clocks[replica] = max(allVc.Clocks[replica], entry)
+		}
 	}
 	zap.L().Info("Copied all KVS", zap.Int("num-keys", len(allKvs)))
 	// Move nodes to new shard
-	newShards, err := initShards(rr.ShardCount, r.View)
+	newShards, err := initShards(rr.ShardCount, r.getView())
 	if err != nil {
 		zap.L().Error("Failed to init shard names", zap.Error(err))
 		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "bad reshard request"})
@@ -115,6 +141,22 @@ func (r *Replica) handleReshard(c echo.Context) error {
 		kv[k] = v
 		newKv[assignedShard] = kv
 	}
+	newCRDTs := make(map[string]map[string]*CRDT)
+	for k, crdt := range allCRDTs {
+		assignedShard := findShard(k, newShards)
+		if newCRDTs[assignedShard] == nil {
+			newCRDTs[assignedShard] = make(map[string]*CRDT)
+		}
+		newCRDTs[assignedShard][k] = crdt
+	}
+	newDvvs := make(map[string]map[string]*KeyDVV)
+	for k, d := range allDvvs {
+		assignedShard := findShard(k, newShards)
+		if newDvvs[assignedShard] == nil {
+			newDvvs[assignedShard] = make(map[string]*KeyDVV)
+		}
+		newDvvs[assignedShard][k] = d
+	}
 	totalKeys := 0
 	for sh, v := range newKv {
 		zap.L().Debug("Key count for shard", zap.String("shardId", sh), zap.Int("key-count", len(v)))
@@ -125,18 +167,27 @@ func (r *Replica) handleReshard(c echo.Context) error {
 
 	// Broadcast this state update to each shard
 	// Including self
-	for sh, nodes := range newShards {
-		r.BufferAtSender(&BufferAtSenderRequest{
+	for _, sh := range slices.Sorted(maps.Keys(newShards)) {
+		nodes := newShards[sh]
+		failed := r.Broadcast(&BroadcastRequest{
 			Method: http.MethodPut,
 			Payload: ReshardUpdate{
 				ShardCount: rr.ShardCount,
 				ShardId:    sh,
 				Shards:     newShards,
 				KV:         newKv[sh],
+				CRDTs:      newCRDTs[sh],
+				Dvvs:       newDvvs[sh],
+				Vc:         allVc,
 			},
 			Targets:  nodes,
 			Endpoint: "/shard/update",
+			Op:       OpBulk,
 		})
+		if len(failed) > 0 {
+			zap.L().Error("Failed to update shard of", zap.String("addr", failed[0].address))
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "couldn't update every node"})
+		}
 	}
 
 	return c.JSON(http.StatusOK, ActionResponse{Result: "resharded"})
@@ -147,15 +198,36 @@ func (replica *Replica) handleUpdateShard(c echo.Context) error {
 	if err := c.Bind(ru); err != nil || ru == nil {
 		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "missing KV, Shards, or node ID"})
 	}
+	if ru.KV == nil {
+		ru.KV = make(map[string]any)
+	}
+	replica.resetRaft()
+	replica.resetChain()
+	replica.kvLock.Lock()
 	replica.kv = ru.KV
-	zap.L().Debug("Key-Count:", zap.Int("key-count", len(replica.kv)))
-	replica.shardId = ru.ShardId
-	replica.shardCount = ru.ShardCount
-	replica.shards = ru.Shards
+	replica.resetVersions(ru.Dvvs)
+	replica.crdts = ru.CRDTs
+	if replica.crdts == nil {
+		replica.crdts = make(map[string]*CRDT)
+	}
+	replica.kvLock.Unlock()
+	replica.mergeVC(ru.Vc)
+	zap.L().Debug("Key-Count:", zap.Int("key-count", len(ru.KV)))
+	replica.setShards(ru.ShardId, ru.ShardCount, ru.Shards)
+	replica.startRaft()
 
 	return c.JSON(http.StatusOK, ActionResponse{Result: "updated"})
 }
 
+// handleShardDrain responds once the requests queued in the outbox before it
+// were delivered, or with a 503 if they weren't in time
+func (replica *Replica) handleShardDrain(c echo.Context) error {
+	if !replica.outbox.Drain(outboxDrainTimeout) {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "outbox not drained"})
+	}
+	return c.JSON(http.StatusOK, ActionResponse{Result: "drained"})
+}
+
 func (replica *Replica) handleShardMemberPut(c echo.Context) error {
 	shardId := c.Param("id")
 
@@ -165,18 +237,12 @@ func (replica *Replica) handleShardMemberPut(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "Bad Request"})
 	}
 
-	viewExists := false
 	// Sync replica data with shard if it hasn't already
-	if replica.addr == socket.Address && replica.shardId == "" {
+	if replica.addr == socket.Address && replica.getShardId() == "" {
 		replica.initKV(shardId)
 	}
-	_, shardExists := replica.shards[shardId]
-
-	for _, r := range replica.View {
-		if socket.Address == r {
-			viewExists = true
-		}
-	}
+	_, shardExists := replica.getShards()[shardId]
+	viewExists := slices.Contains(replica.getView(), socket.Address)
 
 	// Validate the node's existence as well as the shard
 	if !shardExists && !viewExists {
@@ -191,8 +257,16 @@ func (replica *Replica) handleShardMemberPut(c echo.Context) error {
 	}
 
 	// Add this node to the shard if it isn't already
-	if !slices.Contains(replica.shards[shardId], socket.Address) {
-		replica.shards[shardId] = append(replica.shards[shardId], socket.Address)
+	replica.shardLock.Lock()
+	if members := replica.shards[shardId]; !slices.Contains(members, socket.Address) {
+		shards := maps.Clone(replica.shards)
+		shards[shardId] = append(slices.Clone(members), socket.Address)
+		replica.shards = shards
+	}
+	ownShard := shardId == replica.shardId
+	replica.shardLock.Unlock()
+	if ownShard {
+		replica.startRaft()
 	}
 	// Then broadcast it if this hasn't been broadcast yet
 	if !socket.IsBroadcast {
@@ -200,7 +274,7 @@ func (replica *Replica) handleShardMemberPut(c echo.Context) error {
 			Address:     socket.Address,
 			IsBroadcast: true,
 		}
-		replica.BufferAtSender(&BufferAtSenderRequest{
+		replica.broadcastChange(&BroadcastRequest{
 			Method:   http.MethodPut,
 			Payload:  payload,
 			Endpoint: "/shard/add-member/" + shardId,
@@ -214,23 +288,24 @@ func (replica *Replica) handleShardMemberPut(c echo.Context) error {
 
 func (replica *Replica) handleShardIdGet(c echo.Context) error {
 	var ids []string
-	for shardId := range replica.shards {
+	for shardId := range replica.getShards() {
 		ids = append(ids, shardId)
 	}
 	return c.JSON(http.StatusOK, ShardIdsResponse{ShardIds: ids})
 }
 
 func (replica *Replica) handleShardNodeGet(c echo.Context) error {
-	zap.L().Info("in handleShardNodeGet", zap.String("node-shard-id", replica.shardId))
-	if replica.shardId != "" {
-		return c.JSON(http.StatusOK, NodeIdResponse{NodeShardId: replica.shardId})
+	shardId := replica.getShardId()
+	zap.L().Info("in handleShardNodeGet", zap.String("node-shard-id", shardId))
+	if shardId != "" {
+		return c.JSON(http.StatusOK, NodeIdResponse{NodeShardId: shardId})
 	}
 	return c.JSON(http.StatusNotFound, ErrResponse{Error: "Shard Not Found (shouldn't happen)"})
 }
 
 func (replica *Replica) handleShardMembersGet(c echo.Context) error {
 	shardId := c.Param("id")
-	nodes, ok := replica.shards[shardId]
+	nodes, ok := replica.getShards()[shardId]
 	if ok {
 		return c.JSON(http.StatusOK, ShardMembersResponse{ShardMembers: nodes})
 	}
@@ -240,19 +315,27 @@ func (replica *Replica) handleShardMembersGet(c echo.Context) error {
 func (replica *Replica) handleShardKeyCount(c echo.Context) error {
 	shardId := c.Param("id")
 
-	if shardId == replica.shardId {
+	ownShardId, shards := replica.shardState()
+	if shardId == ownShardId {
+		replica.kvLock.RLock()
+		defer replica.kvLock.RUnlock()
 		return c.JSON(http.StatusOK, ShardKeyCountResponse{ShardKeyCount: len(replica.kv)})
 	}
 
-	shardNodes, shardExists := replica.shards[shardId]
+	shardNodes, shardExists := shards[shardId]
 	if !shardExists {
 		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Shard ID does not exist"})
 	}
 
-	resp, err := http.Get(fmt.Sprintf("http://%s/shard/key-count/%s", shardNodes[0], shardId))
+	resp, err := replica.transport.Send(HttpRequest{
+		method:   http.MethodGet,
+		endpoint: "/shard/key-count/" + shardId,
+		addr:     shardNodes[0],
+	})
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, ErrResponse{Error: "Request for key count failed"})
 	}
+	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
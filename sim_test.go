@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var simSeed = flag.Int64("sim.seed", 0, "run the simulations with this seed only")
+
+const (
+	// simMaxLatency bounds the random latency of a simulated request
+	simMaxLatency = 10 * time.Millisecond
+	// simSettle is how long the cluster is left to converge after the workload
+	simSettle = time.Minute
+	// simTraceTail is how many deliveries are reported when a simulation fails
+	simTraceTail = 40
+)
+
+var errSimClosed = errors.New("simulation closed")
+
+// simMessage is a request in flight between two members of a simulation
+type simMessage struct {
+	from, to  string
+	req       HttpRequest
+	body      []byte
+	deliverAt time.Time
+	reply     chan *http.Response
+}
+
+// key orders the messages in flight independently of the order in which the
+// goroutines that sent them ran
+func (m *simMessage) key() string {
+	return strings.Join([]string{m.from, m.to, m.req.method, m.req.endpoint, string(m.body)}, " ")
+}
+
+// simulation runs a cluster in a synctest bubble, whose virtual clock stands
+// in for the sleeps, timers and timeouts of the replicas. A single scheduler,
+// seeded by the seed of the simulation, delivers the requests between the
+// replicas and their clients one at a time with a random latency, and lets the
+// bubble settle between deliveries. Every goroutine runs in response to a
+// delivery or a timer, so a run is determined by its seed and can be replayed
+// from it.
+type simulation struct {
+	t     *testing.T
+	seed  int64
+	rng   *rand.Rand
+	start time.Time
+	nodes []*Replica
+	// handlers serve the requests to each replica
+	handlers map[string]http.Handler
+
+	lock     sync.Mutex
+	inFlight []*simMessage
+	closed   bool
+	// sent wakes the scheduler up when a request is sent
+	sent chan struct{}
+
+	// trace lists the deliveries in the order they were made
+	trace []string
+}
+
+// newSimulation starts `replicas` replicas split into shardCount shards. It
+// must be called in a synctest bubble.
+func newSimulation(t *testing.T, seed int64, replicas int, shardCount int) *simulation {
+	s := &simulation{
+		t:        t,
+		seed:     seed,
+		rng:      rand.New(rand.NewSource(seed)),
+		start:    time.Now(),
+		handlers: make(map[string]http.Handler),
+		sent:     make(chan struct{}, 1),
+	}
+	addrs := make([]string, replicas)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("replica-%d:8090", i)
+	}
+	for i, addr := range addrs {
+		r := NewReplicaWithConfig(ReplicaConfig{
+			Address:    addr,
+			View:       addrs,
+			ShardCount: shardCount,
+			DataDir:    t.TempDir(),
+			Transport:  s.transport(addr),
+			Seed:       seed + int64(i) + 1,
+		})
+		e := echo.New()
+		r.routes(e)
+		s.handlers[addr] = e
+		s.nodes = append(s.nodes, r)
+	}
+	for _, r := range s.nodes {
+		r.Start()
+	}
+	return s
+}
+
+func (s *simulation) addrs() []string {
+	addrs := make([]string, len(s.nodes))
+	for i, r := range s.nodes {
+		addrs[i] = r.addr
+	}
+	return addrs
+}
+
+// transport returns the transport through which from sends its requests
+func (s *simulation) transport(from string) Transport {
+	return simTransport{sim: s, from: from}
+}
+
+type simTransport struct {
+	sim  *simulation
+	from string
+}
+
+func (t simTransport) Send(r HttpRequest) (*http.Response, error) {
+	s := t.sim
+	body, err := json.Marshal(r.payload)
+	if err != nil {
+		return nil, err
+	}
+	m := &simMessage{from: t.from, to: r.addr, req: r, body: body, reply: make(chan *http.Response, 1)}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, errSimClosed
+	}
+	s.inFlight = append(s.inFlight, m)
+	s.lock.Unlock()
+	select {
+	case s.sent <- struct{}{}:
+	default:
+	}
+
+	timeout := r.timeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	select {
+	case res := <-m.reply:
+		if res == nil {
+			return nil, fmt.Errorf("%s: %w", r.addr, errConnRefused)
+		}
+		return res, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("%s %s to %s: %w", r.method, r.endpoint, r.addr, ErrTimedOut)
+	}
+}
+
+// run delivers requests until done is closed
+func (s *simulation) run(done <-chan struct{}) {
+	for {
+		synctest.Wait()
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if m := s.next(); m != nil {
+			s.deliver(m)
+			continue
+		}
+		wait := time.Hour
+		if m := s.earliest(); m != nil {
+			wait = time.Until(m.deliverAt)
+		}
+		select {
+		case <-s.sent:
+		case <-done:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runFor delivers requests for d
+func (s *simulation) runFor(d time.Duration) {
+	done := make(chan struct{})
+	time.AfterFunc(d, func() { close(done) })
+	s.run(done)
+}
+
+// next schedules the requests sent since the last call, in a stable order, and
+// returns the first one due
+func (s *simulation) next() *simMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var fresh []*simMessage
+	for _, m := range s.inFlight {
+		if m.deliverAt.IsZero() {
+			fresh = append(fresh, m)
+		}
+	}
+	slices.SortStableFunc(fresh, func(a, b *simMessage) int {
+		return strings.Compare(a.key(), b.key())
+	})
+	now := time.Now()
+	for _, m := range fresh {
+		m.deliverAt = now.Add(time.Duration(s.rng.Int63n(int64(simMaxLatency))))
+	}
+
+	var due *simMessage
+	for _, m := range s.inFlight {
+		if m.deliverAt.After(now) {
+			continue
+		}
+		if due == nil || m.deliverAt.Before(due.deliverAt) || (m.deliverAt.Equal(due.deliverAt) && m.key() < due.key()) {
+			due = m
+		}
+	}
+	if due != nil {
+		s.inFlight = slices.DeleteFunc(s.inFlight, func(m *simMessage) bool { return m == due })
+	}
+	return due
+}
+
+// earliest returns the request in flight due first
+func (s *simulation) earliest() *simMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var first *simMessage
+	for _, m := range s.inFlight {
+		if first == nil || m.deliverAt.Before(first.deliverAt) {
+			first = m
+		}
+	}
+	return first
+}
+
+func (s *simulation) deliver(m *simMessage) {
+	digest := fnv.New32a()
+	digest.Write(m.body)
+	s.trace = append(s.trace, fmt.Sprintf("%v %s -> %s %s %s %08x", time.Since(s.start), m.from, m.to, m.req.method, m.req.endpoint, digest.Sum32()))
+	h, ok := s.handlers[m.to]
+	if !ok {
+		m.reply <- nil
+		return
+	}
+	req := httptest.NewRequest(m.req.method, "http://"+m.to+m.req.endpoint, bytes.NewReader(m.body))
+	req.Header.Set("Content-Type", "application/json")
+	if m.req.from != "" {
+		req.Header.Set(replicaHeader, m.req.from)
+	}
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		m.reply <- rec.Result()
+	}()
+}
+
+// close fails the requests in flight and stops the replicas
+func (s *simulation) close() {
+	s.lock.Lock()
+	s.closed = true
+	inFlight := s.inFlight
+	s.inFlight = nil
+	s.lock.Unlock()
+	for _, m := range inFlight {
+		m.reply <- nil
+	}
+	for _, r := range s.nodes {
+		r.Stop()
+	}
+}
+
+// fatalf fails the simulation, reporting its seed and the end of its trace
+func (s *simulation) fatalf(format string, args ...any) {
+	s.t.Helper()
+	trace := s.trace[max(0, len(s.trace)-simTraceTail):]
+	s.t.Fatalf("%s\nreplay with -sim.seed=%d; last deliveries:\n\t%s", fmt.Sprintf(format, args...), s.seed, strings.Join(trace, "\n\t"))
+}
+
+// client returns a client that records its operations in history
+func (s *simulation) client(id int, history *History) *historyClient {
+	t := s.transport(fmt.Sprintf("client-%d", id))
+	return &historyClient{
+		testClient: &testClient{
+			do: func(method string, addr string, endpoint string, payload any, res any) (int, error) {
+				return simDo(t, method, addr, endpoint, payload, res)
+			},
+			clock: VectorClock{Clocks: make(map[string]int)},
+		},
+		id:      id,
+		history: history,
+		rng:     rand.New(rand.NewSource(s.seed*100 + int64(id))),
+	}
+}
+
+// simDo sends a request through t and decodes its JSON response into res,
+// returning the status code
+func simDo(t Transport, method string, addr string, endpoint string, payload any, res any) (int, error) {
+	resp, err := t.Send(HttpRequest{
+		method:   method,
+		endpoint: endpoint,
+		addr:     addr,
+		payload:  payload,
+		timeout:  testClientTimeout,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if res != nil && resp.StatusCode < http.StatusBadRequest {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding %s %s: %w", method, endpoint, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// simulate runs a randomized workload on the simulation: rounds of concurrent
+// puts and gets, each followed by a view change or a reshard. The history of
+// the clients is returned once the cluster had time to converge.
+func (s *simulation) simulate(clients int, rounds int, ops int) *History {
+	h := &History{}
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(done)
+		if err := s.workload(h, clients, rounds, ops); err != nil {
+			errs <- err
+		}
+	}()
+	s.run(done)
+	select {
+	case err := <-errs:
+		s.fatalf("%v", err)
+	default:
+	}
+	s.runFor(simSettle)
+	return h
+}
+
+func (s *simulation) workload(h *History, clientCount int, rounds int, ops int) error {
+	addrs := s.addrs()
+	keys := []string{"a", "b", "c", "d", "e"}
+	var clients []*historyClient
+	for id := 0; id < clientCount; id++ {
+		clients = append(clients, s.client(id, h))
+	}
+	admin := s.transport("admin")
+	rng := rand.New(rand.NewSource(s.seed))
+
+	for round := 0; round < rounds; round++ {
+		errs := make(chan error, clientCount)
+		for _, hc := range clients {
+			go func() {
+				for i := 0; i < ops; i++ {
+					addr := addrs[hc.rng.Intn(len(addrs))]
+					key := keys[hc.rng.Intn(len(keys))]
+					var err error
+					if hc.rng.Intn(2) == 0 {
+						err = hc.put(addr, key)
+					} else {
+						err = hc.get(addr, key)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					time.Sleep(time.Duration(hc.rng.Int63n(int64(simMaxLatency))))
+				}
+				errs <- nil
+			}()
+		}
+		for range clients {
+			if err := <-errs; err != nil {
+				return fmt.Errorf("round %d: %w", round, err)
+			}
+		}
+
+		at := addrs[rng.Intn(len(addrs))]
+		if rng.Intn(2) == 0 {
+			// Take a replica out of the views and put it back. Both changes
+			// are broadcast by the same replica, so that they arrive in order.
+			victim := addrs[rng.Intn(len(addrs))]
+			if victim == at {
+				continue
+			}
+			for _, method := range []string{http.MethodDelete, http.MethodPut} {
+				status, err := simDo(admin, method, at, "/view", map[string]string{"socket-address": victim}, nil)
+				if err != nil || status != http.StatusOK {
+					return fmt.Errorf("round %d: %s /view %s at %s: %d %v", round, method, victim, at, status, err)
+				}
+			}
+		} else {
+			count := 1 + rng.Intn(len(addrs)/2)
+			status, err := simDo(admin, http.MethodPut, at, "/shard/reshard", map[string]int{"shard-count": count}, nil)
+			if err != nil || status != http.StatusOK {
+				return fmt.Errorf("round %d: reshard to %d at %s: %d %v", round, count, at, status, err)
+			}
+		}
+		// Leave the change time to reach every replica
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// check checks that the replicas agree on the views and the shards, that the
+// replicas of each shard converged on the keys of the shard, and that the
+// history is causally consistent
+func (s *simulation) check(h *History) {
+	s.t.Helper()
+	addrs := s.addrs()
+	slices.Sort(addrs)
+	first := s.nodes[0]
+	firstShards := first.getShards()
+	for _, r := range s.nodes {
+		if view := slices.Sorted(slices.Values(r.getView())); !slices.Equal(view, addrs) {
+			s.fatalf("%s has view %v", r.addr, view)
+		}
+		if shards := r.getShards(); !reflect.DeepEqual(shards, firstShards) || r.getShardCount() != first.getShardCount() {
+			s.fatalf("%s has shards %v, %s has %v", r.addr, shards, first.addr, firstShards)
+		}
+	}
+
+	for shardId, members := range firstShards {
+		var kv map[string]any
+		for _, addr := range members {
+			r := s.nodes[slices.Index(s.addrs(), addr)]
+			r.kvLock.RLock()
+			got := maps.Clone(r.kv)
+			r.kvLock.RUnlock()
+			for key := range got {
+				if owner := findShard(key, firstShards); owner != shardId {
+					s.fatalf("%s of shard %s has %s, owned by shard %s", addr, shardId, key, owner)
+				}
+			}
+			if kv == nil {
+				kv = got
+			} else if !reflect.DeepEqual(got, kv) {
+				s.fatalf("replicas of shard %s diverged: %s has %v, %s has %v", shardId, members[0], kv, addr, got)
+			}
+		}
+	}
+
+	if v := checkCausal(h.Ops()); v != nil {
+		s.fatalf("%v", v)
+	}
+}
+
+// simSeeds returns the seeds to simulate
+func simSeeds() []int64 {
+	if *simSeed != 0 {
+		return []int64{*simSeed}
+	}
+	return []int64{1, 2, 3, 4, 5}
+}
+
+// Test_Simulation runs randomized workloads on simulated clusters. A failing
+// seed can be replayed with -sim.seed.
+func Test_Simulation(t *testing.T) {
+	for _, seed := range simSeeds() {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				s := newSimulation(t, seed, 6, 2)
+				defer s.close()
+				s.check(s.simulate(3, 4, 10))
+			})
+		})
+	}
+}
+
+// Check that simulations replay exactly from their seeds
+func Test_SimulationReplays(t *testing.T) {
+	for _, seed := range simSeeds() {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			traces := make([][]string, 2)
+			for i := range traces {
+				synctest.Test(t, func(t *testing.T) {
+					s := newSimulation(t, seed, 6, 2)
+					defer s.close()
+					s.simulate(3, 4, 10)
+					traces[i] = s.trace
+				})
+			}
+			for i := range min(len(traces[0]), len(traces[1])) {
+				if traces[0][i] != traces[1][i] {
+					t.Fatalf("runs diverged at delivery %d: %q != %q", i, traces[0][i], traces[1][i])
+				}
+			}
+			if len(traces[0]) != len(traces[1]) {
+				t.Fatalf("runs made %d and %d deliveries", len(traces[0]), len(traces[1]))
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// snapshotRounds bounds how many times the shards are read while looking
+	// for a cut they can all serve
+	snapshotRounds  = 10
+	snapshotBackoff = 50 * time.Millisecond
+)
+
+type SnapshotRequest struct {
+	Keys           []string    `json:"keys"`
+	CausalMetadata VectorClock `json:"causal-metadata"`
+}
+
+type SnapshotResponse struct {
+	Values         map[string]any `json:"values"`
+	CausalMetadata VectorClock    `json:"causal-metadata"`
+}
+
+// SnapshotValue is the state of a key along with the clock of the write that
+// produced it
+type SnapshotValue struct {
+	Value  any         `json:"value,omitempty"`
+	Exists bool        `json:"exists"`
+	Clock  VectorClock `json:"clock"`
+}
+
+// SnapshotPart is the state of the keys of one shard, read at the clock Vc
+type SnapshotPart struct {
+	Values map[string]SnapshotValue `json:"values"`
+	Vc     VectorClock              `json:"vc"`
+}
+
+// snapshotCut returns the smallest cut containing the client's causal past and
+// every value read, along with the shards that can't serve it. A shard can
+// serve the cut if it had applied every write of the cut coordinated by its
+// members when it was read: the value of each of its keys is then the latest
+// one within the cut.
+func snapshotCut(clientClock VectorClock, parts map[string]SnapshotPart, shards map[string][]string) (VectorClock, []string) {
+	cut := CloneVC(clientClock)
+	for _, part := range parts {
+		for _, v := range part.Values {
+			for client, entry := range v.Clock.Clocks {
+				if entry > cut.Clocks[client] {
+					cut.Clocks[client] = entry
+				}
+			}
+		}
+	}
+
+	var stale []string
+	for shardId, part := range parts {
+		if shardCut := restrictVC(cut, shards[shardId]); part.Vc.Compare(&shardCut) < 0 {
+			stale = append(stale, shardId)
+		}
+	}
+	return cut, stale
+}
+
+// readSnapshotPart reads keys from the first member of the shard that responds,
+// preferring the member that was read before so that its clock only moves
+// forward
+func (r *Replica) readSnapshotPart(shardId string, keys []string, preferred string) (string, SnapshotPart, error) {
+	members := r.getShards()[shardId]
+	if preferred != "" {
+		members = append([]string{preferred}, FilterViews(members, preferred)...)
+	}
+	for _, member := range members {
+		var part SnapshotPart
+		if err := postJSON(r.transport, member, "/txn/snapshot", SnapshotRequest{Keys: keys}, &part); err != nil {
+			continue
+		}
+		return member, part, nil
+	}
+	return "", SnapshotPart{}, fmt.Errorf("no member of shard %s is reachable", shardId)
+}
+
+// handleSnapshotRead is a read-only transaction: it returns the values of a set
+// of keys, possibly owned by different shards, as of a single causally
+// consistent cut. Every shard is read along with its clock and the clocks of
+// the writes that produced the values. Shards whose clock doesn't cover the
+// resulting cut are read again, until every shard was read at a clock
+// covering the cut.
+func (r *Replica) handleSnapshotRead(c echo.Context) error {
+	request := new(SnapshotRequest)
+	if err := c.Bind(request); err != nil || len(request.Keys) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "snapshot read must specify keys"})
+	}
+
+	clientClock := GetClientVectorClock(&Request{CausalMetadata: request.CausalMetadata})
+
+	keys := make(map[string][]string)
+	for _, k := range request.Keys {
+		if len(k) > 50 {
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: "Key is too long"})
+		}
+		if r.isStronglyConsistent(k) {
+			return c.JSON(http.StatusBadRequest, ErrResponse{Error: fmt.Sprintf("key %s isn't causally consistent", k)})
+		}
+		shardId := findShard(k, r.getShards())
+		keys[shardId] = append(keys[shardId], k)
+	}
+
+	parts := make(map[string]SnapshotPart)
+	members := make(map[string]string)
+	stale := make([]string, 0, len(keys))
+	for shardId := range keys {
+		stale = append(stale, shardId)
+	}
+	for round := 0; round < snapshotRounds; round++ {
+		for _, shardId := range stale {
+			member, part, err := r.readSnapshotPart(shardId, keys[shardId], members[shardId])
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, ErrResponse{Error: err.Error()})
+			}
+			members[shardId], parts[shardId] = member, part
+		}
+
+		var cut VectorClock
+		cut, stale = snapshotCut(clientClock, parts, r.getShards())
+		if len(stale) == 0 {
+			values := make(map[string]any)
+			for _, part := range parts {
+				for k, v := range part.Values {
+					if v.Exists {
+						values[k] = v.Value
+					}
+				}
+			}
+			return c.JSON(http.StatusOK, SnapshotResponse{Values: values, CausalMetadata: cut})
+		}
+		zap.L().Debug("Snapshot cut not served by every shard", zap.Int("round", round), zap.Strings("stale", stale))
+		time.Sleep(snapshotBackoff)
+	}
+	return c.JSON(
+		http.StatusServiceUnavailable,
+		ErrResponse{Error: "Couldn't find a consistent snapshot; try again later"},
+	)
+}
+
+// handleSnapshotPart returns the state of the requested keys of this replica
+// along with its clock
+func (r *Replica) handleSnapshotPart(c echo.Context) error {
+	request := new(SnapshotRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+
+	part := SnapshotPart{Values: make(map[string]SnapshotValue)}
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	for _, k := range request.Keys {
+		v, ok := r.kv[k]
+		latest, _ := r.latestVersion(k)
+		part.Values[k] = SnapshotValue{Value: v, Exists: ok, Clock: latest.Clock}
+	}
+	r.vcLock.Lock()
+	part.Vc = CloneVC(*r.vc)
+	r.vcLock.Unlock()
+	return c.JSON(http.StatusOK, part)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func vcOf(clocks map[string]int) VectorClock {
+	return VectorClock{Clocks: clocks}
+}
+
+func Test_SnapshotCut(t *testing.T) {
+	shards := map[string][]string{"s0": {"a1", "a2"}, "s1": {"b1", "b2"}}
+	client := vcOf(map[string]int{"a1": 1})
+	parts := map[string]SnapshotPart{
+		"s0": {
+			Values: map[string]SnapshotValue{"a": {Value: 1, Exists: true, Clock: vcOf(map[string]int{"a1": 1})}},
+			Vc:     vcOf(map[string]int{"a1": 1, "a2": 2}),
+		},
+		"s1": {
+			Values: map[string]SnapshotValue{"b": {Exists: false}},
+			Vc:     vcOf(map[string]int{"b1": 1}),
+		},
+	}
+	cut, stale := snapshotCut(client, parts, shards)
+	assert.Equal(t, map[string]int{"a1": 1}, cut.Clocks)
+	assert.Empty(t, stale)
+
+	// s0's value was written by a client that had read the second write of
+	// b1, which s1 hasn't applied. s0 doesn't track the writes of s1.
+	parts["s0"] = SnapshotPart{
+		Values: map[string]SnapshotValue{"a": {Value: 2, Exists: true, Clock: vcOf(map[string]int{"a1": 2, "b1": 2})}},
+		Vc:     vcOf(map[string]int{"a1": 2, "a2": 2}),
+	}
+	cut, stale = snapshotCut(client, parts, shards)
+	assert.Equal(t, map[string]int{"a1": 2, "b1": 2}, cut.Clocks)
+	assert.Equal(t, []string{"s1"}, stale)
+}
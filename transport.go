@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Transport carries the requests a replica sends to other replicas
+type Transport interface {
+	Send(r HttpRequest) (*http.Response, error)
+}
+
+// replicaHeader names the replica that sent a request
+const replicaHeader = "X-Replica"
+
+// senderTransport names the replica sending the requests it carries, so that
+// their targets can tell replicas apart from clients, and sets their timeouts
+// from the timeouts of their operation
+type senderTransport struct {
+	from     string
+	timeouts Timeouts
+	next     Transport
+}
+
+func (t senderTransport) Send(r HttpRequest) (*http.Response, error) {
+	r.from = t.from
+	if r.timeout == 0 {
+		r.timeout = t.timeouts.For(r.op)
+	}
+	return t.next.Send(r)
+}
+
+var (
+	ErrPartitioned = errors.New("replicas are partitioned")
+	ErrDropped     = errors.New("request dropped")
+	ErrTimedOut    = errors.New("request timed out")
+)
+
+// reorderWindow is how long a reordered request waits for the next request on
+// its link before it's sent anyway
+const reorderWindow = 50 * time.Millisecond
+
+// Faults are the faults a FaultNetwork injects into requests. Rates are
+// probabilities between 0 and 1. Every request is delayed by Delay plus a
+// random duration up to Jitter; requests delayed past their timeout still
+// arrive, but their sender gives up on them.
+type Faults struct {
+	DropRate      float64
+	DuplicateRate float64
+	// ReorderRate is the probability that a request is held back until the
+	// next request between the same replicas has been sent
+	ReorderRate float64
+	Delay       time.Duration
+	Jitter      time.Duration
+}
+
+type FaultStats struct {
+	Sent        int `json:"sent"`
+	Dropped     int `json:"dropped"`
+	Duplicated  int `json:"duplicated"`
+	Reordered   int `json:"reordered"`
+	Partitioned int `json:"partitioned"`
+}
+
+type link struct {
+	from, to string
+}
+
+// LinkFaults are the faults injected into the requests from one replica to
+// another, on top of the faults of the network
+type LinkFaults struct {
+	Drop  bool
+	Delay time.Duration
+}
+
+// FaultNetwork injects faults into the requests sent through the transports
+// it wraps, and partitions replicas from each other. Faults are drawn from a
+// seeded source so that the faults of a run can be reproduced.
+type FaultNetwork struct {
+	lock   sync.Mutex
+	rng    *rand.Rand
+	faults Faults
+	links  map[link]LinkFaults
+	// held are the reordered requests waiting for the next request on their
+	// link
+	held  map[link]chan struct{}
+	stats FaultStats
+}
+
+func NewFaultNetwork(seed int64) *FaultNetwork {
+	return &FaultNetwork{
+		rng:   rand.New(rand.NewSource(seed)),
+		links: make(map[link]LinkFaults),
+		held:  make(map[link]chan struct{}),
+	}
+}
+
+// SetFaults replaces the faults injected into requests
+func (n *FaultNetwork) SetFaults(f Faults) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.faults = f
+}
+
+func (n *FaultNetwork) Faults() Faults {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.faults
+}
+
+// Partition stops the replicas of different groups from reaching each other,
+// in both directions. Partitions add up until Heal is called.
+func (n *FaultNetwork) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i, g := range groups {
+		for _, h := range groups[i+1:] {
+			for _, a := range g {
+				for _, b := range h {
+					n.setDrop(link{a, b})
+					n.setDrop(link{b, a})
+				}
+			}
+		}
+	}
+}
+
+// setDrop drops the requests on l. The caller must hold n.lock.
+func (n *FaultNetwork) setDrop(l link) {
+	f := n.links[l]
+	f.Drop = true
+	n.links[l] = f
+}
+
+// Heal removes every partition and the faults of every link
+func (n *FaultNetwork) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	clear(n.links)
+}
+
+// Partitioned returns the replicas from cannot reach
+func (n *FaultNetwork) Partitioned(from string) []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var to []string
+	for l, f := range n.links {
+		if l.from == from && f.Drop {
+			to = append(to, l.to)
+		}
+	}
+	slices.Sort(to)
+	return to
+}
+
+// SetLink replaces the faults of the requests from one replica to another
+func (n *FaultNetwork) SetLink(from string, to string, f LinkFaults) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if f == (LinkFaults{}) {
+		delete(n.links, link{from, to})
+		return
+	}
+	n.links[link{from, to}] = f
+}
+
+func (n *FaultNetwork) Link(from string, to string) LinkFaults {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.links[link{from, to}]
+}
+
+// Links returns the faults of every link that has some, by sender and target
+func (n *FaultNetwork) Links() map[string]map[string]LinkFaults {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	links := make(map[string]map[string]LinkFaults)
+	for l, f := range n.links {
+		if links[l.from] == nil {
+			links[l.from] = make(map[string]LinkFaults)
+		}
+		links[l.from][l.to] = f
+	}
+	return links
+}
+
+func (n *FaultNetwork) Stats() FaultStats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stats
+}
+
+// Wrap returns a transport that sends the requests of the replica at from
+// through t, injecting the faults of the network
+func (n *FaultNetwork) Wrap(from string, t Transport) Transport {
+	return &faultyTransport{network: n, from: from, next: t}
+}
+
+// roll returns true with probability p. The caller must hold n.lock.
+func (n *FaultNetwork) roll(p float64) bool {
+	return p > 0 && n.rng.Float64() < p
+}
+
+type faultyTransport struct {
+	network *FaultNetwork
+	from    string
+	next    Transport
+}
+
+func (t *faultyTransport) Send(r HttpRequest) (*http.Response, error) {
+	n := t.network
+	l := link{t.from, r.addr}
+
+	n.lock.Lock()
+	n.stats.Sent++
+	blocked := n.links[l].Drop
+	drop := n.roll(n.faults.DropRate)
+	duplicate := n.roll(n.faults.DuplicateRate)
+	delay := n.faults.Delay + n.links[l].Delay
+	if n.faults.Jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(n.faults.Jitter)))
+	}
+	// A request is either held back for the next one, or releases the one
+	// held back on its link
+	var hold, release chan struct{}
+	if _, ok := n.held[l]; !ok && n.roll(n.faults.ReorderRate) {
+		hold = make(chan struct{})
+		n.held[l] = hold
+		n.stats.Reordered++
+	} else if ch, ok := n.held[l]; ok {
+		release = ch
+		delete(n.held, l)
+	}
+	switch {
+	case blocked:
+		n.stats.Partitioned++
+	case drop:
+		n.stats.Dropped++
+	case duplicate:
+		n.stats.Duplicated++
+	}
+	n.lock.Unlock()
+
+	if release != nil {
+		defer close(release)
+	}
+	if blocked {
+		return nil, ErrPartitioned
+	}
+	if drop {
+		zap.L().Debug("Dropping request", zap.String("from", t.from), zap.String("to", r.addr), zap.String("endpoint", r.endpoint))
+		return nil, ErrDropped
+	}
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-time.After(reorderWindow):
+			n.lock.Lock()
+			if n.held[l] == hold {
+				delete(n.held, l)
+			}
+			n.lock.Unlock()
+		}
+	}
+
+	timeout := r.timeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	if delay >= timeout {
+		// The request arrives after its sender gave up on it
+		go func() {
+			time.Sleep(delay)
+			if res, err := t.next.Send(r); err == nil {
+				res.Body.Close()
+			}
+		}()
+		time.Sleep(timeout)
+		return nil, ErrTimedOut
+	}
+	time.Sleep(delay)
+	r.timeout = timeout - delay
+
+	res, err := t.next.Send(r)
+	if duplicate {
+		if dup, err := t.next.Send(r); err == nil {
+			dup.Body.Close()
+		}
+	}
+	return res, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTransport answers every request with 200 and records the endpoints
+// it was sent
+type recordingTransport struct {
+	lock      sync.Mutex
+	endpoints []string
+}
+
+func (t *recordingTransport) Send(r HttpRequest) (*http.Response, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.endpoints = append(t.endpoints, r.endpoint)
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (t *recordingTransport) sent() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return slices.Clone(t.endpoints)
+}
+
+func send(t Transport, to string, endpoint string) error {
+	res, err := t.Send(HttpRequest{method: http.MethodPut, endpoint: endpoint, addr: to})
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+func Test_FaultNetworkPartition(t *testing.T) {
+	n := NewFaultNetwork(1)
+	next := &recordingTransport{}
+	a, b, c := n.Wrap("a", next), n.Wrap("b", next), n.Wrap("c", next)
+
+	n.Partition([]string{"a"}, []string{"b", "c"})
+	assert.ErrorIs(t, send(a, "b", "/ab"), ErrPartitioned)
+	assert.ErrorIs(t, send(c, "a", "/ca"), ErrPartitioned)
+	assert.NoError(t, send(b, "c", "/bc"))
+	assert.Equal(t, []string{"b", "c"}, n.Partitioned("a"))
+	assert.Equal(t, []string{"a"}, n.Partitioned("b"))
+
+	n.Heal()
+	assert.NoError(t, send(a, "b", "/ab"))
+	assert.Empty(t, n.Partitioned("a"))
+	assert.Equal(t, []string{"/bc", "/ab"}, next.sent())
+	assert.Equal(t, FaultStats{Sent: 4, Partitioned: 2}, n.Stats())
+}
+
+func Test_FaultNetworkDropAndDuplicate(t *testing.T) {
+	n := NewFaultNetwork(1)
+	next := &recordingTransport{}
+	a := n.Wrap("a", next)
+
+	n.SetFaults(Faults{DropRate: 1})
+	assert.ErrorIs(t, send(a, "b", "/dropped"), ErrDropped)
+	n.SetFaults(Faults{DuplicateRate: 1})
+	assert.NoError(t, send(a, "b", "/duplicated"))
+
+	assert.Equal(t, []string{"/duplicated", "/duplicated"}, next.sent())
+	assert.Equal(t, FaultStats{Sent: 2, Dropped: 1, Duplicated: 1}, n.Stats())
+}
+
+// Check that a reordered request is sent after the next request on its link,
+// and only waits for requests on its link
+func Test_FaultNetworkReorder(t *testing.T) {
+	n := NewFaultNetwork(1)
+	next := &recordingTransport{}
+	a := n.Wrap("a", next)
+	n.SetFaults(Faults{ReorderRate: 1})
+
+	done := make(chan error)
+	go func() { done <- send(a, "b", "/first") }()
+	assert.Eventually(t, func() bool { return n.Stats().Reordered == 1 }, time.Second, time.Millisecond)
+	n.SetFaults(Faults{})
+	assert.NoError(t, send(a, "c", "/other"))
+	assert.NoError(t, send(a, "b", "/second"))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"/other", "/second", "/first"}, next.sent())
+
+	// Without a next request, the held request goes out after reorderWindow
+	n.SetFaults(Faults{ReorderRate: 1})
+	start := time.Now()
+	assert.NoError(t, send(a, "b", "/alone"))
+	assert.GreaterOrEqual(t, time.Since(start), reorderWindow)
+}
+
+// Check that requests delayed past their timeout fail but still arrive
+func Test_FaultNetworkDelay(t *testing.T) {
+	n := NewFaultNetwork(1)
+	next := &recordingTransport{}
+	a := n.Wrap("a", next)
+	n.SetFaults(Faults{Delay: 30 * time.Millisecond})
+
+	_, err := a.Send(HttpRequest{method: http.MethodPut, endpoint: "/late", addr: "b", timeout: 10 * time.Millisecond})
+	assert.ErrorIs(t, err, ErrTimedOut)
+	assert.Empty(t, next.sent())
+	assert.Eventually(t, func() bool { return len(next.sent()) == 1 }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, send(a, "b", "/slow"))
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+}
+
+// Check that networks with the same seed inject the same faults
+func Test_FaultNetworkSeed(t *testing.T) {
+	outcomes := func(seed int64) []error {
+		n := NewFaultNetwork(seed)
+		n.SetFaults(Faults{DropRate: 0.5})
+		a := n.Wrap("a", &recordingTransport{})
+		var errs []error
+		for i := 0; i < 20; i++ {
+			errs = append(errs, send(a, "b", "/"))
+		}
+		return errs
+	}
+	assert.Equal(t, outcomes(7), outcomes(7))
+	assert.NotEqual(t, outcomes(7), outcomes(8))
+}
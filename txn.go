@@ -0,0 +1,857 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// txnTimeout is how long a transaction may stay undecided before its
+	// coordinator aborts it and its participants ask for the outcome
+	txnTimeout          = 5 * time.Second
+	txnRecoveryInterval = time.Second
+	// txnOutcomeTTL is how long participants remember the outcome of a
+	// transaction for the other participants recovering from a failure
+	txnOutcomeTTL = time.Hour
+)
+
+type TxnStatus string
+
+const (
+	TxnPending   TxnStatus = "pending"
+	TxnPrepared  TxnStatus = "prepared"
+	TxnCommitted TxnStatus = "committed"
+	TxnAborted   TxnStatus = "aborted"
+)
+
+var errTxnNotReady = errors.New("causal dependencies not satisfied")
+
+type TxnRequest struct {
+	Reads          []string       `json:"reads"`
+	Writes         map[string]any `json:"writes"`
+	Deletes        []string       `json:"deletes"`
+	CausalMetadata VectorClock    `json:"causal-metadata"`
+}
+
+type TxnResponse struct {
+	Result         string         `json:"result"`
+	Id             string         `json:"txn-id"`
+	Values         map[string]any `json:"values,omitempty"`
+	CausalMetadata VectorClock    `json:"causal-metadata"`
+}
+
+// TxnPart is the share of a transaction executed by a single shard
+type TxnPart struct {
+	Id          string `json:"txn-id"`
+	Coordinator string `json:"coordinator"`
+	// Participants are the members of every shard taking part in the
+	// transaction, which are asked for its outcome if the coordinator fails
+	Participants []string       `json:"participants"`
+	Reads        []string       `json:"reads,omitempty"`
+	Writes       map[string]any `json:"writes,omitempty"`
+	Deletes      []string       `json:"deletes,omitempty"`
+	// Contexts are the version vectors of the written keys at the replica
+	// that committed the part, whose siblings the writes supersede
+	Contexts       map[string]map[string]int `json:"contexts,omitempty"`
+	CausalMetadata VectorClock               `json:"causal-metadata"`
+	PreparedAt     time.Time                 `json:"prepared-at"`
+}
+
+// keys returns the keys the part reads or writes
+func (p *TxnPart) keys() []string {
+	keys := append([]string(nil), p.Reads...)
+	for k := range p.Writes {
+		keys = append(keys, k)
+	}
+	return append(keys, p.Deletes...)
+}
+
+type TxnVote struct {
+	Commit bool           `json:"commit"`
+	Reason string         `json:"reason,omitempty"`
+	Values map[string]any `json:"values,omitempty"`
+	Vc     VectorClock    `json:"vc"`
+}
+
+type TxnDecision struct {
+	Id string `json:"txn-id"`
+}
+
+// TxnAck acknowledges a decision. Participants acknowledging a commit return
+// the clock of the write that applied their part.
+type TxnAck struct {
+	Result         string      `json:"result"`
+	CausalMetadata VectorClock `json:"causal-metadata"`
+}
+
+type TxnStatusResponse struct {
+	Id     string    `json:"txn-id"`
+	Status TxnStatus `json:"status"`
+}
+
+// TxnRecord is the coordinator's record of a transaction. Pending lists the
+// participants that haven't acknowledged the decision yet.
+type TxnRecord struct {
+	Id           string    `json:"txn-id"`
+	Status       TxnStatus `json:"status"`
+	Participants []string  `json:"participants"`
+	Pending      []string  `json:"pending"`
+	CreatedAt    time.Time `json:"created-at"`
+}
+
+type TxnOutcome struct {
+	Status TxnStatus `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// TxnLog persists the transactions a replica coordinates or takes part in,
+// along with the locks held by prepared transactions
+type TxnLog struct {
+	lock        sync.Mutex
+	path        string
+	NextId      uint64                `json:"next-id"`
+	Coordinated map[string]*TxnRecord `json:"coordinated"`
+	Prepared    map[string]*TxnPart   `json:"prepared"`
+	// Held are the parts prepared by another member of the shard, whose
+	// keys this replica keeps locked until the participant resolves them
+	Held     map[string]*TxnPart   `json:"held"`
+	Outcomes map[string]TxnOutcome `json:"outcomes"`
+	// locks maps locked keys to the transaction holding them
+	locks map[string]string
+}
+
+func NewTxnLog(dataDir string) *TxnLog {
+	tl := &TxnLog{path: filepath.Join(dataDir, "txns.json")}
+	if err := loadJSON(tl.path, tl); err != nil {
+		zap.L().Error("Couldn't load transactions", zap.String("path", tl.path), zap.Error(err))
+	}
+	if tl.Coordinated == nil {
+		tl.Coordinated = make(map[string]*TxnRecord)
+	}
+	if tl.Prepared == nil {
+		tl.Prepared = make(map[string]*TxnPart)
+	}
+	if tl.Held == nil {
+		tl.Held = make(map[string]*TxnPart)
+	}
+	if tl.Outcomes == nil {
+		tl.Outcomes = make(map[string]TxnOutcome)
+	}
+	tl.locks = make(map[string]string)
+	for _, parts := range []map[string]*TxnPart{tl.Prepared, tl.Held} {
+		for id, part := range parts {
+			for _, k := range part.keys() {
+				tl.locks[k] = id
+			}
+		}
+	}
+	return tl
+}
+
+// save persists the log. The caller must hold tl.lock.
+func (tl *TxnLog) save() {
+	if err := saveJSON(tl.path, tl); err != nil {
+		zap.L().Error("Couldn't persist transactions", zap.String("path", tl.path), zap.Error(err))
+	}
+}
+
+// IsLocked returns whether key is locked by a prepared transaction
+func (tl *TxnLog) IsLocked(key string) bool {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	_, ok := tl.locks[key]
+	return ok
+}
+
+// Begin records a new transaction coordinated by addr and returns its id
+func (tl *TxnLog) Begin(addr string) string {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	tl.NextId++
+	id := fmt.Sprintf("%s-%d", addr, tl.NextId)
+	tl.Coordinated[id] = &TxnRecord{Id: id, Status: TxnPending, CreatedAt: time.Now()}
+	tl.save()
+	return id
+}
+
+// Decide records the outcome of a pending transaction and returns the
+// outcome, which is the one recorded before if the transaction was already
+// decided
+func (tl *TxnLog) Decide(id string, status TxnStatus, participants []string) TxnStatus {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	rec, ok := tl.Coordinated[id]
+	if !ok {
+		return TxnAborted
+	}
+	if rec.Status == TxnPending {
+		rec.Status = status
+	}
+	for _, p := range participants {
+		if !slices.Contains(rec.Participants, p) {
+			rec.Participants = append(rec.Participants, p)
+			rec.Pending = append(rec.Pending, p)
+		}
+	}
+	status = rec.Status
+	tl.forgetIfDone(rec)
+	tl.save()
+	return status
+}
+
+// forgetIfDone replaces the record of a transaction whose decision reached
+// every participant by its outcome. The caller must hold tl.lock.
+func (tl *TxnLog) forgetIfDone(rec *TxnRecord) {
+	if len(rec.Pending) == 0 && rec.Status != TxnPending {
+		delete(tl.Coordinated, rec.Id)
+		tl.Outcomes[rec.Id] = TxnOutcome{Status: rec.Status, At: time.Now()}
+	}
+}
+
+// Acknowledge removes a participant that learned the decision, and forgets
+// the transaction once every participant did
+func (tl *TxnLog) Acknowledge(id string, participant string) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	rec, ok := tl.Coordinated[id]
+	if !ok {
+		return
+	}
+	rec.Pending = FilterViews(rec.Pending, participant)
+	tl.forgetIfDone(rec)
+	tl.save()
+}
+
+// Status returns what the replica knows about a transaction. Transactions
+// this replica coordinates that stayed undecided for too long are aborted, so
+// that their participants can release their locks.
+func (tl *TxnLog) Status(id string) (TxnStatus, bool) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if rec, ok := tl.Coordinated[id]; ok {
+		if rec.Status == TxnPending && time.Since(rec.CreatedAt) > txnTimeout {
+			rec.Status = TxnAborted
+			tl.save()
+		}
+		return rec.Status, true
+	}
+	if _, ok := tl.Prepared[id]; ok {
+		return TxnPrepared, true
+	}
+	if outcome, ok := tl.Outcomes[id]; ok {
+		return outcome.Status, true
+	}
+	return "", false
+}
+
+// Prepare locks the keys of part. It fails without locking any key if one of
+// them is locked by another transaction.
+func (tl *TxnLog) Prepare(part *TxnPart) bool {
+	return tl.lockPart(tl.Prepared, part)
+}
+
+// Hold locks the keys of a part prepared by another member of the shard, so
+// that the writes this replica coordinates don't interleave with the
+// transaction. It fails like Prepare.
+func (tl *TxnLog) Hold(part *TxnPart) bool {
+	return tl.lockPart(tl.Held, part)
+}
+
+// lockPart locks the keys of part and records it in parts
+func (tl *TxnLog) lockPart(parts map[string]*TxnPart, part *TxnPart) bool {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if _, ok := parts[part.Id]; ok {
+		return true
+	}
+	for _, k := range part.keys() {
+		if holder, ok := tl.locks[k]; ok && holder != part.Id {
+			return false
+		}
+	}
+	for _, k := range part.keys() {
+		tl.locks[k] = part.Id
+	}
+	part.PreparedAt = time.Now()
+	parts[part.Id] = part
+	tl.save()
+	return true
+}
+
+// unlockPart releases the locks of part. The caller must hold tl.lock.
+func (tl *TxnLog) unlockPart(part *TxnPart) {
+	for _, k := range part.keys() {
+		if tl.locks[k] == part.Id {
+			delete(tl.locks, k)
+		}
+	}
+}
+
+// Resolve releases the locks of a prepared transaction and records its
+// outcome. apply is called with the part before the locks are released if the
+// part was still prepared. It returns whether the part was still prepared.
+func (tl *TxnLog) Resolve(id string, status TxnStatus, apply func(*TxnPart)) bool {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	part, ok := tl.Prepared[id]
+	if !ok {
+		return false
+	}
+	if apply != nil {
+		apply(part)
+	}
+	tl.unlockPart(part)
+	delete(tl.Prepared, id)
+	tl.Outcomes[id] = TxnOutcome{Status: status, At: time.Now()}
+	tl.save()
+	return true
+}
+
+// Release releases the locks held for a part prepared by another member of
+// the shard
+func (tl *TxnLog) Release(id string) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	part, ok := tl.Held[id]
+	if !ok {
+		return
+	}
+	tl.unlockPart(part)
+	delete(tl.Held, id)
+	tl.save()
+}
+
+// Unresolved returns the coordinated transactions whose decision isn't known
+// to every participant, and the parts prepared before cutoff
+func (tl *TxnLog) Unresolved(cutoff time.Time) ([]TxnRecord, []TxnPart) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	var records []TxnRecord
+	for _, rec := range tl.Coordinated {
+		if rec.Status == TxnPending && rec.CreatedAt.Before(cutoff) {
+			rec.Status = TxnAborted
+			tl.forgetIfDone(rec)
+			tl.save()
+		}
+		if rec.Status != TxnPending && len(rec.Pending) > 0 {
+			records = append(records, *rec)
+		}
+	}
+	var parts []TxnPart
+	for _, part := range tl.Prepared {
+		if part.PreparedAt.Before(cutoff) {
+			parts = append(parts, *part)
+		}
+	}
+	return records, parts
+}
+
+// HeldBefore returns the parts held since before cutoff
+func (tl *TxnLog) HeldBefore(cutoff time.Time) []TxnPart {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	var parts []TxnPart
+	for _, part := range tl.Held {
+		if part.PreparedAt.Before(cutoff) {
+			parts = append(parts, *part)
+		}
+	}
+	return parts
+}
+
+// Expire forgets outcomes older than txnOutcomeTTL
+func (tl *TxnLog) Expire() {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	for id, outcome := range tl.Outcomes {
+		if time.Since(outcome.At) > txnOutcomeTTL {
+			delete(tl.Outcomes, id)
+		}
+	}
+}
+
+// splitTxn groups the keys of a transaction by the shard that owns them
+func (r *Replica) splitTxn(request *TxnRequest) (map[string]*TxnPart, error) {
+	parts := make(map[string]*TxnPart)
+	part := func(key string) (*TxnPart, error) {
+		if len(key) > 50 {
+			return nil, fmt.Errorf("key %s is too long", key)
+		}
+		if r.isStronglyConsistent(key) {
+			return nil, fmt.Errorf("key %s isn't causally consistent", key)
+		}
+		shardId := findShard(key, r.getShards())
+		if _, ok := parts[shardId]; !ok {
+			parts[shardId] = &TxnPart{Writes: make(map[string]any)}
+		}
+		return parts[shardId], nil
+	}
+
+	for _, k := range request.Reads {
+		p, err := part(k)
+		if err != nil {
+			return nil, err
+		}
+		p.Reads = append(p.Reads, k)
+	}
+	for k, v := range request.Writes {
+		p, err := part(k)
+		if err != nil {
+			return nil, err
+		}
+		p.Writes[k] = v
+	}
+	for _, k := range request.Deletes {
+		if _, ok := request.Writes[k]; ok {
+			return nil, fmt.Errorf("key %s is both written and deleted", k)
+		}
+		p, err := part(k)
+		if err != nil {
+			return nil, err
+		}
+		p.Deletes = append(p.Deletes, k)
+	}
+	return parts, nil
+}
+
+// prepareTxnPart sends part to the first reachable member of the shard, which
+// becomes the shard's participant in the transaction
+func (r *Replica) prepareTxnPart(shardId string, part *TxnPart) (string, TxnVote, error) {
+	for _, member := range r.getShards()[shardId] {
+		var vote TxnVote
+		if err := postJSON(r.transport, member, "/txn/prepare", part, &vote); err != nil {
+			continue
+		}
+		return member, vote, nil
+	}
+	return "", TxnVote{}, fmt.Errorf("no member of shard %s is reachable", shardId)
+}
+
+// finishTxn sends the decision of a transaction to the participants that
+// haven't acknowledged it yet, and returns the entry-wise maximum of the
+// clocks they acknowledged it with
+func (r *Replica) finishTxn(rec TxnRecord) VectorClock {
+	endpoint := "/txn/abort"
+	if rec.Status == TxnCommitted {
+		endpoint = "/txn/commit"
+	}
+	var (
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		clock = VectorClock{Clocks: make(map[string]int)}
+	)
+	for _, p := range rec.Pending {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			var res TxnAck
+			if err := postJSON(r.transport, p, endpoint, TxnDecision{Id: rec.Id}, &res); err != nil {
+				zap.L().Warn("Couldn't send transaction decision", zap.String("txn-id", rec.Id), zap.String("participant", p), zap.Error(err))
+				return
+			}
+			r.txns.Acknowledge(rec.Id, p)
+			lock.Lock()
+			defer lock.Unlock()
+			for replica, entry := range res.CausalMetadata.Clocks {
+				clock.Clocks[replica] = max(clock.Clocks[replica], entry)
+			}
+		}(p)
+	}
+	wg.Wait()
+	return clock
+}
+
+// handleTxn executes a transaction across the shards owning its keys with two
+// phase commit. The replica receiving the request coordinates the
+// transaction: it records it, asks the first reachable member of every
+// involved shard to lock the keys and vote, and commits only if every shard
+// voted to commit. The decision is recorded before it is sent, so that it
+// survives a restart of the coordinator.
+func (r *Replica) handleTxn(c echo.Context) error {
+	request := new(TxnRequest)
+	if err := c.Bind(request); err != nil || len(request.Reads)+len(request.Writes)+len(request.Deletes) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "transaction must specify reads, writes or deletes"})
+	}
+
+	clientClock := GetClientVectorClock(&Request{CausalMetadata: request.CausalMetadata})
+
+	parts, err := r.splitTxn(request)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	var members []string
+	shards := r.getShards()
+	for shardId := range parts {
+		members = append(members, shards[shardId]...)
+	}
+
+	id := r.txns.Begin(r.addr)
+	type result struct {
+		participant string
+		vote        TxnVote
+		err         error
+	}
+	results := make(chan result, len(parts))
+	for shardId, part := range parts {
+		part.Id = id
+		part.Coordinator = r.addr
+		part.Participants = members
+		part.CausalMetadata = clientClock
+		go func(shardId string, part *TxnPart) {
+			participant, vote, err := r.prepareTxnPart(shardId, part)
+			results <- result{participant, vote, err}
+		}(shardId, part)
+	}
+
+	status := TxnCommitted
+	reason := ""
+	var participants []string
+	values := make(map[string]any)
+	readClock := CloneVC(clientClock)
+	for range parts {
+		res := <-results
+		switch {
+		case res.err != nil:
+			status, reason = TxnAborted, res.err.Error()
+			continue
+		case !res.vote.Commit:
+			status, reason = TxnAborted, res.vote.Reason
+		}
+		participants = append(participants, res.participant)
+		for k, v := range res.vote.Values {
+			values[k] = v
+		}
+		for client, entry := range res.vote.Vc.Clocks {
+			if entry > readClock.Clocks[client] {
+				readClock.Clocks[client] = entry
+			}
+		}
+	}
+
+	status = r.txns.Decide(id, status, participants)
+	writeClock := r.finishTxn(TxnRecord{Id: id, Status: status, Pending: participants})
+	zap.L().Info("Finished transaction", zap.String("txn-id", id), zap.String("status", string(status)), zap.Strings("participants", participants))
+
+	if status != TxnCommitted {
+		if reason == errTxnNotReady.Error() {
+			return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "Causal Dependencies not satisfied; try again later"})
+		}
+		if reason == "" {
+			reason = "timed out"
+		}
+		return c.JSON(http.StatusConflict, ErrResponse{Error: "transaction aborted: " + reason})
+	}
+
+	// Participants that didn't acknowledge the commit are left out of the
+	// clock until they recover it
+	for replica, entry := range writeClock.Clocks {
+		readClock.Clocks[replica] = max(readClock.Clocks[replica], entry)
+	}
+	return c.JSON(http.StatusOK, TxnResponse{Result: "committed", Id: id, Values: values, CausalMetadata: readClock})
+}
+
+// applyTxnPart applies the writes of a committed part as the single write
+// identified by clock. The writes to every key share a dot, numbered by the
+// committing replica's clock.
+func (r *Replica) applyTxnPart(part *TxnPart, clock *VectorClock) {
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+	r.acceptWrite(clock)
+	dot := Dot{Id: "txn:" + clock.Self, Counter: clock.Clocks[clock.Self]}
+	for k, v := range part.Writes {
+		r.applyDVV(k, part.Contexts[k], dot, v, false, *clock)
+	}
+	for _, k := range part.Deletes {
+		if _, ok := r.kv[k]; !ok && r.dvvs[k] == nil {
+			continue
+		}
+		r.applyDVV(k, part.Contexts[k], dot, nil, true, *clock)
+	}
+}
+
+// txnContexts returns the version vectors of the keys written by part. The
+// caller must hold r.kvLock.
+func (r *Replica) txnContexts(part *TxnPart) map[string]map[string]int {
+	contexts := make(map[string]map[string]int)
+	for _, k := range append(slices.Collect(maps.Keys(part.Writes)), part.Deletes...) {
+		if d, ok := r.dvvs[k]; ok {
+			contexts[k] = maps.Clone(d.VV)
+		}
+	}
+	return contexts
+}
+
+func (r *Replica) handleTxnPrepare(c echo.Context) error {
+	part := new(TxnPart)
+	if err := c.Bind(part); err != nil || part.Id == "" {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+
+	unlock := r.lockKeys(part.keys())
+	prepared := r.txns.Prepare(part)
+	unlock()
+	if !prepared {
+		return c.JSON(http.StatusOK, TxnVote{Reason: "conflicting transaction"})
+	}
+	// A part is ready if the replica has seen everything the client has seen
+	if !r.vc.IsReadyFor(restrictVC(part.CausalMetadata, r.shardMembers()), false, &r.vcLock) {
+		r.txns.Resolve(part.Id, TxnAborted, nil)
+		return c.JSON(http.StatusOK, TxnVote{Reason: errTxnNotReady.Error()})
+	}
+	// Writes coordinated by the other members of the shard must wait for the
+	// transaction too
+	peers := FilterViews(r.shardMembers(), r.addr)
+	failed := r.Broadcast(&BroadcastRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/txn/hold",
+		Payload:  part,
+		Targets:  peers,
+		Op:       OpReplication,
+	})
+	if len(failed) > 0 {
+		r.txns.Resolve(part.Id, TxnAborted, nil)
+		r.releaseTxnPart(part.Id, peers)
+		return c.JSON(http.StatusOK, TxnVote{Reason: "couldn't lock every replica of the shard"})
+	}
+
+	vote := TxnVote{Commit: true, Values: make(map[string]any)}
+	r.kvLock.RLock()
+	for _, k := range part.Reads {
+		if v, ok := r.kv[k]; ok {
+			vote.Values[k] = v
+		}
+	}
+	r.kvLock.RUnlock()
+	r.vcLock.Lock()
+	vote.Vc = CloneVC(*r.vc)
+	r.vcLock.Unlock()
+	return c.JSON(http.StatusOK, vote)
+}
+
+// commitTxnPart applies a prepared part as a write coordinated by this
+// replica and replicates it to the rest of the shard. It returns the clock of the write, which is empty if the part
+// has no writes or was already resolved.
+func (r *Replica) commitTxnPart(id string) VectorClock {
+	clock := VectorClock{Clocks: make(map[string]int)}
+	resolved := r.txns.Resolve(id, TxnCommitted, func(part *TxnPart) {
+		if len(part.Writes)+len(part.Deletes) == 0 {
+			return
+		}
+		r.coordLock.Lock()
+		defer r.coordLock.Unlock()
+		clock = r.nextWriteClock(part.CausalMetadata)
+		r.kvLock.RLock()
+		applied := &TxnPart{
+			Id:       part.Id,
+			Writes:   part.Writes,
+			Deletes:  part.Deletes,
+			Contexts: r.txnContexts(part),
+		}
+		r.kvLock.RUnlock()
+		applied.CausalMetadata = CloneVC(clock)
+		r.BufferAtSender(&BufferAtSenderRequest{
+			Method:   http.MethodPut,
+			Endpoint: "/txn/apply",
+			Payload:  applied,
+			Targets:  FilterViews(r.shardMembers(), r.addr),
+		})
+		r.applyTxnPart(applied, &clock)
+		clock.Self = ""
+	})
+	if resolved {
+		r.releaseTxnPart(id, FilterViews(r.shardMembers(), r.addr))
+	}
+	return clock
+}
+
+// abortTxnPart aborts a prepared part and releases the locks held for it by
+// the rest of the shard
+func (r *Replica) abortTxnPart(id string) {
+	if r.txns.Resolve(id, TxnAborted, nil) {
+		r.releaseTxnPart(id, FilterViews(r.shardMembers(), r.addr))
+	}
+}
+
+// releaseTxnPart asks targets to release the locks they hold for a part. The
+// release follows the part's writes to each target.
+func (r *Replica) releaseTxnPart(id string, targets []string) {
+	r.BufferAtSender(&BufferAtSenderRequest{
+		Method:   http.MethodPut,
+		Endpoint: "/txn/release",
+		Payload:  TxnDecision{Id: id},
+		Targets:  targets,
+	})
+}
+
+// handleTxnHold locks the keys of a part prepared by another member of the
+// shard
+func (r *Replica) handleTxnHold(c echo.Context) error {
+	part := new(TxnPart)
+	if err := c.Bind(part); err != nil || part.Id == "" {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	defer r.lockKeys(part.keys())()
+	if !r.txns.Hold(part) {
+		return c.JSON(http.StatusServiceUnavailable, ErrResponse{Error: "conflicting transaction"})
+	}
+	return c.JSON(http.StatusOK, ActionResponse{Result: "held"})
+}
+
+func (r *Replica) handleTxnRelease(c echo.Context) error {
+	d := new(TxnDecision)
+	if err := c.Bind(d); err != nil || d.Id == "" {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	r.txns.Release(d.Id)
+	return c.JSON(http.StatusOK, ActionResponse{Result: "released"})
+}
+
+func (r *Replica) handleTxnCommit(c echo.Context) error {
+	d := new(TxnDecision)
+	if err := c.Bind(d); err != nil || d.Id == "" {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	clock := r.commitTxnPart(d.Id)
+	return c.JSON(http.StatusOK, TxnAck{Result: "committed", CausalMetadata: clock})
+}
+
+func (r *Replica) handleTxnAbort(c echo.Context) error {
+	d := new(TxnDecision)
+	if err := c.Bind(d); err != nil || d.Id == "" {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	r.abortTxnPart(d.Id)
+	return c.JSON(http.StatusOK, TxnAck{Result: "aborted"})
+}
+
+// handleTxnApply applies a committed part replicated by the shard's
+// participant
+func (r *Replica) handleTxnApply(c echo.Context) error {
+	part := new(TxnPart)
+	if err := c.Bind(part); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid data format"})
+	}
+	if r.vc.HasApplied(part.CausalMetadata, &r.vcLock) {
+		return c.JSON(http.StatusOK, ActionResponse{Result: "already applied"})
+	}
+	ready, err := r.waitReady(c, part.CausalMetadata, false)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if !ready {
+		return c.JSON(
+			http.StatusServiceUnavailable,
+			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
+		)
+	}
+	clock := CloneVC(part.CausalMetadata)
+	r.applyTxnPart(part, &clock)
+	return c.JSON(http.StatusOK, ActionResponse{Result: "applied"})
+}
+
+func (r *Replica) handleTxnStatus(c echo.Context) error {
+	id := c.Param("id")
+	status, ok := r.txns.Status(id)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Transaction does not exist"})
+	}
+	return c.JSON(http.StatusOK, TxnStatusResponse{Id: id, Status: status})
+}
+
+// fetchTxnStatus asks addr for the status of a transaction. The status is
+// empty if addr doesn't know about the transaction.
+func (r *Replica) fetchTxnStatus(addr string, id string) (TxnStatus, error) {
+	res, err := r.transport.Send(HttpRequest{
+		method:   http.MethodGet,
+		endpoint: "/txn/" + id,
+		addr:     addr,
+		op:       OpReplication,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	var status TxnStatusResponse
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// txnOutcome asks the coordinator of a part for the outcome of the
+// transaction, and the other participants if the coordinator is unreachable.
+// A coordinator that doesn't know about the transaction never decided to
+// commit it.
+func (r *Replica) txnOutcome(part TxnPart) TxnStatus {
+	status, err := r.fetchTxnStatus(part.Coordinator, part.Id)
+	if err == nil {
+		if status == "" {
+			return TxnAborted
+		}
+		return status
+	}
+	for _, p := range FilterViews(part.Participants, r.addr, part.Coordinator) {
+		status, err := r.fetchTxnStatus(p, part.Id)
+		if err == nil && (status == TxnCommitted || status == TxnAborted) {
+			return status
+		}
+	}
+	return TxnPrepared
+}
+
+// heldTxnResolved returns whether a held part can be released because no
+// member of the shard still has it prepared and its outcome is decided. A
+// member that resolved the part sent its release after its writes, so the
+// release only got lost with the member's outbox.
+func (r *Replica) heldTxnResolved(part TxnPart) bool {
+	for _, peer := range FilterViews(r.shardMembers(), r.addr) {
+		status, err := r.fetchTxnStatus(peer, part.Id)
+		if err != nil || status == TxnPrepared {
+			return false
+		}
+	}
+	return r.txnOutcome(part) != TxnPrepared
+}
+
+// runTxnRecovery periodically finishes the transactions interrupted by a
+// failure. Coordinators resend their decisions to the participants that
+// didn't acknowledge them, and participants whose prepared parts weren't
+// decided in time ask for the outcome.
+func (r *Replica) runTxnRecovery() {
+	for r.sleep(txnRecoveryInterval) {
+		records, parts := r.txns.Unresolved(time.Now().Add(-txnTimeout))
+		for _, rec := range records {
+			r.finishTxn(rec)
+		}
+		for _, part := range parts {
+			switch r.txnOutcome(part) {
+			case TxnCommitted:
+				zap.L().Info("Recovered committed transaction", zap.String("txn-id", part.Id))
+				r.commitTxnPart(part.Id)
+			case TxnAborted:
+				zap.L().Info("Recovered aborted transaction", zap.String("txn-id", part.Id))
+				r.abortTxnPart(part.Id)
+			}
+		}
+		for _, part := range r.txns.HeldBefore(time.Now().Add(-txnTimeout)) {
+			if r.heldTxnResolved(part) {
+				zap.L().Info("Released transaction held too long", zap.String("txn-id", part.Id))
+				r.txns.Release(part.Id)
+			}
+		}
+		r.txns.Expire()
+	}
+}
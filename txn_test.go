@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TxnLogLocks(t *testing.T) {
+	tl := NewTxnLog(t.TempDir())
+
+	assert.True(t, tl.Prepare(&TxnPart{Id: "t1", Reads: []string{"a"}, Writes: map[string]any{"b": 1}}))
+	assert.True(t, tl.IsLocked("a"))
+	assert.True(t, tl.IsLocked("b"))
+
+	// A conflicting transaction locks none of its keys
+	assert.False(t, tl.Prepare(&TxnPart{Id: "t2", Writes: map[string]any{"c": 1, "b": 2}}))
+	assert.False(t, tl.IsLocked("c"))
+
+	applied := false
+	tl.Resolve("t1", TxnCommitted, func(*TxnPart) { applied = true })
+	assert.True(t, applied)
+	assert.False(t, tl.IsLocked("a"))
+	status, ok := tl.Status("t1")
+	assert.True(t, ok)
+	assert.Equal(t, TxnCommitted, status)
+
+	// Parts held for another replica lock their keys until released
+	assert.True(t, tl.Hold(&TxnPart{Id: "t3", Writes: map[string]any{"a": 1}}))
+	assert.False(t, tl.Prepare(&TxnPart{Id: "t4", Reads: []string{"a"}}))
+	tl.Release("t3")
+	assert.False(t, tl.IsLocked("a"))
+}
+
+func Test_TxnLogRecovers(t *testing.T) {
+	dir := t.TempDir()
+	tl := NewTxnLog(dir)
+	id := tl.Begin("a")
+	assert.Equal(t, TxnCommitted, tl.Decide(id, TxnCommitted, []string{"b", "c"}))
+	tl.Acknowledge(id, "b")
+	tl.Prepare(&TxnPart{Id: "x-1", Deletes: []string{"k"}})
+
+	// The decision and the locks survive a restart
+	tl = NewTxnLog(dir)
+	records, parts := tl.Unresolved(time.Now().Add(time.Second))
+	assert.Len(t, records, 1)
+	assert.Equal(t, []string{"c"}, records[0].Pending)
+	assert.Len(t, parts, 1)
+	assert.True(t, tl.IsLocked("k"))
+
+	// Undecided transactions are aborted once they time out
+	id = tl.Begin("a")
+	tl.Coordinated[id].CreatedAt = time.Now().Add(-2 * txnTimeout)
+	status, _ := tl.Status(id)
+	assert.Equal(t, TxnAborted, status)
+	assert.Equal(t, TxnAborted, tl.Decide(id, TxnCommitted, nil))
+}
+
+// Check that a transaction commits writes across shards atomically, returns
+// the values it read, and that its causal metadata lets the client go on
+// writing to every shard involved, including the ones it only read from
+func Test_TxnAcrossShards(t *testing.T) {
+	tc := startCluster(t, 4, 2)
+	addrs := tc.addrs()
+	// Find keys owned by different shards
+	a, b := "k0", ""
+	for i := 1; b == ""; i++ {
+		if k := fmt.Sprintf("k%d", i); tc.owners(k)[0] != tc.owners(a)[0] {
+			b = k
+		}
+	}
+	cl := tc.client()
+	status, err := cl.Put(addrs[tc.owners(b)[0]], b, "old")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+
+	txn := func(req TxnRequest) (TxnResponse, int) {
+		req.CausalMetadata = cl.clock
+		var res TxnResponse
+		status, err := tc.do(http.MethodPost, addrs[0], "/txn", req, &res)
+		assert.NoError(t, err)
+		if status == http.StatusOK {
+			cl.clock = res.CausalMetadata
+		}
+		return res, status
+	}
+
+	// b's shard only takes part in the transaction as a reader
+	res, status := txn(TxnRequest{Reads: []string{b}, Writes: map[string]any{a: "1"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "committed", res.Result)
+	assert.Equal(t, map[string]any{b: "old"}, res.Values)
+	for _, i := range tc.owners(a) {
+		tc.eventually(func() bool { return tc.kv(i)[a] == "1" }, "replica %d didn't apply the transaction", i)
+	}
+	for _, k := range []string{a, b} {
+		status, err = cl.Put(addrs[tc.owners(k)[1]], k, "2")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, status, "write to %s after the transaction", k)
+	}
+
+	// Writes to both shards
+	_, status = txn(TxnRequest{Writes: map[string]any{a: "3"}, Deletes: []string{b}})
+	assert.Equal(t, http.StatusOK, status)
+	for _, k := range []string{a, b} {
+		for _, i := range tc.owners(k) {
+			tc.eventually(func() bool {
+				v, ok := tc.kv(i)[k]
+				return k == a && v == "3" || k == b && !ok
+			}, "replica %d didn't apply the transaction to %s", i, k)
+		}
+	}
+
+	// A transaction conflicting with a prepared one is aborted
+	for _, i := range tc.owners(a) {
+		assert.True(t, tc.nodes[i].txns.Prepare(&TxnPart{Id: "other", Writes: map[string]any{a: "x"}}))
+	}
+	_, status = txn(TxnRequest{Writes: map[string]any{a: "4", b: "4"}})
+	assert.Equal(t, http.StatusConflict, status)
+	for _, i := range tc.owners(b) {
+		assert.NotContains(t, tc.kv(i), b)
+	}
+}
+
+// Check that a prepared transaction locks its keys on every replica of the
+// shard, not only on the participant
+func Test_TxnLocksWholeShard(t *testing.T) {
+	tc := startCluster(t, 2, 1)
+	addrs := tc.addrs()
+	part := TxnPart{Id: "t-1", Coordinator: addrs[0], Participants: addrs[:1], Writes: map[string]any{"k": "txn"}}
+	var vote TxnVote
+	status, err := tc.do(http.MethodPost, addrs[0], "/txn/prepare", part, &vote)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, vote.Commit, vote.Reason)
+
+	cl := tc.client()
+	status, err = cl.Put(addrs[1], "k", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// The abort releases the lock held by the other replica
+	status, err = tc.do(http.MethodPost, addrs[0], "/txn/abort", TxnDecision{Id: part.Id}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	tc.eventually(func() bool { return !tc.nodes[1].txns.IsLocked("k") }, "replica 1 didn't release the lock")
+	status, err = cl.Put(addrs[1], "k", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+}
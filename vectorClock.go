@@ -2,54 +2,81 @@ package main
 
 import (
 	"maps"
+	"slices"
 	"sync"
 )
 
+// VectorClock maps every replica to the number of writes it coordinated, so
+// that it's bounded by the size of the cluster rather than by the number of
+// clients. The entries of the members of a shard form the clock of that
+// shard. Self is the replica that coordinated the write the clock is attached
+// to, and is empty in the causal metadata of clients. Timestamp is the hybrid
+// logical clock timestamp of the write, or the greatest timestamp the clock
+// has observed. Session is the client session the causal metadata belongs to,
+// and is only known to the replica serving the client.
 type VectorClock struct {
-	Clocks map[string]int
-	Self   string
+	Clocks    map[string]int
+	Self      string
+	Timestamp *Timestamp `json:",omitempty"`
+	Session   string     `json:",omitempty"`
 }
 
 func (vc *VectorClock) IsReadyFor(clientClock VectorClock, isRead bool, vcLock *sync.Mutex) bool {
 	// Returns true if I have satisfied all dependencies for the client clock.
 	vcLock.Lock()
 	defer vcLock.Unlock()
-	if isRead {
-		clk, present := vc.Clocks[clientClock.Self]
-		clientSelfClock := clientClock.Clocks[clientClock.Self]
 
-		return present && (clk >= clientSelfClock)
+	// Client requests only need every write the client depends on to be applied
+	if isRead || clientClock.Self == "" {
+		for replica, clientEntry := range clientClock.Clocks {
+			if vc.Clocks[replica] < clientEntry {
+				return false
+			}
+		}
+		return true
 	}
 
-	isReady := true
-
-	// Check if I know about all clients this client knows about, I'm not ready if I don't.
-	// Check if all my clock's entries are greater than or equal the client's corresponding ones apart from that of this client, who should only have one new write, namely, this one.
+	// A write replicated by the replica that coordinated it must also be the
+	// next write of that replica, so that its writes are applied in order.
+	for replica, clientEntry := range clientClock.Clocks {
+		nodeEntry := vc.Clocks[replica]
 
-	for client, clientEntry := range clientClock.Clocks {
-		nodeEntry, present := vc.Clocks[client]
-
-		if client == clientClock.Self {
-			isReady = isReady && nodeEntry == clientEntry
+		if replica == clientClock.Self {
+			if nodeEntry != clientEntry {
+				return false
+			}
 			continue
 		}
 
-		isReady = isReady && present && nodeEntry >= clientEntry
+		if nodeEntry < clientEntry {
+			return false
+		}
 	}
 
-	return isReady
+	return true
+}
+
+// HasApplied returns true if vc has already accepted the write that carried
+// clientClock, i.e. the message is a duplicate of one delivered before
+func (vc *VectorClock) HasApplied(clientClock VectorClock, vcLock *sync.Mutex) bool {
+	if clientClock.Self == "" {
+		return false
+	}
+	vcLock.Lock()
+	defer vcLock.Unlock()
+	return vc.Clocks[clientClock.Self] > clientClock.Clocks[clientClock.Self]
 }
 
 // Compare returns the following:
-// -1 if vc < vc2
-// 0 if vc <= vc2
+// -1 if vc < vc2 or the two clocks are concurrent
+// 0 if vc == vc2
 // 1 if vc > vc2
 func (vc *VectorClock) Compare(vc2 *VectorClock) int {
 	// If all entries of vc >= vc2, and all clients in vc2 are in vc, vc > vc2.
 	clients := getAllClients(vc.Clocks, vc2.Clocks)
 
-	vcGreater := false
-	vcLess := false
+	vcGreater := true
+	vcLess := true
 
 	for client := range clients {
 		vcEntry := vc.Clocks[client]
@@ -78,31 +105,98 @@ func (vc *VectorClock) Accept(clientClock *VectorClock, isRead bool, vcLock *syn
 
 		clientClock.Clocks[clientClock.Self] = clientClock.Clocks[clientClock.Self] + 1
 
+		// Inherit the dependencies of the write on other shards, so that
+		// readers of the shard depend on them too
+		for replica, entry := range clientClock.Clocks {
+			if entry > vc.Clocks[replica] {
+				vc.Clocks[replica] = entry
+			}
+		}
+		vc.observe(clientClock.Timestamp)
+
 		return
 	}
 
-	maps.Copy(clientClock.Clocks, vc.Clocks)
+	for replica, entry := range vc.Clocks {
+		if entry > clientClock.Clocks[replica] {
+			clientClock.Clocks[replica] = entry
+		}
+	}
+	clientClock.observe(vc.Timestamp)
 }
 
-func GetClientVectorClock(request *Request, clientIP string) VectorClock {
-	var clientClock VectorClock
+// observe raises the timestamp of vc to ts
+func (vc *VectorClock) observe(ts *Timestamp) {
+	if ts == nil {
+		return
+	}
+	if vc.Timestamp == nil || ts.Compare(*vc.Timestamp) > 0 {
+		t := *ts
+		vc.Timestamp = &t
+	}
+}
 
-	if len(request.CausalMetadata.Clocks) > 0 {
-		clientClock = request.CausalMetadata
-	} else {
-		clientClock = VectorClock{Clocks: make(map[string]int), Self: clientIP}
-		clientClock.Clocks[clientIP] = 0
+// timestamp returns the timestamp of vc, or the zero timestamp if it has none
+func (vc *VectorClock) timestamp() Timestamp {
+	if vc.Timestamp == nil {
+		return Timestamp{}
 	}
+	return *vc.Timestamp
+}
 
+// GetClientVectorClock returns the causal metadata of a request. Clients
+// don't coordinate writes, so Self is only kept for writes replicated by the
+// replica that coordinated them. The session was resolved by the Sessions
+// middleware and is dropped.
+func GetClientVectorClock(request *Request) VectorClock {
+	clientClock := CloneVC(request.CausalMetadata)
+	clientClock.Session = ""
+	if !request.IsBroadcast {
+		clientClock.Self = ""
+	}
 	return clientClock
 }
 
+// nextWriteClock returns the clock of the next write coordinated by the
+// replica: the dependencies of the client, with the replica as Self at the
+// number of writes it coordinated so far, stamped with a hybrid logical clock
+// timestamp greater than every timestamp the client and the replica have
+// observed. Accepting the clock, here or at
+// another replica, counts the write. The caller must hold r.coordLock until
+// the write is accepted and its broadcasts are enqueued, so that the writes of
+// the replica are broadcast in order.
+func (r *Replica) nextWriteClock(clientClock VectorClock) VectorClock {
+	clock := CloneVC(clientClock)
+	clock.Self = r.addr
+	r.vcLock.Lock()
+	clock.Clocks[r.addr] = r.vc.Clocks[r.addr]
+	r.vcLock.Unlock()
+	ts := r.hlc.Update(clientClock.timestamp())
+	clock.Timestamp = &ts
+	return clock
+}
+
+// restrictVC returns the entries of vc for the given replicas. Each shard only
+// tracks the writes coordinated by its members, so the dependencies of a
+// request are checked against the entries of the shard serving it.
+func restrictVC(vc VectorClock, replicas []string) VectorClock {
+	restricted := VectorClock{Self: vc.Self, Clocks: make(map[string]int)}
+	for replica, entry := range vc.Clocks {
+		if replica == vc.Self || slices.Contains(replicas, replica) {
+			restricted.Clocks[replica] = entry
+		}
+	}
+	return restricted
+}
+
 func CloneVC(src VectorClock) VectorClock {
 	copiedClock := VectorClock{
-		Self:   src.Self,
-		Clocks: make(map[string]int),
+		Self:    src.Self,
+		Session: src.Session,
+		Clocks:  make(map[string]int),
 	}
 	maps.Copy(copiedClock.Clocks, src.Clocks)
+	copiedClock.observe(src.Timestamp)
 	return copiedClock
 }
 
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test IsReadyFor:
+// IsReadyFor compares the causal metadata of a request with the clock of the
+// replica. Clocks count the writes coordinated by each replica. Client requests
+// are ready once the replica applied every write they depend on, while a write
+// replicated by the replica that coordinated it (Self) must also be the next
+// write of that replica.
+
+// Client requests:
+// 1. If the request depends on writes of a replica the server knows nothing of => not ready.
+func Test_IsReadyForClientUnkReplica(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 10, "C": 12}}
+	clientVc := VectorClock{Clocks: map[string]int{"B": 9, "C": 12, "D": 2}}
+
+	assert.False(t, serverVc.IsReadyFor(clientVc, true, &lock))
+	assert.False(t, serverVc.IsReadyFor(clientVc, false, &lock))
+}
+
+// 2. If the request depends on writes the server hasn't applied => not ready.
+func Test_IsReadyForClientUnkWrites(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 8, "C": 13}}
+	clientVc := VectorClock{Clocks: map[string]int{"B": 9, "C": 12}}
+
+	assert.False(t, serverVc.IsReadyFor(clientVc, true, &lock))
+}
+
+// 3. Else => ready, whether it's a read or a write.
+func Test_IsReadyForClientKnown(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 10, "C": 12, "D": 2}}
+	clientVc := VectorClock{Clocks: map[string]int{"B": 9, "C": 12}}
+
+	assert.True(t, serverVc.IsReadyFor(clientVc, true, &lock))
+	assert.True(t, serverVc.IsReadyFor(clientVc, false, &lock))
+}
+
+// Replicated writes:
+// 1. If the write depends on writes of other replicas the server hasn't applied => not ready.
+func Test_IsReadyForReplicatedUnkWrites(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 8, "C": 11}}
+	clientVc := VectorClock{Self: "B", Clocks: map[string]int{"B": 8, "C": 12}}
+
+	assert.False(t, serverVc.IsReadyFor(clientVc, false, &lock))
+}
+
+// 2. If earlier writes of the coordinator haven't arrived yet => not ready.
+func Test_IsReadyForReplicatedGap(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 8, "C": 12}}
+	clientVc := VectorClock{Self: "B", Clocks: map[string]int{"B": 9, "C": 12}}
+
+	assert.False(t, serverVc.IsReadyFor(clientVc, false, &lock))
+}
+
+// 3. If the write is the next write of the coordinator and the server knows of
+// as many or more writes of the other replicas => ready.
+func Test_IsReadyForReplicatedNext(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 8, "C": 12, "D": 1}}
+
+	exact := VectorClock{Self: "B", Clocks: map[string]int{"B": 8, "C": 12}}
+	assert.True(t, serverVc.IsReadyFor(exact, false, &lock))
+
+	older := VectorClock{Self: "B", Clocks: map[string]int{"B": 8, "C": 10}}
+	assert.True(t, serverVc.IsReadyFor(older, false, &lock))
+}
+
+// 4. If the server already applied the write - an old message is still
+// floating around => not ready, and it's reported as applied.
+func Test_IsReadyForReplicatedOld(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"B": 8, "C": 12}}
+	clientVc := VectorClock{Self: "B", Clocks: map[string]int{"B": 7, "C": 12}}
+
+	assert.False(t, serverVc.IsReadyFor(clientVc, false, &lock))
+	assert.True(t, serverVc.HasApplied(clientVc, &lock))
+
+	next := VectorClock{Self: "B", Clocks: map[string]int{"B": 8, "C": 12}}
+	assert.False(t, serverVc.HasApplied(next, &lock))
+	// Client requests are never duplicates
+	assert.False(t, serverVc.HasApplied(VectorClock{Clocks: map[string]int{"B": 1}}, &lock))
+}
+
+// Test Accept
+// Accept takes the clock of a request and updates the replica's and the
+// request's clocks assuming the operation is accepted.
+
+// Read:
+// 1. the client should get the entries of the server it doesn't have
+// (transferred causal dependencies) and the server should remain untouched
+// (no new writes).
+func Test_AcceptRead(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"D": 10, "B": 5, "C": 10}}
+	clientVc := &VectorClock{Clocks: map[string]int{"A": 9, "B": 5}}
+
+	serverVc.Accept(clientVc, true, &lock)
+
+	assert.Equal(t, map[string]int{"D": 10, "B": 5, "C": 10}, serverVc.Clocks)
+	assert.Equal(t, map[string]int{"A": 9, "D": 10, "B": 5, "C": 10}, clientVc.Clocks)
+}
+
+// Write:
+// 1. the coordinator's entry should be incremented on both clocks, and the
+// server should inherit the other dependencies of the write.
+func Test_AcceptWrite(t *testing.T) {
+	var lock sync.Mutex
+	serverVc := &VectorClock{Self: "A", Clocks: map[string]int{"D": 10, "B": 5, "C": 10}}
+	clientVc := &VectorClock{Self: "B", Clocks: map[string]int{"E": 9, "B": 5, "C": 10}}
+
+	serverVc.Accept(clientVc, false, &lock)
+
+	assert.Equal(t, map[string]int{"D": 10, "B": 6, "C": 10, "E": 9}, serverVc.Clocks)
+	assert.Equal(t, map[string]int{"E": 9, "B": 6, "C": 10}, clientVc.Clocks)
+}
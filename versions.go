@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxVersions = 10
+	versionGCInterval  = 10 * time.Second
+)
+
+// Version is a value a key held, along with the client clock of the write
+// that produced it. Deletions are kept as versions too.
+type Version struct {
+	Version   string      `json:"version"`
+	Value     any         `json:"value,omitempty"`
+	Deleted   bool        `json:"deleted,omitempty"`
+	Clock     VectorClock `json:"clock"`
+	WrittenAt time.Time   `json:"written-at"`
+}
+
+// VersionPolicy bounds the history kept for each key. The latest version of a
+// key is always kept.
+type VersionPolicy struct {
+	MaxVersions int
+	// Retention, if positive, drops versions older than it
+	Retention time.Duration
+}
+
+func parseVersionPolicy(maxVersions string, retention string) VersionPolicy {
+	policy := VersionPolicy{MaxVersions: defaultMaxVersions}
+	if maxVersions != "" {
+		n, err := strconv.Atoi(maxVersions)
+		if err != nil || n < 1 {
+			panic("VERSION_MAX_COUNT must be a positive integer")
+		}
+		policy.MaxVersions = n
+	}
+	if retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			panic(err)
+		}
+		policy.Retention = d
+	}
+	return policy
+}
+
+// setKey writes value to key and records it as a new version. The siblings of
+// the key are left as they are. The caller must hold r.kvLock.
+func (r *Replica) setKey(key string, value any, clock VectorClock) {
+	r.kv[key] = value
+	r.addVersion(key, Version{Value: value, Clock: CloneVC(clock)})
+}
+
+// deleteKey deletes key and records the deletion as a new version. The
+// siblings of the key are left as they are. The caller must hold r.kvLock.
+func (r *Replica) deleteKey(key string, clock VectorClock) {
+	delete(r.kv, key)
+	r.addVersion(key, Version{Deleted: true, Clock: CloneVC(clock)})
+}
+
+// writtenAt returns the physical time of the write's hybrid logical clock
+// timestamp, which is the same on every replica, or the time the replica
+// applied the version if the write wasn't stamped
+func (v Version) writtenAt() time.Time {
+	if v.Clock.Timestamp != nil {
+		return v.Clock.Timestamp.Wall
+	}
+	return v.WrittenAt
+}
+
+// versionId returns the id of the version written at ts. Versions are
+// identified by the hybrid logical clock timestamp of their write, so a
+// version has the same id on every replica.
+func versionId(ts Timestamp) string {
+	return fmt.Sprintf("%d-%d-%s", ts.Wall.UnixNano(), ts.Logical, ts.Node)
+}
+
+func (r *Replica) addVersion(key string, v Version) {
+	v.WrittenAt = time.Now()
+	v.Version = versionId(Timestamp{Wall: v.writtenAt()})
+	if v.Clock.Timestamp != nil {
+		v.Version = versionId(*v.Clock.Timestamp)
+	}
+	r.versions[key] = append(r.versions[key], v)
+}
+
+// latestVersion returns the last version of key. The caller must hold
+// r.kvLock.
+func (r *Replica) latestVersion(key string) (Version, bool) {
+	history := r.versions[key]
+	if len(history) == 0 {
+		return Version{}, false
+	}
+	return history[len(history)-1], true
+}
+
+// resetVersions replaces the dotted version vectors of the keys with dvvs, and
+// drops the history of the keys the replica no longer holds. The history of a
+// key is kept if its latest version is the current value of the key, and the
+// current value is recorded as a new version otherwise, identified by the
+// timestamp of the winning sibling so that it matches the other replicas. The
+// caller must hold r.kvLock.
+func (r *Replica) resetVersions(dvvs map[string]*KeyDVV) {
+	history := r.versions
+	r.versions = make(map[string][]Version)
+	r.dvvs = dvvs
+	if r.dvvs == nil {
+		r.dvvs = make(map[string]*KeyDVV)
+	}
+	for k, v := range r.kv {
+		r.versions[k] = history[k]
+		var ts *Timestamp
+		if d, ok := r.dvvs[k]; ok && len(d.Siblings) > 0 {
+			ts = d.winner().Timestamp
+		}
+		latest, ok := r.latestVersion(k)
+		if ok && !latest.Deleted && (ts != nil && latest.Version == versionId(*ts) || ts == nil && reflect.DeepEqual(latest.Value, v)) {
+			continue
+		}
+		r.addVersion(k, Version{Value: v, Clock: VectorClock{Timestamp: ts}})
+	}
+}
+
+// asOfCausalMetadata selects the latest version within the causal past of the
+// client instead of a point in time
+const asOfCausalMetadata = "causal-metadata"
+
+// findVersion returns the version of key selected by the version or as-of
+// query parameters
+func (r *Replica) findVersion(key string, version string, asOf string, clientClock VectorClock) (Version, bool, error) {
+	var match func(v Version) bool
+	switch {
+	case version != "":
+		match = func(v Version) bool { return v.Version == version }
+	case asOf == asOfCausalMetadata:
+		// Versions installed by anti-entropy, read repair or a reshard only
+		// know the timestamp of their write, not its clock, so whether the
+		// client observed them is unknown
+		match = func(v Version) bool { return len(v.Clock.Clocks) > 0 && clientClock.Compare(&v.Clock) >= 0 }
+	default:
+		at, err := time.Parse(time.RFC3339Nano, asOf)
+		if err != nil {
+			return Version{}, false, err
+		}
+		match = func(v Version) bool { return !v.writtenAt().After(at) }
+	}
+
+	r.kvLock.RLock()
+	defer r.kvLock.RUnlock()
+	history := r.versions[key]
+	for i := len(history) - 1; i >= 0; i-- {
+		if match(history[i]) {
+			return history[i], true, nil
+		}
+	}
+	return Version{}, false, nil
+}
+
+// handleVersionGet serves a read of the value a key held at a given version
+// (?version=), at a point in time (?as-of=, in RFC 3339 format) or at the
+// client's causal metadata (?as-of=causal-metadata). Like any read, it waits
+// until the replica applied the writes the client depends on, whose versions
+// the history would miss otherwise. The clock of the version is merged into
+// the client's causal metadata.
+func (r *Replica) handleVersionGet(c echo.Context, key string, clientClock VectorClock) error {
+	ready, err := r.waitReady(c, clientClock, true)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: err.Error()})
+	}
+	if !ready {
+		return c.JSON(
+			http.StatusServiceUnavailable,
+			ErrResponse{Error: "Causal Dependencies not satisfied; try again later"},
+		)
+	}
+
+	v, ok, err := r.findVersion(key, c.QueryParam("version"), c.QueryParam("as-of"), clientClock)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "invalid version or as-of"})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Version does not exist"})
+	}
+	if v.Deleted {
+		return c.JSON(http.StatusNotFound, ErrResponse{Error: "Key was deleted at version " + v.Version})
+	}
+
+	for client, entry := range v.Clock.Clocks {
+		if entry > clientClock.Clocks[client] {
+			clientClock.Clocks[client] = entry
+		}
+	}
+	return c.JSON(http.StatusOK, GetResponse{
+		Response: Response{
+			Result:         "found",
+			CausalMetadata: clientClock,
+			ShardId:        r.getShardId(),
+		},
+		StoreValue: StoreValue{Value: v.Value},
+		Version:    v.Version,
+	})
+}
+
+// isHistoricalRead returns whether the request reads an older version of a key
+func isHistoricalRead(c echo.Context) bool {
+	return c.Request().Method == http.MethodGet && (c.QueryParam("version") != "" || c.QueryParam("as-of") != "")
+}
+
+// gcVersions drops the versions outside of the version policy
+func (r *Replica) gcVersions() int {
+	r.kvLock.Lock()
+	defer r.kvLock.Unlock()
+
+	dropped := 0
+	cutoff := time.Now().Add(-r.versionPolicy.Retention)
+	for key, history := range r.versions {
+		keep := min(len(history), r.versionPolicy.MaxVersions)
+		if r.versionPolicy.Retention > 0 {
+			for keep > 1 && history[len(history)-keep].WrittenAt.Before(cutoff) {
+				keep--
+			}
+			// Forget deleted keys entirely once their deletion expired
+			if latest := history[len(history)-1]; latest.Deleted && latest.WrittenAt.Before(cutoff) {
+				keep = 0
+			}
+		}
+		if keep == len(history) {
+			continue
+		}
+		dropped += len(history) - keep
+		if keep == 0 {
+			delete(r.versions, key)
+			continue
+		}
+		r.versions[key] = append([]Version(nil), history[len(history)-keep:]...)
+	}
+	return dropped
+}
+
+// runVersionGC periodically garbage-collects old versions
+func (r *Replica) runVersionGC() {
+	for r.sleep(versionGCInterval) {
+		if dropped := r.gcVersions(); dropped > 0 {
+			zap.L().Info("Garbage-collected versions", zap.Int("dropped", dropped))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newVersionTestReplica(policy VersionPolicy) *Replica {
+	return &Replica{
+		kv:            make(map[string]any),
+		versions:      make(map[string][]Version),
+		versionPolicy: policy,
+	}
+}
+
+func Test_FindVersion(t *testing.T) {
+	r := newVersionTestReplica(VersionPolicy{MaxVersions: 10})
+	ts := func(sec int64) *Timestamp { return &Timestamp{Wall: time.Unix(sec, 0), Node: "a"} }
+	r.setKey("x", "a", VectorClock{Clocks: map[string]int{"c1": 1}, Timestamp: ts(1)})
+	r.setKey("x", "b", VectorClock{Clocks: map[string]int{"c1": 1, "c2": 1}, Timestamp: ts(3)})
+	r.deleteKey("x", VectorClock{Clocks: map[string]int{"c1": 2, "c2": 1}, Timestamp: ts(4)})
+
+	// Versions are identified by the timestamp of their write
+	v, ok, err := r.findVersion("x", versionId(*ts(3)), "", VectorClock{})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "b", v.Value)
+
+	v, ok, _ = r.findVersion("x", versionId(*ts(4)), "", VectorClock{})
+	assert.True(t, ok)
+	assert.True(t, v.Deleted)
+
+	v, ok, _ = r.findVersion("x", "", time.Unix(2, 0).Format(time.RFC3339Nano), VectorClock{})
+	assert.True(t, ok)
+	assert.Equal(t, versionId(*ts(1)), v.Version)
+
+	// The latest version within the client's causal past
+	v, ok, _ = r.findVersion("x", "", asOfCausalMetadata, VectorClock{Clocks: map[string]int{"c1": 1, "c2": 3}})
+	assert.True(t, ok)
+	assert.Equal(t, "b", v.Value)
+
+	// Versions without a clock aren't known to be in anyone's causal past
+	r.setKey("x", "c", VectorClock{Timestamp: ts(5)})
+	v, ok, _ = r.findVersion("x", "", asOfCausalMetadata, VectorClock{Clocks: map[string]int{"c1": 1, "c2": 3}})
+	assert.True(t, ok)
+	assert.Equal(t, "b", v.Value)
+	_, ok, _ = r.findVersion("x", "", asOfCausalMetadata, VectorClock{Clocks: make(map[string]int)})
+	assert.False(t, ok)
+
+	_, ok, _ = r.findVersion("x", "4", "", VectorClock{})
+	assert.False(t, ok)
+	_, _, err = r.findVersion("x", "", "yesterday", VectorClock{})
+	assert.Error(t, err)
+}
+
+// Check that a reset keeps the history of the keys whose value didn't change,
+// and records the new values under the timestamp of their write
+func Test_ResetVersionsKeepsIds(t *testing.T) {
+	r := newVersionTestReplica(VersionPolicy{MaxVersions: 10})
+	r.dvvs = make(map[string]*KeyDVV)
+	ts := func(sec int64) *Timestamp { return &Timestamp{Wall: time.Unix(sec, 0), Node: "a"} }
+	r.applyDVV("x", nil, Dot{Id: "a", Counter: 1}, "a", false, VectorClock{Timestamp: ts(1)})
+	r.applyDVV("x", map[string]int{"a": 1}, Dot{Id: "a", Counter: 2}, "b", false, VectorClock{Timestamp: ts(2)})
+	r.applyDVV("y", nil, Dot{Id: "a", Counter: 1}, "c", false, VectorClock{Timestamp: ts(3)})
+	before := r.versions["x"]
+
+	// The replica receives a newer value of y from another replica
+	y := r.dvvs["y"].clone()
+	y.update(maps.Clone(y.VV), Dot{Id: "b", Counter: 1}, "d", false, ts(5))
+	r.kv["y"] = "d"
+	r.resetVersions(map[string]*KeyDVV{"x": r.dvvs["x"], "y": y})
+
+	assert.Equal(t, before, r.versions["x"])
+	assert.Len(t, r.versions["y"], 2)
+	latest, _ := r.latestVersion("y")
+	assert.Equal(t, versionId(*ts(5)), latest.Version)
+	assert.Equal(t, "d", latest.Value)
+}
+
+// Check that a write has the same version id on every replica
+func Test_VersionIdsMatchAcrossReplicas(t *testing.T) {
+	tc := startCluster(t, 3, 1)
+	addrs := tc.addrs()
+	_, err := tc.client().Put(addrs[0], "k", "v")
+	assert.NoError(t, err)
+	res, _, err := tc.client().Get(addrs[0], "k")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, res.Version)
+
+	for i := range tc.nodes {
+		assert.Eventually(t, func() bool {
+			history := tc.versions(i, "k")
+			return len(history) == 1 && history[0].Version == res.Version
+		}, 2*time.Second, 10*time.Millisecond, "replica %d", i)
+	}
+}
+
+func Test_GCVersions(t *testing.T) {
+	r := newVersionTestReplica(VersionPolicy{MaxVersions: 2, Retention: time.Hour})
+	for i := 0; i < 5; i++ {
+		r.setKey("x", i, VectorClock{})
+	}
+	r.setKey("y", 0, VectorClock{})
+	r.deleteKey("y", VectorClock{})
+	r.versions["y"][1].WrittenAt = time.Now().Add(-2 * time.Hour)
+
+	assert.Equal(t, 5, r.gcVersions())
+	assert.Len(t, r.versions["x"], 2)
+	assert.Equal(t, 4, r.versions["x"][1].Value)
+	assert.NotContains(t, r.versions, "y")
+}
+
+// Check that a historical read waits for the writes the client depends on
+// instead of answering from an older history
+func Test_VersionReadWaitsForDependencies(t *testing.T) {
+	tc := startCluster(t, 2, 1)
+	addrs := tc.addrs()
+	cl := tc.client()
+	_, err := cl.Put(addrs[0], "k", "v1")
+	assert.NoError(t, err)
+	tc.eventually(func() bool { return len(tc.versions(1, "k")) == 1 }, "replica 1 didn't apply v1")
+
+	// Replica 1 misses v2
+	tc.nodes[0].outbox.Stop()
+	_, err = cl.Put(addrs[0], "k", "v2")
+	assert.NoError(t, err)
+
+	var res GetResponse
+	asOf := url.QueryEscape(time.Now().Add(time.Minute).Format(time.RFC3339Nano))
+	status, err := tc.do(http.MethodGet, addrs[1], "/kvs/k?as-of="+asOf, Request{CausalMetadata: cl.clock}, &res)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	status, err = tc.do(http.MethodGet, addrs[0], "/kvs/k?as-of="+asOf, Request{CausalMetadata: cl.clock}, &res)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "v2", res.Value)
+}
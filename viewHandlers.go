@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"slices"
@@ -29,21 +28,40 @@ type BufferAtSenderRequest struct {
 
 	// Targets to send the request to
 	Targets []string
+
+	// Hint, if set, hands off requests to targets that fail to respond to the
+	// hint store instead of deleting them from the view
+	Hint *Hint
+
+	// Op decides the timeout of the requests, unless Timeout is set
+	Op Operation `json:",omitempty"`
+	// Timeout, if set, replaces the default timeout of requests sent by
+	// BroadcastFirst
+	Timeout time.Duration
 }
 
-func sendViewRequest(method string, addr string, socketAddr string, path string) (*http.Response, error) {
+func (replica *Replica) sendViewRequest(method string, addr string, socketAddr string, path string) (*http.Response, error) {
 	payload := map[string]string{
 		"socket-address": socketAddr,
 	}
 	endpoint := "/view" + path
-	return SendRequest(HttpRequest{
+	return replica.transport.Send(HttpRequest{
 		method:   method,
 		endpoint: endpoint,
 		addr:     addr,
 		payload:  payload,
+		op:       OpHealth,
 	})
 }
 
+// removeFromView deletes addr from the view of the replica, which broadcasts
+// the deletion to the rest of the view
+func (replica *Replica) removeFromView(addr string) {
+	if res, err := replica.sendViewRequest(http.MethodDelete, replica.addr, addr, ""); err == nil {
+		drain(res)
+	}
+}
+
 // FilterViews removes `exclude` from the list of `views`
 func FilterViews(views []string, exclude ...string) []string {
 	var newViews []string
@@ -62,23 +80,15 @@ func (replica *Replica) handleViewPut(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "Bad Request"})
 	}
 
-	if len(replica.View) == 0 {
-		replica.View = append(replica.View, replica.addr)
-	}
-
-	for _, addr := range replica.View {
-		if addr == socket.Address {
-			return c.JSON(http.StatusOK, ResponseNC{Result: "already present"})
-		}
+	if !replica.addToView(socket.Address) {
+		return c.JSON(http.StatusOK, ResponseNC{Result: "already present"})
 	}
 
-	replica.View = append(replica.View, socket.Address)
-
 	payload := map[string]string{
 		"socket-address": socket.Address,
 	}
 
-	replica.BufferAtSender(&BufferAtSenderRequest{
+	replica.broadcastChange(&BroadcastRequest{
 		Method:   http.MethodPut,
 		Payload:  payload,
 		Endpoint: "/view",
@@ -88,13 +98,54 @@ func (replica *Replica) handleViewPut(c echo.Context) error {
 	return c.JSON(http.StatusOK, ResponseNC{Result: "added"})
 }
 
-func (replica *Replica) handleViewGet(c echo.Context) error {
-	if len(replica.View) == 0 {
-		replica.View = append(replica.View, replica.addr)
+// addToView adds addr to the view and returns whether it wasn't there yet
+func (replica *Replica) addToView(addr string) bool {
+	replica.shardLock.Lock()
+	defer replica.shardLock.Unlock()
+	view := replica.View
+	if len(view) == 0 {
+		view = []string{replica.addr}
+	}
+	if slices.Contains(view, addr) {
+		return false
+	}
+	replica.View = append(slices.Clone(view), addr)
+	return true
+}
+
+// deleteFromView deletes addr from the view and returns whether it was there
+func (replica *Replica) deleteFromView(addr string) bool {
+	replica.shardLock.Lock()
+	defer replica.shardLock.Unlock()
+	if !slices.Contains(replica.View, addr) {
+		return false
+	}
+	replica.View = FilterViews(replica.View, addr)
+	return true
+}
+
+// broadcastChange sends a change of the view or the shards to br.Targets and
+// waits for them to apply it. Targets that don't respond are deleted from the
+// view, and the ones that answer with a 503 get the change through the outbox.
+func (replica *Replica) broadcastChange(br *BroadcastRequest) {
+	for _, fr := range replica.Broadcast(br) {
+		if fr.err != nil {
+			replica.removeFromView(fr.address)
+			continue
+		}
+		retry := *br
+		retry.Targets = []string{fr.address}
+		replica.BufferAtSender(&retry)
 	}
-	return c.JSON(http.StatusOK, replica.ViewInfo)
 }
 
+func (replica *Replica) handleViewGet(c echo.Context) error {
+	return c.JSON(http.StatusOK, ViewInfo{View: replica.getView()})
+}
+
+// BufferAtSender queues the request in the outbox of every target and returns
+// without waiting for it to be delivered. Requests are retried on 503s, while
+// targets that don't respond are handled by handleUnreachable.
 func (replica *Replica) BufferAtSender(pr *BufferAtSenderRequest) error {
 	switch pr.Method {
 	case http.MethodPut, http.MethodDelete:
@@ -103,42 +154,14 @@ func (replica *Replica) BufferAtSender(pr *BufferAtSenderRequest) error {
 		return errors.New(fmt.Sprintf("invalid method %s", pr.Method))
 	}
 
-	conns := pr.Targets
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*15)
-	defer cancel()
-
-	for {
-		zap.L().Info("Sending requests to the following replicas", zap.Strings("conns", conns), zap.String("method", pr.Method), zap.String("endpoint", pr.Endpoint))
-		select {
-		case <-ctx.Done():
-			zap.L().Error("BufferAtSender timed out")
-			return errors.New("timed out")
-		default:
-			failingReqs := Broadcast(pr)
-			// Retry the broadcast request
-			var toRetry []string
-			for _, val := range failingReqs {
-				if val.err == nil {
-					toRetry = append(toRetry, val.address)
-				} else {
-					// Delete the view if it got a non-503 error
-					zap.L().Warn("Deleting view", zap.String("address", val.address))
-					sendViewRequest(http.MethodDelete, replica.addr, val.address, "")
-				}
-			}
-			if len(toRetry) == 0 {
-				return nil
-			}
-			conns = toRetry
-			time.Sleep(200 * time.Millisecond)
-		}
-	}
+	zap.L().Info("Queueing requests to the following replicas", zap.Strings("conns", pr.Targets), zap.String("method", pr.Method), zap.String("endpoint", pr.Endpoint))
+	return replica.outbox.Enqueue(pr)
 }
 
 func (replica *Replica) handleViewDelete(c echo.Context) error {
-	zap.L().Info("In DELETE /view", zap.Strings("view", replica.View))
+	zap.L().Info("In DELETE /view", zap.Strings("view", replica.getView()))
 	defer func() {
-		zap.L().Info("Exiting DELETE /view", zap.Strings("view", replica.View))
+		zap.L().Info("Exiting DELETE /view", zap.Strings("view", replica.getView()))
 	}()
 	var socket SocketAddress
 	err := c.Bind(&socket)
@@ -147,34 +170,23 @@ func (replica *Replica) handleViewDelete(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "Bad Request"})
 	}
 
-	if len(replica.View) == 0 {
-		replica.View = append(replica.View, replica.addr)
-	}
-
 	if replica.addr == socket.Address {
 		zap.L().Error("Can't delete Self")
 		return c.JSON(http.StatusBadRequest, ErrResponse{Error: "Can't Delete Self"})
 	}
 
-	var new_view []string
-	for _, addr := range replica.View {
-		if socket.Address != addr {
-			new_view = append(new_view, addr)
-		}
-	}
-
-	if len(new_view) != len(replica.View) {
-		replica.View = new_view
+	if replica.deleteFromView(socket.Address) {
+		replica.removeChainMember(socket.Address)
 		if !socket.IsBroadcast {
 			payload := map[string]any{
 				"socket-address": socket.Address,
 				"is-broadcast":   true,
 			}
-			replica.BufferAtSender(&BufferAtSenderRequest{
+			replica.broadcastChange(&BroadcastRequest{
 				Method:   http.MethodDelete,
 				Payload:  payload,
 				Endpoint: "/view",
-				Targets:  FilterViews(replica.View, socket.Address),
+				Targets:  FilterViews(replica.getView(), socket.Address),
 			})
 
 		}